@@ -0,0 +1,292 @@
+package kv_db
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"kv-db/util"
+	"kv-db/wal"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	backupManifestName = "BACKUP"
+	backupVersion      = 1
+)
+
+var ErrInvalidBackup = errors.New("invalid backup archive")
+
+// BackupToken describes the files of a backup, the next backup made with it only contains the files created
+// or changed since then. The empty token makes a full backup.
+type BackupToken string
+
+// backupStamp identifies the content of a file, the sealed files are never modified but replaced by merge.
+type backupStamp struct {
+	Size    int64 `json:"size"`
+	ModTime int64 `json:"mtime"`
+}
+
+// backupManifest is the first entry of the archive, Files are all files of the DB when the backup is made,
+// the files not in the archive are the same as in the previous backup.
+type backupManifest struct {
+	Version     int                    `json:"version"`
+	Incremental bool                   `json:"incremental"`
+	Files       map[string]backupStamp `json:"files"`
+}
+
+type backupFile struct {
+	name  string
+	file  *os.File
+	stamp backupStamp
+}
+
+func (t BackupToken) stamps() (map[string]backupStamp, error) {
+	stamps := make(map[string]backupStamp)
+	if len(t) == 0 {
+		return stamps, nil
+	}
+	if err := json.Unmarshal([]byte(t), &stamps); err != nil {
+		return nil, fmt.Errorf("invalid backup token: %w", err)
+	}
+	return stamps, nil
+}
+
+// Backup writes a tar archive of the sealed segments and their hint files to w while the DB is being written,
+// the active segment is sealed first like Checkpoint. If since is the token returned by a previous backup,
+// only the files created or changed after it are written. The archive is restored by Restore.
+func (db *DB) Backup(w io.Writer, since BackupToken) (BackupToken, error) {
+	if db.closed {
+		return "", ErrDBClosed
+	}
+	if db.options.ReadOnly {
+		return "", ErrReadOnly
+	}
+
+	prev, err := since.stamps()
+	if err != nil {
+		return "", err
+	}
+
+	files, err := db.openBackupFiles()
+	defer func() {
+		for _, f := range files {
+			_ = f.file.Close()
+		}
+	}()
+	if err != nil {
+		return "", err
+	}
+
+	manifest := &backupManifest{
+		Version:     backupVersion,
+		Incremental: len(since) > 0,
+		Files:       make(map[string]backupStamp, len(files)),
+	}
+	for _, f := range files {
+		manifest.Files[f.name] = f.stamp
+	}
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return "", err
+	}
+
+	tw := tar.NewWriter(w)
+	if err = writeTarEntry(tw, backupManifestName, int64(len(data)), time.Now(), bytes.NewReader(data)); err != nil {
+		return "", err
+	}
+	for _, f := range files {
+		if stamp, ok := prev[f.name]; ok && stamp == f.stamp {
+			continue
+		}
+		if err = writeTarEntry(tw, f.name, f.stamp.Size, time.Unix(0, f.stamp.ModTime), f.file); err != nil {
+			return "", err
+		}
+	}
+	if err = tw.Close(); err != nil {
+		return "", err
+	}
+
+	token, err := json.Marshal(manifest.Files)
+	if err != nil {
+		return "", err
+	}
+	return BackupToken(token), nil
+}
+
+// openBackupFiles seals the active segment and opens the files of the sealed segments, the opened files
+// are not changed by the merges after it returns.
+func (db *DB) openBackupFiles() ([]*backupFile, error) {
+	db.mergeMu.Lock()
+	defer db.mergeMu.Unlock()
+
+	db.mu.Lock()
+	prevSegId, err := db.wal.SwitchNewSegmentForce()
+	db.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	names, err := db.checkpointFiles(prevSegId)
+	if err != nil {
+		return nil, err
+	}
+
+	files := make([]*backupFile, 0, len(names))
+	for _, name := range names {
+		file, err := os.Open(filepath.Join(db.options.Dir, name))
+		if err != nil {
+			return files, err
+		}
+		files = append(files, &backupFile{name: name, file: file})
+
+		info, err := file.Stat()
+		if err != nil {
+			return files, err
+		}
+		files[len(files)-1].stamp = backupStamp{Size: info.Size(), ModTime: info.ModTime().UnixNano()}
+	}
+	return files, nil
+}
+
+func writeTarEntry(tw *tar.Writer, name string, size int64, modTime time.Time, r io.Reader) error {
+	header := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Size:     size,
+		Mode:     0644,
+		ModTime:  modTime,
+	}
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err := io.CopyN(tw, r, size)
+	return err
+}
+
+// Restore restores the archive written by DB.Backup to dir. An incremental backup must be restored to the dir
+// which the previous backups are restored to, and the dir must not be opened as a DB between the restores.
+func Restore(r io.Reader, dir string) error {
+	tr := tar.NewReader(r)
+	header, err := tr.Next()
+	if err != nil || header.Name != backupManifestName {
+		return ErrInvalidBackup
+	}
+	data, err := ioutil.ReadAll(tr)
+	if err != nil {
+		return err
+	}
+	manifest := &backupManifest{}
+	if err = json.Unmarshal(data, manifest); err != nil || manifest.Version != backupVersion {
+		return ErrInvalidBackup
+	}
+	for name := range manifest.Files {
+		if !isBackupFileName(name) {
+			return fmt.Errorf("%w: unexpected file %s", ErrInvalidBackup, name)
+		}
+	}
+
+	if err = os.MkdirAll(dir, os.ModePerm); err != nil {
+		return err
+	}
+	if !manifest.Incremental {
+		if err = removeBackupFiles(dir, nil); err != nil {
+			return err
+		}
+	}
+
+	for {
+		header, err = tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if _, ok := manifest.Files[header.Name]; !ok || header.Typeflag != tar.TypeReg {
+			return fmt.Errorf("%w: unexpected file %s", ErrInvalidBackup, header.Name)
+		}
+		if err = restoreFile(tr, filepath.Join(dir, header.Name)); err != nil {
+			return err
+		}
+	}
+
+	// the files not in the archive are restored by the previous backups
+	for name := range manifest.Files {
+		if _, err = os.Stat(filepath.Join(dir, name)); err != nil {
+			if os.IsNotExist(err) {
+				return fmt.Errorf("%s is not restored, the previous backups must be restored first", name)
+			}
+			return err
+		}
+	}
+	if err = removeBackupFiles(dir, manifest.Files); err != nil {
+		return err
+	}
+	return util.SyncDir(dir)
+}
+
+func restoreFile(r io.Reader, path string) error {
+	tmpPath := path + ".tmp"
+	f, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	if _, err = io.Copy(f, r); err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(tmpPath)
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// removeBackupFiles removes the segments, the hint files and the fin file in dir which are not kept.
+func removeBackupFiles(dir string, keep map[string]backupStamp) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		name := entry.Name()
+		if _, ok := keep[name]; ok || entry.IsDir() {
+			continue
+		}
+		if isBackupFileName(name) {
+			if err = os.Remove(filepath.Join(dir, name)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// isBackupFileName reports whether name is a file written by Backup: a segment, its hint file, a file of the hint wal
+// or the fin file. The names in an archive are checked with it, so the files are only restored in the directory.
+func isBackupFileName(name string) bool {
+	if name == MergeFinSuffix {
+		return true
+	}
+	for _, suffix := range []string{wal.SegmentSuffix, SegmentHintSuffix, HintSuffix} {
+		if !strings.HasSuffix(name, suffix) {
+			continue
+		}
+		// the ids are formatted as %09d
+		if id := strings.TrimSuffix(name, suffix); len(id) == 9 && strings.Trim(id, "0123456789") == "" {
+			return true
+		}
+	}
+	return false
+}
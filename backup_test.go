@@ -0,0 +1,198 @@
+package kv_db
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"kv-db/wal"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestDB_Backup(t *testing.T) {
+	options := DefaultOptions
+	options.Dir = t.TempDir()
+	options.SegmentSize = 64 * wal.KB
+	db, err := openDB(options)
+	assert.Nil(t, err)
+	defer deleteDB(db)
+
+	for i := 0; i < 5000; i++ {
+		assert.Nil(t, db.Put([]byte(strconv.Itoa(i)), []byte("value"+strconv.Itoa(i))))
+	}
+	// the hint files are built in background, the ones built after the full backup would be in the incremental one
+	segmentIds := db.wal.SegmentIds()
+	assert.Eventually(t, func() bool {
+		for _, id := range segmentIds[:len(segmentIds)-1] {
+			if _, err := os.Stat(wal.JoinSegmentPath(options.Dir, SegmentHintSuffix, id)); err != nil {
+				return false
+			}
+		}
+		return true
+	}, 5*time.Second, 10*time.Millisecond)
+	full := &bytes.Buffer{}
+	token, err := db.Backup(full, "")
+	assert.Nil(t, err)
+
+	// the incremental backup only contains the new segments
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Put([]byte(strconv.Itoa(i)), []byte("new"+strconv.Itoa(i))))
+	}
+	assert.Nil(t, db.Delete([]byte("100")))
+	incremental := &bytes.Buffer{}
+	token2, err := db.Backup(incremental, token)
+	assert.Nil(t, err)
+	assert.NotEqual(t, token, token2)
+	assert.True(t, incremental.Len() < full.Len()/2)
+
+	restoreDir := filepath.Join(t.TempDir(), "restore")
+	assert.NotNil(t, Restore(bytes.NewReader(incremental.Bytes()), restoreDir))
+	assert.Nil(t, Restore(bytes.NewReader(full.Bytes()), restoreDir))
+	assert.Nil(t, Restore(bytes.NewReader(incremental.Bytes()), restoreDir))
+	assert.Equal(t, ErrInvalidBackup, Restore(bytes.NewReader([]byte("garbage")), restoreDir))
+
+	restoreOptions := options
+	restoreOptions.Dir = restoreDir
+	restored, err := openDB(restoreOptions)
+	assert.Nil(t, err)
+	defer deleteDB(restored)
+	for i := 0; i < 5000; i++ {
+		value, err := restored.Get([]byte(strconv.Itoa(i)))
+		if i == 100 {
+			assert.Equal(t, ErrKeyNotFound, err)
+			continue
+		}
+		assert.Nil(t, err)
+		if i < 100 {
+			assert.Equal(t, []byte("new"+strconv.Itoa(i)), value)
+		} else {
+			assert.Equal(t, []byte("value"+strconv.Itoa(i)), value)
+		}
+	}
+
+	_, err = db.Backup(&bytes.Buffer{}, "invalid")
+	assert.NotNil(t, err)
+}
+
+func TestDB_BackupAfterMerge(t *testing.T) {
+	options := DefaultOptions
+	options.Dir = t.TempDir()
+	options.SegmentSize = 64 * wal.KB
+	db, err := openDB(options)
+	assert.Nil(t, err)
+	defer deleteDB(db)
+
+	for i := 0; i < 5000; i++ {
+		assert.Nil(t, db.Put([]byte(strconv.Itoa(i%1000)), []byte("value"+strconv.Itoa(i))))
+	}
+	// the hint files are built in background, the ones built after the full backup would be in the incremental one
+	segmentIds := db.wal.SegmentIds()
+	assert.Eventually(t, func() bool {
+		for _, id := range segmentIds[:len(segmentIds)-1] {
+			if _, err := os.Stat(wal.JoinSegmentPath(options.Dir, SegmentHintSuffix, id)); err != nil {
+				return false
+			}
+		}
+		return true
+	}, 5*time.Second, 10*time.Millisecond)
+	full := &bytes.Buffer{}
+	token, err := db.Backup(full, "")
+	assert.Nil(t, err)
+
+	// the merged segments replace the old ones, which are removed when restored
+	assert.Nil(t, db.merge())
+	incremental := &bytes.Buffer{}
+	_, err = db.Backup(incremental, token)
+	assert.Nil(t, err)
+
+	restoreDir := t.TempDir()
+	assert.Nil(t, Restore(full, restoreDir))
+	assert.Nil(t, Restore(incremental, restoreDir))
+	assert.Equal(t, db.wal.SegmentIds()[:len(db.wal.SegmentIds())-1], segmentIdsIn(t, restoreDir))
+
+	restoreOptions := options
+	restoreOptions.Dir = restoreDir
+	restored, err := openDB(restoreOptions)
+	assert.Nil(t, err)
+	defer deleteDB(restored)
+	for i := 0; i < 1000; i++ {
+		value, err := restored.Get([]byte(strconv.Itoa(i)))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("value"+strconv.Itoa(i+4000)), value)
+	}
+}
+
+func TestRestore_HostileArchive(t *testing.T) {
+	// the archive of the files in the manifest and the entries, which are symlinks if typeflag is tar.TypeSymlink
+	archive := func(files []string, entries []string, typeflag byte) *bytes.Buffer {
+		manifest := &backupManifest{Version: backupVersion, Incremental: true, Files: make(map[string]backupStamp)}
+		for _, name := range files {
+			manifest.Files[name] = backupStamp{Size: 3}
+		}
+		data, err := json.Marshal(manifest)
+		assert.Nil(t, err)
+
+		buf := &bytes.Buffer{}
+		tw := tar.NewWriter(buf)
+		assert.Nil(t, writeTarEntry(tw, backupManifestName, int64(len(data)), time.Now(), bytes.NewReader(data)))
+		for _, name := range entries {
+			if typeflag == tar.TypeSymlink {
+				assert.Nil(t, tw.WriteHeader(&tar.Header{Typeflag: typeflag, Name: name, Linkname: "../LOCK", Mode: 0644}))
+				continue
+			}
+			assert.Nil(t, writeTarEntry(tw, name, 3, time.Now(), bytes.NewReader([]byte("abc"))))
+		}
+		assert.Nil(t, tw.Close())
+		return buf
+	}
+
+	parent := t.TempDir()
+	dir := filepath.Join(parent, "restore")
+	for _, tt := range []struct {
+		name     string
+		files    []string
+		entries  []string
+		typeflag byte
+	}{
+		{"dot dot", []string{".."}, []string{".."}, tar.TypeReg},
+		{"dot", []string{"."}, []string{"."}, tar.TypeReg},
+		{"parent dir", []string{"../000000001.seg"}, []string{"../000000001.seg"}, tar.TypeReg},
+		{"absolute", []string{"/tmp/000000001.seg"}, []string{"/tmp/000000001.seg"}, tar.TypeReg},
+		{"other file", []string{LockFileName}, []string{LockFileName}, tar.TypeReg},
+		{"bad id", []string{"1.seg"}, []string{"1.seg"}, tar.TypeReg},
+		{"not in manifest", []string{"000000001.seg"}, []string{"000000002.seg"}, tar.TypeReg},
+		{"symlink", []string{"000000001.seg"}, []string{"000000001.seg"}, tar.TypeSymlink},
+	} {
+		err := Restore(archive(tt.files, tt.entries, tt.typeflag), dir)
+		assert.ErrorIs(t, err, ErrInvalidBackup, tt.name)
+	}
+
+	// nothing is written out of the directory
+	entries, err := os.ReadDir(parent)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(entries))
+	entries, err = os.ReadDir(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(entries))
+
+	// the valid names are restored
+	assert.Nil(t, Restore(archive([]string{"000000001.seg", "000000001.hnt", "000000002.hint", MergeFinSuffix},
+		[]string{"000000001.seg", "000000001.hnt", "000000002.hint", MergeFinSuffix}, tar.TypeReg), dir))
+}
+
+func segmentIdsIn(t *testing.T, dir string) []uint32 {
+	paths, err := filepath.Glob(filepath.Join(dir, "*"+wal.SegmentSuffix))
+	assert.Nil(t, err)
+
+	var ids []uint32
+	for _, path := range paths {
+		id, err := strconv.Atoi(filepath.Base(path)[:9])
+		assert.Nil(t, err)
+		ids = append(ids, uint32(id))
+	}
+	return ids
+}
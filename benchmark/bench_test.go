@@ -2,10 +2,13 @@ package benchmark
 
 import (
 	"errors"
+	"fmt"
 	"github.com/stretchr/testify/assert"
 	kvDB "kv-db"
+	"kv-db/wal"
 	"os"
 	"strconv"
+	"strings"
 	"testing"
 )
 
@@ -64,3 +67,43 @@ func benchmarkGet(b *testing.B) {
 		}
 	}
 }
+
+func BenchmarkBlockSize(b *testing.B) {
+	for _, blockSize := range []uint32{wal.MinBlockSize, wal.DefaultBlockSize, 256 * wal.KB, wal.MaxBlockSize} {
+		for _, valueSize := range []int{16, 4 * wal.KB, 128 * wal.KB} {
+			b.Run(fmt.Sprintf("block-%dKB/value-%dB", blockSize/wal.KB, valueSize), func(b *testing.B) {
+				benchmarkBlockSize(b, blockSize, valueSize)
+			})
+		}
+	}
+}
+
+func benchmarkBlockSize(b *testing.B, blockSize uint32, valueSize int) {
+	var options = kvDB.DefaultOptions
+	options.Dir = dir
+	options.BlockSize = blockSize
+
+	db, err := kvDB.Open(options)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer func() {
+		_ = db.Close()
+		_ = os.RemoveAll(dir)
+	}()
+
+	val := []byte(strings.Repeat("x", valueSize))
+	b.SetBytes(int64(valueSize))
+	b.ResetTimer()
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		key := []byte(strconv.Itoa(i % 10000))
+		if err := db.Put(key, val); err != nil {
+			b.Fatal(err)
+		}
+		if _, err := db.Get(key); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
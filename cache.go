@@ -0,0 +1,126 @@
+package kv_db
+
+import (
+	"container/list"
+	"sync"
+)
+
+// valueCache is a LRU cache of the decoded values of hot keys, its size is the bytes of keys and values.
+// All methods are safe to be called on a nil cache, which caches nothing.
+type valueCache struct {
+	capacity int64
+	used     int64
+	mu       sync.Mutex
+	lru      *list.List
+	entries  map[string]*list.Element
+}
+
+type valueCacheEntry struct {
+	key    string
+	value  []byte
+	expire int64
+}
+
+func newValueCache(size int64) *valueCache {
+	if size <= 0 {
+		return nil
+	}
+
+	return &valueCache{
+		capacity: size,
+		lru:      list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+}
+
+func (c *valueCache) get(key []byte) ([]byte, int64, bool) {
+	if c == nil {
+		return nil, 0, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.entries[string(key)]; ok {
+		c.lru.MoveToFront(e)
+		entry := e.Value.(*valueCacheEntry)
+		return entry.value, entry.expire, true
+	}
+	return nil, 0, false
+}
+
+// put caches the value, the value must not be modified after it is put.
+func (c *valueCache) put(key []byte, value []byte, expire int64) {
+	if c == nil {
+		return
+	}
+
+	size := int64(len(key) + len(value))
+	if size > c.capacity {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.removeLocked(string(key))
+	c.entries[string(key)] = c.lru.PushFront(&valueCacheEntry{
+		key:    string(key),
+		value:  value,
+		expire: expire,
+	})
+	c.used += size
+
+	for c.used > c.capacity {
+		oldest := c.lru.Back()
+		c.removeLocked(oldest.Value.(*valueCacheEntry).key)
+	}
+}
+
+func (c *valueCache) remove(key []byte) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.removeLocked(string(key))
+}
+
+func (c *valueCache) removeLocked(key string) {
+	if e, ok := c.entries[key]; ok {
+		entry := e.Value.(*valueCacheEntry)
+		c.lru.Remove(e)
+		delete(c.entries, key)
+		c.used -= int64(len(entry.key) + len(entry.value))
+	}
+}
+
+func (c *valueCache) clear() {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.lru.Init()
+	c.entries = make(map[string]*list.Element)
+	c.used = 0
+}
+
+func (c *valueCache) size() int {
+	if c == nil {
+		return 0
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
+
+func cloneBytes(b []byte) []byte {
+	ret := make([]byte, len(b))
+	copy(ret, b)
+	return ret
+}
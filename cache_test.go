@@ -0,0 +1,123 @@
+package kv_db
+
+import (
+	"github.com/stretchr/testify/assert"
+	"kv-db/wal"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestValueCache_PutGet(t *testing.T) {
+	c := newValueCache(100)
+
+	c.put([]byte("a"), []byte("1"), 0)
+	val, expire, ok := c.get([]byte("a"))
+	assert.True(t, ok)
+	assert.Equal(t, []byte("1"), val)
+	assert.Equal(t, int64(0), expire)
+
+	c.remove([]byte("a"))
+	_, _, ok = c.get([]byte("a"))
+	assert.False(t, ok)
+}
+
+func TestValueCache_Evict(t *testing.T) {
+	c := newValueCache(10)
+
+	// every entry takes 5 bytes
+	c.put([]byte("a"), []byte("1111"), 0)
+	c.put([]byte("b"), []byte("2222"), 0)
+	_, _, ok := c.get([]byte("a"))
+	assert.True(t, ok)
+
+	c.put([]byte("c"), []byte("3333"), 0)
+	_, _, ok = c.get([]byte("b"))
+	assert.False(t, ok)
+	assert.Equal(t, 2, c.size())
+
+	// larger than the whole cache
+	c.put([]byte("d"), []byte("4444444444"), 0)
+	_, _, ok = c.get([]byte("d"))
+	assert.False(t, ok)
+
+	c.clear()
+	assert.Equal(t, 0, c.size())
+}
+
+func TestValueCache_Nil(t *testing.T) {
+	var c *valueCache = newValueCache(0)
+	assert.Nil(t, c)
+
+	c.put([]byte("a"), []byte("1"), 0)
+	_, _, ok := c.get([]byte("a"))
+	assert.False(t, ok)
+	c.remove([]byte("a"))
+	c.clear()
+	assert.Equal(t, 0, c.size())
+}
+
+func TestDB_GetWithValueCache(t *testing.T) {
+	db, err := Open(Options{
+		Dir:            t.TempDir(),
+		SegmentSize:    1024 * wal.KB,
+		ValueCacheSize: 1 * wal.MB,
+	})
+	assert.Nil(t, err)
+	defer deleteDB(db)
+
+	val := []byte("xxxx")
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Put([]byte(strconv.Itoa(i)), val))
+	}
+
+	for i := 0; i < 100; i++ {
+		ret, err := db.Get([]byte(strconv.Itoa(i)))
+		assert.Nil(t, err)
+		assert.Equal(t, val, ret)
+	}
+	assert.Equal(t, 100, db.valueCache.size())
+
+	// the returned value is a copy of the cached one
+	ret, err := db.Get([]byte("0"))
+	assert.Nil(t, err)
+	ret[0] = 'y'
+	ret, err = db.Get([]byte("0"))
+	assert.Nil(t, err)
+	assert.Equal(t, val, ret)
+
+	// put invalidates the cached value
+	val2 := []byte("yyyy")
+	assert.Nil(t, db.Put([]byte("1"), val2))
+	ret, err = db.Get([]byte("1"))
+	assert.Nil(t, err)
+	assert.Equal(t, val2, ret)
+
+	// delete invalidates the cached value
+	assert.Nil(t, db.Delete([]byte("2")))
+	_, err = db.Get([]byte("2"))
+	assert.Equal(t, ErrKeyNotFound, err)
+}
+
+func TestDB_GetWithValueCacheExpired(t *testing.T) {
+	db, err := Open(Options{
+		Dir:            t.TempDir(),
+		SegmentSize:    1024 * wal.KB,
+		ValueCacheSize: 1 * wal.MB,
+	})
+	assert.Nil(t, err)
+	defer deleteDB(db)
+
+	key := []byte("a")
+	assert.Nil(t, db.PutWithTTL(key, []byte("1"), 50*time.Millisecond))
+
+	_, err = db.Get(key)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, db.valueCache.size())
+
+	time.Sleep(60 * time.Millisecond)
+	_, err = db.Get(key)
+	assert.Equal(t, ErrKeyNotFound, err)
+	assert.Equal(t, 0, db.valueCache.size())
+	assert.Equal(t, 0, db.indexer.Size())
+}
@@ -0,0 +1,99 @@
+package kv_db
+
+import (
+	"kv-db/util"
+	"kv-db/wal"
+	"os"
+	"path/filepath"
+)
+
+// Checkpoint makes a consistent copy of the DB in dir while it is being written, dir must not exist and can be opened
+// as a DB. The active segment is sealed first, then the sealed segments and their hint files are hard linked,
+// or copied if dir is on another file system. The records written after Checkpoint starts are not in the copy.
+func (db *DB) Checkpoint(dir string) error {
+	if db.closed {
+		return ErrDBClosed
+	}
+	if db.options.ReadOnly {
+		return ErrReadOnly
+	}
+
+	// merge and the hint builder replace and remove the files, they wait until the files are linked
+	db.mergeMu.Lock()
+	defer db.mergeMu.Unlock()
+
+	db.mu.Lock()
+	prevSegId, err := db.wal.SwitchNewSegmentForce()
+	db.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if err = os.MkdirAll(filepath.Dir(dir), os.ModePerm); err != nil {
+		return err
+	}
+	if err = os.Mkdir(dir, os.ModePerm); err != nil {
+		return err
+	}
+
+	// the linked segments are shared with the DB, so the copy writes to a new segment when it is opened
+	active, err := wal.Open(wal.Options{
+		Dir:               dir,
+		SegmentSize:       db.options.SegmentSize,
+		SegmentFileSuffix: wal.SegmentSuffix,
+		Checksum:          db.options.Checksum,
+		RecordHash:        db.options.RecordHash,
+		BlockSize:         db.options.BlockSize,
+		FirstSegmentId:    prevSegId + 1,
+	})
+	if err != nil {
+		return err
+	}
+	if err = active.Close(); err != nil {
+		return err
+	}
+
+	files, err := db.checkpointFiles(prevSegId)
+	if err != nil {
+		return err
+	}
+	for _, name := range files {
+		if err = util.LinkOrCopyFile(filepath.Join(db.options.Dir, name), filepath.Join(dir, name)); err != nil {
+			return err
+		}
+	}
+	return util.SyncDir(dir)
+}
+
+// checkpointFiles returns the names of the sealed segments up to maxId, their hint files, and the hint wal and
+// the merge fin file written by the old versions.
+func (db *DB) checkpointFiles(maxId uint32) ([]string, error) {
+	var files []string
+	for _, id := range db.wal.SegmentIds() {
+		if id > maxId {
+			break
+		}
+
+		files = append(files, filepath.Base(wal.JoinSegmentPath(db.options.Dir, wal.SegmentSuffix, id)))
+		hintPath := wal.JoinSegmentPath(db.options.Dir, SegmentHintSuffix, id)
+		if _, err := os.Stat(hintPath); err == nil {
+			files = append(files, filepath.Base(hintPath))
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+
+	legacyPaths, err := filepath.Glob(filepath.Join(db.options.Dir, "*"+HintSuffix))
+	if err != nil {
+		return nil, err
+	}
+	if _, err = os.Stat(filepath.Join(db.options.Dir, MergeFinSuffix)); err == nil {
+		legacyPaths = append(legacyPaths, filepath.Join(db.options.Dir, MergeFinSuffix))
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, path := range legacyPaths {
+		files = append(files, filepath.Base(path))
+	}
+	return files, nil
+}
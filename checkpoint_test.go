@@ -0,0 +1,69 @@
+package kv_db
+
+import (
+	"github.com/stretchr/testify/assert"
+	"kv-db/wal"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestDB_Checkpoint(t *testing.T) {
+	options := DefaultOptions
+	options.Dir = t.TempDir()
+	options.SegmentSize = 64 * wal.KB
+	db, err := openDB(options)
+	assert.Nil(t, err)
+	defer deleteDB(db)
+
+	for i := 0; i < 5000; i++ {
+		assert.Nil(t, db.Put([]byte(strconv.Itoa(i)), []byte("value"+strconv.Itoa(i))))
+	}
+
+	// the writes go on during the checkpoint
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 5000; i++ {
+			_ = db.Put([]byte("new"+strconv.Itoa(i)), []byte("value"))
+		}
+	}()
+	checkpointDir := filepath.Join(t.TempDir(), "checkpoint")
+	assert.Nil(t, db.Checkpoint(checkpointDir))
+	wg.Wait()
+	assert.NotNil(t, db.Checkpoint(checkpointDir))
+
+	// the sealed segments are linked
+	src, err := os.Stat(wal.JoinSegmentPath(options.Dir, wal.SegmentSuffix, 1))
+	assert.Nil(t, err)
+	dest, err := os.Stat(wal.JoinSegmentPath(checkpointDir, wal.SegmentSuffix, 1))
+	assert.Nil(t, err)
+	assert.True(t, os.SameFile(src, dest))
+
+	// the DB and the copy are changed independently
+	assert.Nil(t, db.merge())
+	cpOptions := options
+	cpOptions.Dir = checkpointDir
+	cp, err := openDB(cpOptions)
+	assert.Nil(t, err)
+	defer deleteDB(cp)
+	assert.Nil(t, cp.Put([]byte("1"), []byte("changed")))
+
+	for i := 0; i < 5000; i++ {
+		value, err := db.Get([]byte(strconv.Itoa(i)))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("value"+strconv.Itoa(i)), value)
+
+		if i != 1 {
+			value, err = cp.Get([]byte(strconv.Itoa(i)))
+			assert.Nil(t, err)
+			assert.Equal(t, []byte("value"+strconv.Itoa(i)), value)
+		}
+	}
+	value, err := cp.Get([]byte("1"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("changed"), value)
+}
@@ -0,0 +1,381 @@
+// Command kvdb inspects and edits a kv-db directory from the shell.
+//
+//	kvdb [-dir <dir>] [-segment-size n] [-block-size n] <command> [flags] [args]
+//
+// The DB must not be opened by another writer for put, del, merge and import. The read commands open the DB
+// read-only, so they can run while the DB is served. -segment-size and -block-size must be the options the DB is
+// written with, or else put, merge and import rotate the segments at a different size.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	kvDB "kv-db"
+	"kv-db/wal"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+type command struct {
+	name  string
+	usage string
+	run   func(e *env, args []string) error
+}
+
+var commands = []*command{
+	{"get", "get <key>", runGet},
+	{"put", "put [-ttl duration] <key> <value>", runPut},
+	{"del", "del <key>", runDel},
+	{"scan", "scan [-prefix prefix] [-limit n]", runScan},
+	{"stats", "stats", runStats},
+	{"merge", "merge", runMerge},
+	{"verify", "verify [-skip-hints] [-max-issues n]", runVerify},
+	{"export", "export [-prefix prefix] [-ttl] [-o file]", runExport},
+	{"import", "import [-i file]", runImport},
+	{"dump-segment", "dump-segment <segment file>", runDumpSegment},
+}
+
+// errUsage makes the command print its usage.
+var errUsage = errors.New("invalid arguments")
+
+// errFailed exits with 1 without printing more, the command has printed the failure itself.
+var errFailed = errors.New("failed")
+
+// env is what the commands run with, the options of the DB are set by the global flags.
+type env struct {
+	options kvDB.Options
+	stdin   io.Reader
+	stdout  io.Writer
+}
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+// run runs the command line args and returns the exit code.
+func run(args []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) int {
+	e := &env{options: kvDB.DefaultOptions, stdin: stdin, stdout: stdout}
+	fs := flag.NewFlagSet("kvdb", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		usage(stderr)
+	}
+	fs.StringVar(&e.options.Dir, "dir", ".", "the directory of the DB")
+	fs.Int64Var(&e.options.SegmentSize, "segment-size", kvDB.DefaultOptions.SegmentSize, "the max bytes of a segment")
+	blockSize := fs.Uint("block-size", uint(kvDB.DefaultOptions.BlockSize), "the block size of the new segments")
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return 0
+		}
+		return 2
+	}
+	e.options.BlockSize = uint32(*blockSize)
+	if fs.NArg() == 0 {
+		usage(stderr)
+		return 2
+	}
+
+	name := fs.Arg(0)
+	for _, cmd := range commands {
+		if cmd.name != name {
+			continue
+		}
+		err := cmd.run(e, fs.Args()[1:])
+		if err == errUsage {
+			fmt.Fprintf(stderr, "usage: kvdb -dir <dir> %s\n", cmd.usage)
+			return 2
+		}
+		if err == errFailed {
+			return 1
+		}
+		if err != nil {
+			fmt.Fprintf(stderr, "kvdb %s: %v\n", name, err)
+			return 1
+		}
+		return 0
+	}
+
+	fmt.Fprintf(stderr, "kvdb: unknown command %q\n", name)
+	usage(stderr)
+	return 2
+}
+
+func usage(w io.Writer) {
+	fmt.Fprintln(w, "usage: kvdb [-dir <dir>] [-segment-size n] [-block-size n] <command> [flags] [args]")
+	fmt.Fprintln(w, "\ncommands:")
+	for _, cmd := range commands {
+		fmt.Fprintf(w, "  %s\n", cmd.usage)
+	}
+}
+
+func (e *env) openDB(readOnly bool) (*kvDB.DB, error) {
+	options := e.options
+	options.ReadOnly = readOnly
+	if readOnly {
+		// the read-only DB fails on a missing directory instead of creating an empty DB
+		if _, err := os.Stat(options.Dir); err != nil {
+			return nil, err
+		}
+	}
+	return kvDB.Open(options)
+}
+
+// withDB opens the DB, runs fn and closes the DB, the error of fn is returned first.
+func (e *env) withDB(readOnly bool, fn func(db *kvDB.DB) error) (err error) {
+	db, err := e.openDB(readOnly)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := db.Close(); err == nil {
+			err = closeErr
+		}
+	}()
+	return fn(db)
+}
+
+func parseFlags(fs *flag.FlagSet, args []string, nArgs int) error {
+	fs.SetOutput(ioutil.Discard)
+	if err := fs.Parse(args); err != nil || fs.NArg() != nArgs {
+		return errUsage
+	}
+	return nil
+}
+
+func runGet(e *env, args []string) error {
+	fs := flag.NewFlagSet("get", flag.ContinueOnError)
+	if err := parseFlags(fs, args, 1); err != nil {
+		return err
+	}
+
+	return e.withDB(true, func(db *kvDB.DB) error {
+		value, err := db.Get([]byte(fs.Arg(0)))
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(e.stdout, "%s\n", value)
+		return err
+	})
+}
+
+func runPut(e *env, args []string) error {
+	fs := flag.NewFlagSet("put", flag.ContinueOnError)
+	ttl := fs.Duration("ttl", 0, "the time to live of the key, 0 means the key does not expire")
+	if err := parseFlags(fs, args, 2); err != nil {
+		return err
+	}
+
+	return e.withDB(false, func(db *kvDB.DB) error {
+		return db.PutWithTTL([]byte(fs.Arg(0)), []byte(fs.Arg(1)), *ttl)
+	})
+}
+
+func runDel(e *env, args []string) error {
+	fs := flag.NewFlagSet("del", flag.ContinueOnError)
+	if err := parseFlags(fs, args, 1); err != nil {
+		return err
+	}
+
+	return e.withDB(false, func(db *kvDB.DB) error {
+		return db.Delete([]byte(fs.Arg(0)))
+	})
+}
+
+func runScan(e *env, args []string) error {
+	fs := flag.NewFlagSet("scan", flag.ContinueOnError)
+	prefix := fs.String("prefix", "", "only print the keys with the prefix")
+	limit := fs.Int("limit", 0, "print at most this many keys, 0 means no limit")
+	if err := parseFlags(fs, args, 0); err != nil {
+		return err
+	}
+
+	return e.withDB(true, func(db *kvDB.DB) error {
+		var count int
+		var err error
+		scanErr := db.Scan([]byte(*prefix), func(key []byte, value []byte) bool {
+			_, err = fmt.Fprintf(e.stdout, "%s\t%s\n", key, value)
+			count++
+			return err == nil && (*limit <= 0 || count < *limit)
+		})
+		if scanErr != nil {
+			return scanErr
+		}
+		return err
+	})
+}
+
+func runStats(e *env, args []string) error {
+	fs := flag.NewFlagSet("stats", flag.ContinueOnError)
+	if err := parseFlags(fs, args, 0); err != nil {
+		return err
+	}
+
+	return e.withDB(true, func(db *kvDB.DB) error {
+		stats, err := db.Stats()
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintf(e.stdout, "keys:            %d\n", stats.Keys)
+		fmt.Fprintf(e.stdout, "segments:        %d\n", stats.Segments)
+		fmt.Fprintf(e.stdout, "segments size:   %d\n", stats.SegmentsSize)
+		fmt.Fprintf(e.stdout, "active segment:  %d\n", stats.ActiveSegmentId)
+		fmt.Fprintf(e.stdout, "garbage:         %d (%s)\n", stats.GarbageBytes, ratio(stats.GarbageBytes, stats.SegmentsSize))
+		fmt.Fprintf(e.stdout, "hint files size: %d\n", stats.HintFilesSize)
+
+		ids := make([]uint32, 0, len(stats.SegmentSizes))
+		for id := range stats.SegmentSizes {
+			ids = append(ids, id)
+		}
+		sort.Slice(ids, func(i, j int) bool {
+			return ids[i] < ids[j]
+		})
+		fmt.Fprintf(e.stdout, "\n%-10s %14s\n", "SEGMENT", "SIZE")
+		for _, id := range ids {
+			fmt.Fprintf(e.stdout, "%-10d %14d\n", id, stats.SegmentSizes[id])
+		}
+		return nil
+	})
+}
+
+func ratio(n int64, total int64) string {
+	if total == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.1f%%", float64(n)*100/float64(total))
+}
+
+func runMerge(e *env, args []string) error {
+	fs := flag.NewFlagSet("merge", flag.ContinueOnError)
+	if err := parseFlags(fs, args, 0); err != nil {
+		return err
+	}
+
+	return e.withDB(false, func(db *kvDB.DB) error {
+		start := time.Now()
+		if err := db.Merge(); err != nil {
+			return err
+		}
+		fmt.Fprintf(e.stdout, "merged in %v\n", time.Since(start).Round(time.Millisecond))
+		return nil
+	})
+}
+
+func runVerify(e *env, args []string) error {
+	fs := flag.NewFlagSet("verify", flag.ContinueOnError)
+	skipHints := fs.Bool("skip-hints", false, "only read the segments")
+	maxIssues := fs.Int("max-issues", 0, "stop after this many issues, 0 means no limit")
+	if err := parseFlags(fs, args, 0); err != nil {
+		return err
+	}
+
+	report, err := kvDB.Verify(e.options.Dir, kvDB.VerifyOptions{SkipHintFiles: *skipHints, MaxIssues: *maxIssues})
+	if err != nil {
+		return err
+	}
+	for _, issue := range report.Issues {
+		fmt.Fprintln(e.stdout, issue)
+	}
+	fmt.Fprintf(e.stdout, "%d segments, %d hint files, %d records, %d issues\n",
+		report.Segments, report.HintFiles, report.Records, len(report.Issues))
+	if !report.OK() {
+		return errFailed
+	}
+	return nil
+}
+
+func runExport(e *env, args []string) error {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	prefix := fs.String("prefix", "", "only export the keys with the prefix")
+	ttl := fs.Bool("ttl", false, "export the remaining time to live of the keys")
+	output := fs.String("o", "", "the output file, the standard output by default")
+	if err := parseFlags(fs, args, 0); err != nil {
+		return err
+	}
+
+	w := e.stdout
+	if len(*output) > 0 {
+		f, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			_ = f.Close()
+		}()
+		w = f
+	}
+
+	return e.withDB(true, func(db *kvDB.DB) error {
+		return db.Export(w, kvDB.ExportOptions{Prefix: []byte(*prefix), IncludeTTL: *ttl})
+	})
+}
+
+func runImport(e *env, args []string) error {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	input := fs.String("i", "", "the input file, the standard input by default")
+	if err := parseFlags(fs, args, 0); err != nil {
+		return err
+	}
+
+	r := e.stdin
+	if len(*input) > 0 {
+		f, err := os.Open(*input)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			_ = f.Close()
+		}()
+		r = f
+	}
+
+	return e.withDB(false, func(db *kvDB.DB) error {
+		return db.Import(r)
+	})
+}
+
+// runDumpSegment lists the chunks of a segment file, or a file of the hint wal, the -dir flag is not used.
+func runDumpSegment(e *env, args []string) error {
+	fs := flag.NewFlagSet("dump-segment", flag.ContinueOnError)
+	if err := parseFlags(fs, args, 1); err != nil {
+		return err
+	}
+
+	path := fs.Arg(0)
+	suffix := filepath.Ext(path)
+	var id uint32
+	if _, err := fmt.Sscanf(strings.TrimSuffix(filepath.Base(path), suffix), "%d", &id); err != nil {
+		return fmt.Errorf("%s is not a segment file", path)
+	}
+
+	info, errs, err := wal.ScanChunks(filepath.Dir(path), suffix, id, func(chunk *wal.ChunkInfo) {
+		valid := "ok"
+		if !chunk.Valid {
+			valid = "BAD CHECKSUM"
+		}
+		fmt.Fprintf(e.stdout, "block %-8d offset %-6d %-8s length %-6d %s\n", chunk.BlockIndex, chunk.BlockOffset, chunk.Type, chunk.Length, valid)
+	})
+	if err != nil {
+		return err
+	}
+
+	checksum := "crc32-ieee"
+	if info.Checksum == wal.ChecksumCastagnoli {
+		checksum = "crc32c"
+	}
+	fmt.Fprintf(e.stdout, "\nsegment %d: version %d, checksum %s, block size %d, record hash %v, created %s, %d bytes\n",
+		info.Id, info.Version, checksum, info.BlockSize, info.RecordHash, info.CreateTime.Format(time.RFC3339), info.Size)
+	for _, scanErr := range errs {
+		fmt.Fprintln(e.stdout, scanErr)
+	}
+	if len(errs) > 0 {
+		return errFailed
+	}
+	return nil
+}
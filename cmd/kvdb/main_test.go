@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	kvDB "kv-db"
+	"kv-db/wal"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRun(t *testing.T) {
+	dir := t.TempDir()
+	exportFile := filepath.Join(t.TempDir(), "export.jsonl")
+	segment := filepath.Join(dir, "000000001"+wal.SegmentSuffix)
+	global := []string{"-dir", dir, "-segment-size", "65536", "-block-size", "4096"}
+
+	// the cases run in order on the same DB
+	tests := []struct {
+		name   string
+		args   []string
+		stdin  string
+		code   int
+		stdout []string
+		stderr string
+	}{
+		{name: "no command", code: 2, stderr: "usage: kvdb"},
+		{name: "unknown command", args: []string{"foo"}, code: 2, stderr: `unknown command "foo"`},
+		{name: "put", args: []string{"put", "a", "1"}},
+		{name: "put ttl", args: []string{"put", "-ttl", "1h", "b", "2"}},
+		{name: "invalid block size", args: []string{"-block-size", "1", "put", "a", "1"}, code: 1, stderr: "block size must be"},
+		{name: "put usage", args: []string{"put", "a"}, code: 2, stderr: "usage: kvdb -dir <dir> put"},
+		{name: "get", args: []string{"get", "a"}, stdout: []string{"1\n"}},
+		{name: "get missing", args: []string{"get", "c"}, code: 1, stderr: kvDB.ErrKeyNotFound.Error()},
+		{name: "del", args: []string{"del", "a"}},
+		{name: "import", args: []string{"import"}, stdin: `{"key":"c","value":"3"}` + "\n"},
+		{name: "scan", args: []string{"scan", "-limit", "1"}, stdout: []string{"b\t2\n"}},
+		{name: "scan prefix", args: []string{"scan", "-prefix", "c"}, stdout: []string{"c\t3\n"}},
+		{name: "export", args: []string{"export", "-o", exportFile}},
+		{name: "import file", args: []string{"import", "-i", exportFile}},
+		{name: "export stdout", args: []string{"export", "-prefix", "b"}, stdout: []string{`"key":"b"`, `"value":"2"`}},
+		{name: "dump-segment", args: []string{"dump-segment", segment}, stdout: []string{"block size 4096"}},
+		{name: "merge", args: []string{"merge"}, stdout: []string{"merged in"}},
+		{name: "stats", args: []string{"stats"}, stdout: []string{"keys:            2\n", "SEGMENT"}},
+		{name: "verify", args: []string{"verify"}, stdout: []string{"0 issues"}},
+		{name: "dump-segment missing", args: []string{"dump-segment", filepath.Join(dir, "x.seg")}, code: 1, stderr: "is not a segment file"},
+	}
+	for _, tt := range tests {
+		args := tt.args
+		if tt.name != "no command" {
+			args = append(append([]string{}, global...), tt.args...)
+		}
+		var stdout, stderr bytes.Buffer
+		code := run(args, strings.NewReader(tt.stdin), &stdout, &stderr)
+		assert.Equal(t, tt.code, code, tt.name+": "+stderr.String())
+		for _, s := range tt.stdout {
+			assert.Contains(t, stdout.String(), s, tt.name)
+		}
+		assert.Contains(t, stderr.String(), tt.stderr, tt.name)
+	}
+}
@@ -6,41 +6,94 @@ import (
 	"github.com/valyala/bytebufferpool"
 	"io"
 	"kv-db/index"
+	"kv-db/util"
 	"kv-db/wal"
+	"os"
+	"path/filepath"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 var (
-	ErrEmptyKey    = errors.New("key can not be empty")
-	ErrKeyNotFound = errors.New("key not found")
-	ErrDBClosed    = errors.New("db is closed")
+	ErrEmptyKey       = errors.New("key can not be empty")
+	ErrKeyNotFound    = errors.New("key not found")
+	ErrDBClosed       = errors.New("db is closed")
+	ErrDatabaseLocked = errors.New("the database directory is used by another process")
+	ErrReadOnly       = errors.New("the database is opened read-only")
 )
 
 type DB struct {
 	options         Options
+	lock            *util.FileLock
 	closed          bool
 	mu              sync.RWMutex
 	batchPool       sync.Pool
 	indexer         index.Indexer
 	wal             *wal.Wal
-	hintWal         *wal.Wal
+	blockCache      *wal.BlockCache
+	valueCache      *valueCache
+	garbage         *garbageStats
 	walMergeTask    *cron.Cron
+	mergeMu         sync.Mutex
+	mergeSignal     chan struct{}
+	mergeStop       chan struct{}
+	mergeWg         sync.WaitGroup
+	readLimiter     *util.RateLimiter
+	writeLimiter    *util.RateLimiter
+	activeSegmentId uint32
+	hintMu          sync.Mutex
+	hintPending     []uint32
+	hintSignal      chan struct{}
+	hintStop        chan struct{}
+	hintWg          sync.WaitGroup
 	logRecordHeader []byte
 	recordPool      sync.Pool
+	stats           *opStats
+	// closing is closed when the DB starts closing, the throttled merges and hint builds stop waiting for it
+	closing chan struct{}
 }
 
-func Open(options Options) (*DB, error) {
-	db := &DB{
-		options:         options,
-		indexer:         index.NewIndexer(),
-		logRecordHeader: make([]byte, 21),
-		recordPool: sync.Pool{New: func() interface{} {
-			return &logRecord{}
-		}},
+func Open(options Options) (_ *DB, err error) {
+	if options.ReadOnly {
+		return openReadOnly(options)
+	}
+
+	if err = os.MkdirAll(options.Dir, os.ModePerm); err != nil {
+		return nil, err
+	}
+	lock, err := util.LockFile(filepath.Join(options.Dir, LockFileName))
+	if err != nil {
+		if err == util.ErrLocked {
+			return nil, ErrDatabaseLocked
+		}
+		return nil, err
+	}
+
+	db := newDB(options, lock)
+
+	defer func() {
+		if err != nil {
+			if db.wal != nil {
+				_ = db.wal.Close()
+			}
+			_ = lock.Unlock()
+		}
+	}()
+
+	// the read-only DBs do not create the read lock file, so it is created by the writer
+	if err = util.TouchFile(filepath.Join(options.Dir, ReadLockFileName)); err != nil {
+		return nil, err
+	}
+
+	// complete or discard the merge interrupted by a crash
+	if err = db.installMerge(filepath.Join(options.Dir, mergeDirName)); err != nil {
+		return nil, err
+	}
+	if err = db.removeMergeLeftovers(); err != nil {
+		return nil, err
 	}
 
-	var err error
 	if db.wal, err = db.openWalFiles(); err != nil {
 		return nil, err
 	}
@@ -49,42 +102,160 @@ func Open(options Options) (*DB, error) {
 		return nil, err
 	}
 
+	// the cron expression is checked before any background job is started, so no job is left running on an error
 	if len(options.AutoMergeExpr) > 0 {
 		db.walMergeTask = cron.New(cron.WithParser(cron.NewParser(
 			cron.SecondOptional | cron.Minute | cron.Hour | cron.Dom | cron.Month | cron.Dow | cron.Descriptor,
 		)))
 
-		_, err := db.walMergeTask.AddFunc(options.AutoMergeExpr, func() {
-			_ = db.merge()
-		})
+		_, err := db.walMergeTask.AddFunc(options.AutoMergeExpr, db.autoMerge)
 
 		if err != nil {
 			return nil, err
 		}
+	}
 
+	// build the hint files of the sealed segments which do not have one
+	db.hintSignal = make(chan struct{}, 1)
+	db.hintStop = make(chan struct{})
+	db.hintWg.Add(1)
+	go db.runHintBuilder()
+	segmentIds := db.wal.SegmentIds()
+	db.activeSegmentId = segmentIds[len(segmentIds)-1]
+	db.scheduleHintFiles(segmentIds[:len(segmentIds)-1])
+
+	if db.walMergeTask != nil {
 		db.walMergeTask.Start()
 	}
 
+	if options.MergeGarbageRatio > 0 || options.MergeReclaimableBytes > 0 {
+		db.mergeSignal = make(chan struct{}, 1)
+		db.mergeStop = make(chan struct{})
+		db.mergeWg.Add(1)
+		go db.runAutoMerge()
+		db.scheduleMerge()
+	}
+
 	return db, nil
 }
 
-func (db *DB) Close() error {
-	if err := db.wal.Close(); err != nil {
-		return err
+func newDB(options Options, lock *util.FileLock) *DB {
+	return &DB{
+		lock:            lock,
+		options:         options,
+		indexer:         index.NewIndexer(),
+		blockCache:      wal.NewBlockCache(options.BlockCacheSize),
+		valueCache:      newValueCache(options.ValueCacheSize),
+		garbage:         newGarbageStats(),
+		readLimiter:     util.NewRateLimiter(options.MergeReadRateLimit),
+		writeLimiter:    util.NewRateLimiter(options.MergeWriteRateLimit),
+		logRecordHeader: make([]byte, 21),
+		recordPool: sync.Pool{New: func() interface{} {
+			return &logRecord{}
+		}},
+		stats:   &opStats{},
+		closing: make(chan struct{}),
 	}
+}
 
-	if db.hintWal != nil {
-		if err := db.hintWal.Close(); err != nil {
-			return err
+// openReadOnly opens the DB without the background jobs, an interrupted merge is left to the writer.
+func openReadOnly(options Options) (*DB, error) {
+	lock, err := util.LockFileShared(filepath.Join(options.Dir, ReadLockFileName))
+	if err != nil {
+		if err == util.ErrLocked {
+			return nil, ErrDatabaseLocked
 		}
+		return nil, err
 	}
 
-	if db.walMergeTask != nil {
-		db.walMergeTask.Stop()
+	db := newDB(options, lock)
+	if db.wal, err = db.openWalFiles(); err != nil {
+		_ = lock.Unlock()
+		return nil, err
+	}
+	if err = db.loadIndex(); err != nil {
+		_ = db.wal.Close()
+		_ = lock.Unlock()
+		return nil, err
+	}
+	return db, nil
+}
+
+// Refresh reloads the segments and the index of a read-only DB, so the records written and merged by the writer
+// since the DB is opened or refreshed are visible. It does nothing if the DB is not read-only.
+func (db *DB) Refresh() error {
+	if db.closed {
+		return ErrDBClosed
+	}
+	if !db.options.ReadOnly {
+		return nil
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	oldWal, oldIndexer, oldGarbage := db.wal, db.indexer, db.garbage
+	newWal, err := db.openWalFiles()
+	if err != nil {
+		return err
+	}
+
+	db.wal, db.indexer, db.garbage = newWal, index.NewIndexer(), newGarbageStats()
+	if err = db.loadIndex(); err != nil {
+		_ = newWal.Close()
+		db.wal, db.indexer, db.garbage = oldWal, oldIndexer, oldGarbage
+		return err
+	}
+	db.valueCache.clear()
+	return oldWal.Close()
+}
+
+// stopped reports whether the DB is closing, unlike db.closed it can be checked by the other goroutines.
+func (db *DB) stopped() bool {
+	select {
+	case <-db.closing:
+		return true
+	default:
+		return false
 	}
+}
 
+func (db *DB) Close() error {
+	if db.closed {
+		return nil
+	}
 	db.closed = true
-	return nil
+	close(db.closing)
+
+	// wait for the background jobs, they use the wal
+	if db.walMergeTask != nil {
+		<-db.walMergeTask.Stop().Done()
+	}
+	if db.mergeStop != nil {
+		close(db.mergeStop)
+		db.mergeWg.Wait()
+	}
+	if db.hintStop != nil {
+		close(db.hintStop)
+		db.hintWg.Wait()
+	}
+	// the merge run by the caller of Merge stops at the next record
+	db.mergeMu.Lock()
+	db.mergeMu.Unlock()
+
+	var err error
+	if !db.options.ReadOnly {
+		err = db.garbage.save(db.options.Dir)
+	}
+	if walErr := db.wal.Close(); err == nil {
+		err = walErr
+	}
+
+	// the directory can be opened by others after the lock is released
+	if lockErr := db.lock.Unlock(); err == nil {
+		err = lockErr
+	}
+	return err
 }
 
 func (db *DB) openWalFiles() (*wal.Wal, error) {
@@ -92,20 +263,82 @@ func (db *DB) openWalFiles() (*wal.Wal, error) {
 		Dir:               db.options.Dir,
 		SegmentSize:       db.options.SegmentSize,
 		SegmentFileSuffix: wal.SegmentSuffix,
+		BlockCache:        db.blockCache,
+		MaxOpenSegments:   db.options.MaxOpenSegments,
+		Preallocate:       !db.options.ReadOnly,
+		Checksum:          db.options.Checksum,
+		RecordHash:        db.options.RecordHash,
+		BlockSize:         db.options.BlockSize,
+		ReadOnly:          db.options.ReadOnly,
+		SyncObserver:      db.stats.syncLatency.observe,
+		SwitchObserver:    db.segmentRotated,
 	})
 }
 
+// SetMergeRateLimit changes the max bytes per second read and written by merge and the other background jobs,
+// 0 means no limit. It takes effect on the running jobs too.
+func (db *DB) SetMergeRateLimit(readBytesPerSec, writeBytesPerSec int64) {
+	db.readLimiter.SetRate(readBytesPerSec)
+	db.writeLimiter.SetRate(writeBytesPerSec)
+}
+
+// BlockCacheStats returns the statistics of the block cache, all zero if the cache is disabled.
+func (db *DB) BlockCacheStats() wal.BlockCacheStats {
+	if db.blockCache == nil {
+		return wal.BlockCacheStats{}
+	}
+	return db.blockCache.Stats()
+}
+
 func (db *DB) loadIndex() error {
 	if db.closed {
 		return ErrDBClosed
 	}
 
-	if err := db.loadIndexFromHint(); err != nil {
+	// the segments merged by the old versions are indexed by the hint wal
+	mergeFinSegId, err := db.readMergeFinFile(db.options.Dir)
+	if err != nil {
 		return err
 	}
+	if mergeFinSegId > 0 {
+		if err = db.loadIndexFromHint(); err != nil {
+			return err
+		}
+	}
 
-	if err := db.loadIndexFromWal(); err != nil {
-		return err
+	// the segments are loaded in order, so the newer records of a key replace the older ones
+	now := time.Now().UnixNano()
+	segmentIds := db.wal.SegmentIds()
+	for i, id := range segmentIds {
+		if id <= mergeFinSegId {
+			continue
+		}
+
+		// the hint file of the last segment is written by the writer after it is opened read-only,
+		// and it may index the records after the end of the opened segment
+		if db.options.ReadOnly && i == len(segmentIds)-1 {
+			if err = db.loadIndexFromSegment(id, now); err != nil {
+				return err
+			}
+			continue
+		}
+
+		entries, err := readHintFile(db.options.Dir, id)
+		if err == nil {
+			db.loadIndexFromHintEntries(entries, now)
+			continue
+		}
+		// the segment is read if the hint file is damaged
+		if !os.IsNotExist(err) && !errors.Is(err, errInvalidHintFile) {
+			return err
+		}
+		if errors.Is(err, errInvalidHintFile) {
+			db.corruptionFound(wal.JoinSegmentPath(db.options.Dir, SegmentHintSuffix, id), nil, err)
+		}
+
+		if err = db.loadIndexFromSegment(id, now); err != nil {
+			return err
+		}
 	}
 	return nil
 }
@@ -130,21 +363,24 @@ func (db *DB) loadIndexFromHint() error {
 		}
 
 		key, chunk := decodeHintRecord(data)
-		db.indexer.Put(key, chunk)
+		db.garbage.written(chunk, false)
+		db.garbage.dead(db.indexer.Put(key, chunk))
 	}
 	return nil
 }
 
-func (db *DB) loadIndexFromWal() error {
-	mergeFinSegId, err := db.readMergeFinFile(db.options.Dir)
+func (db *DB) loadIndexFromHintEntries(entries []*hintEntry, now int64) {
+	for _, e := range entries {
+		db.loadRecord(e.recordType, e.expire, e.key, e.pos, now)
+	}
+}
+
+func (db *DB) loadIndexFromSegment(id uint32, now int64) error {
+	walIter, err := db.wal.NewSegmentIterator(id)
 	if err != nil {
 		return err
 	}
 
-	walIter := db.wal.NewIterator()
-	walIter.SkipSegmentLessEqual(mergeFinSegId)
-
-	now := time.Now().UnixNano()
 	for {
 		data, pos, err := walIter.Next()
 		if err != nil {
@@ -155,15 +391,25 @@ func (db *DB) loadIndexFromWal() error {
 		}
 
 		record := decodeLogRecord(data)
-		if record.recordType == recordModified && !record.isExpired(now) {
-			db.indexer.Put(record.key, pos)
-		} else if record.recordType == recordDeleted {
-			db.indexer.Delete(record.key)
-		}
+		db.loadRecord(record.recordType, record.expire, record.key, pos, now)
 	}
 	return nil
 }
 
+// loadRecord indexes a record read from a segment or a hint file. An expired record deletes the key like a delete record,
+// since the older records of the key are not valid any more.
+func (db *DB) loadRecord(recordType recordType, expire int64, key []byte, pos *wal.Chunk, now int64) {
+	if recordType == recordModified && (expire == 0 || expire > now) {
+		db.garbage.written(pos, false)
+		db.garbage.dead(db.indexer.Put(key, pos))
+		return
+	}
+
+	db.garbage.written(pos, true)
+	old, _ := db.indexer.Delete(key)
+	db.garbage.dead(old)
+}
+
 func (db *DB) Put(key []byte, value []byte) error {
 	return db.PutWithTTL(key, value, 0)
 }
@@ -172,11 +418,15 @@ func (db *DB) PutWithTTL(key []byte, value []byte, ttl time.Duration) error {
 	if db.closed {
 		return ErrDBClosed
 	}
+	if db.options.ReadOnly {
+		return ErrReadOnly
+	}
 
 	if len(key) == 0 {
 		return ErrEmptyKey
 	}
 
+	defer db.finishOp("put", &db.stats.putLatency, key, time.Now())
 	db.mu.Lock()
 	r := db.recordPool.Get().(*logRecord)
 	defer func() {
@@ -193,7 +443,11 @@ func (db *DB) PutWithTTL(key []byte, value []byte, ttl time.Duration) error {
 	} else {
 		r.expire = time.Now().Add(ttl).UnixNano()
 	}
-	return db.writeRecord(r)
+	if err := db.writeRecord(r); err != nil {
+		return err
+	}
+	atomic.AddUint64(&db.stats.puts, 1)
+	return nil
 }
 
 func (db *DB) Get(key []byte) ([]byte, error) {
@@ -205,19 +459,36 @@ func (db *DB) Get(key []byte) ([]byte, error) {
 		return nil, ErrEmptyKey
 	}
 
+	defer db.finishOp("get", &db.stats.getLatency, key, time.Now())
 	db.mu.RLock()
 	defer db.mu.RUnlock()
 
+	atomic.AddUint64(&db.stats.gets, 1)
 	now := time.Now().UnixNano()
+	if value, expire, ok := db.valueCache.get(key); ok {
+		if expire == 0 || expire > now {
+			return cloneBytes(value), nil
+		}
+
+		db.valueCache.remove(key)
+		old, _ := db.indexer.Delete(key)
+		db.garbage.dead(old)
+		db.expired()
+		db.expirationSweep("get", 1)
+		return nil, ErrKeyNotFound
+	}
+
 	chunk := db.indexer.Get(key)
 	if chunk == nil {
+		atomic.AddUint64(&db.stats.misses, 1)
 		return nil, ErrKeyNotFound
 	}
 
-	data, err := db.wal.Read(chunk)
+	data, err := db.readRecord(chunk)
 	if err != nil {
 		return nil, err
 	}
+	atomic.AddUint64(&db.stats.bytesRead, uint64(chunk.Size))
 
 	r := decodeLogRecord(data)
 	if r.recordType == recordDeleted {
@@ -225,21 +496,33 @@ func (db *DB) Get(key []byte) ([]byte, error) {
 	}
 
 	if r.isExpired(now) {
-		db.indexer.Delete(r.key)
+		old, _ := db.indexer.Delete(r.key)
+		db.garbage.dead(old)
+		db.expired()
+		db.expirationSweep("get", 1)
 		return nil, ErrKeyNotFound
 	}
-	return r.value, nil
+
+	if db.valueCache == nil {
+		return r.value, nil
+	}
+	db.valueCache.put(r.key, r.value, r.expire)
+	return cloneBytes(r.value), nil
 }
 
 func (db *DB) Delete(key []byte) error {
 	if db.closed {
 		return ErrDBClosed
 	}
+	if db.options.ReadOnly {
+		return ErrReadOnly
+	}
 
 	if len(key) == 0 {
 		return ErrEmptyKey
 	}
 
+	defer db.finishOp("delete", &db.stats.deleteLatency, key, time.Now())
 	db.mu.Lock()
 	r := db.recordPool.Get().(*logRecord)
 	defer func() {
@@ -251,7 +534,11 @@ func (db *DB) Delete(key []byte) error {
 	r.recordType = recordDeleted
 	r.value = nil
 	r.expire = 0
-	return db.writeRecord(r)
+	if err := db.writeRecord(r); err != nil {
+		return err
+	}
+	atomic.AddUint64(&db.stats.deletes, 1)
+	return nil
 }
 
 func (db *DB) writeRecord(r *logRecord) error {
@@ -263,12 +550,62 @@ func (db *DB) writeRecord(r *logRecord) error {
 	if err != nil {
 		return err
 	}
+	db.indexRecord(r, pos)
+	db.scheduleMerge()
+	return nil
+}
+
+// writeRecords writes the records by a single write of the wal and indexes them, db.mu must be locked.
+func (db *DB) writeRecords(records []*logRecord) error {
+	buf := bytebufferpool.Get()
+	defer bytebufferpool.Put(buf)
+
+	ends := make([]int, 0, len(records))
+	for _, r := range records {
+		encodeLogRecord(r, db.logRecordHeader, buf)
+		ends = append(ends, len(buf.B))
+	}
+	data := make([][]byte, 0, len(records))
+	start := 0
+	for _, end := range ends {
+		data = append(data, buf.B[start:end])
+		start = end
+	}
+
+	positions, err := db.wal.WriteAll(data)
+	if err != nil {
+		return err
+	}
+	for i, r := range records {
+		db.indexRecord(r, positions[i])
+	}
+	db.scheduleMerge()
+	return nil
+}
+
+// indexRecord updates the index with the record written at pos.
+func (db *DB) indexRecord(r *logRecord, pos *wal.Chunk) {
+	atomic.AddUint64(&db.stats.bytesWritten, uint64(pos.Size))
+
+	// the segments before the active one are sealed, their hint files can be built
+	if pos.SegmentId != db.activeSegmentId {
+		var sealed []uint32
+		for id := db.activeSegmentId; id < pos.SegmentId; id++ {
+			sealed = append(sealed, id)
+		}
+		db.scheduleHintFiles(sealed)
+		db.activeSegmentId = pos.SegmentId
+	}
+
+	db.valueCache.remove(r.key)
 
 	// write index
 	if r.recordType == recordDeleted {
-		db.indexer.Delete(r.key)
+		old, _ := db.indexer.Delete(r.key)
+		db.garbage.written(pos, true)
+		db.garbage.dead(old)
 	} else {
-		db.indexer.Put(r.key, pos)
+		db.garbage.written(pos, false)
+		db.garbage.dead(db.indexer.Put(r.key, pos))
 	}
-	return nil
 }
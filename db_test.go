@@ -4,8 +4,11 @@ import (
 	"github.com/stretchr/testify/assert"
 	"kv-db/wal"
 	"os"
+	"path/filepath"
+	"runtime"
 	"strconv"
 	"testing"
+	"time"
 )
 
 func dbTestOpenDB() (*DB, error) {
@@ -55,6 +58,7 @@ func TestDB_Open(t *testing.T) {
 		SegmentSize: 1024 * wal.KB,
 	})
 	assert.Nil(t, err)
+	defer deleteDB(db)
 
 	for i := 1; i <= 100000; i++ {
 		ret, err := db.Get([]byte(strconv.Itoa(i)))
@@ -105,3 +109,254 @@ func TestDB_Delete(t *testing.T) {
 		assert.NotNil(t, err)
 	}
 }
+
+func TestDB_GetWithBlockCache(t *testing.T) {
+	db, err := Open(Options{
+		Dir:            t.TempDir(),
+		SegmentSize:    1024 * wal.KB,
+		BlockCacheSize: 64 * wal.KB,
+	})
+	assert.Nil(t, err)
+	defer deleteDB(db)
+
+	val := []byte("xxxx")
+	for i := 1; i <= 10000; i++ {
+		err = db.Put([]byte(strconv.Itoa(i)), val)
+		assert.Nil(t, err)
+	}
+
+	for i := 1; i <= 10000; i++ {
+		ret, err := db.Get([]byte(strconv.Itoa(i)))
+		assert.Nil(t, err)
+		assert.Equal(t, val, ret)
+	}
+
+	stats := db.BlockCacheStats()
+	assert.True(t, stats.Hits > 0)
+	assert.True(t, stats.Misses > 0)
+	assert.True(t, stats.Bytes <= 64*wal.KB)
+}
+
+func TestDB_OpenWithMaxOpenSegments(t *testing.T) {
+	options := Options{
+		Dir:             t.TempDir(),
+		SegmentSize:     64 * wal.KB,
+		MaxOpenSegments: 2,
+	}
+	db, err := Open(options)
+	assert.Nil(t, err)
+	defer deleteDB(db)
+
+	val := []byte("xxxx")
+	for i := 1; i <= 20000; i++ {
+		assert.Nil(t, db.Put([]byte(strconv.Itoa(i)), val))
+	}
+
+	assert.Nil(t, db.Close())
+	db, err = Open(options)
+	assert.Nil(t, err)
+	defer deleteDB(db)
+
+	for i := 1; i <= 20000; i++ {
+		ret, err := db.Get([]byte(strconv.Itoa(i)))
+		assert.Nil(t, err)
+		assert.Equal(t, val, ret)
+	}
+}
+
+func TestDB_OpenLocked(t *testing.T) {
+	options := DefaultOptions
+	options.Dir = t.TempDir()
+	db, err := Open(options)
+	assert.Nil(t, err)
+
+	_, err = Open(options)
+	assert.Equal(t, ErrDatabaseLocked, err)
+
+	// the lock is released by Close
+	assert.Nil(t, db.Close())
+	db, err = Open(options)
+	assert.Nil(t, err)
+	defer deleteDB(db)
+}
+
+func TestDB_ReadOnly(t *testing.T) {
+	options := DefaultOptions
+	options.Dir = t.TempDir()
+	options.SegmentSize = 64 * wal.KB
+	roOptions := options
+	roOptions.ReadOnly = true
+
+	// the directory is not a DB before the writer opens it
+	_, err := Open(roOptions)
+	assert.NotNil(t, err)
+
+	db, err := Open(options)
+	assert.Nil(t, err)
+	defer deleteDB(db)
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Put([]byte(strconv.Itoa(i)), []byte("value"+strconv.Itoa(i))))
+	}
+
+	reader, err := Open(roOptions)
+	assert.Nil(t, err)
+	reader2, err := Open(roOptions)
+	assert.Nil(t, err)
+	assert.Nil(t, reader2.Close())
+
+	value, err := reader.Get([]byte("1"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("value1"), value)
+	assert.Equal(t, ErrReadOnly, reader.Put([]byte("1"), []byte("x")))
+	assert.Equal(t, ErrReadOnly, reader.Delete([]byte("1")))
+	assert.Equal(t, ErrReadOnly, reader.MergeSegments([]uint32{1}))
+
+	// the writes and the merge of the writer are visible after Refresh
+	for i := 0; i < 2000; i++ {
+		assert.Nil(t, db.Put([]byte(strconv.Itoa(i%200)), []byte("new"+strconv.Itoa(i))))
+	}
+	assert.Nil(t, db.Delete([]byte("2")))
+	assert.Nil(t, db.merge())
+
+	_, err = reader.Get([]byte("150"))
+	assert.Equal(t, ErrKeyNotFound, err)
+	value, err = reader.Get([]byte("2"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("value2"), value)
+
+	assert.Nil(t, reader.Refresh())
+	value, err = reader.Get([]byte("150"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("new1950"), value)
+	_, err = reader.Get([]byte("2"))
+	assert.Equal(t, ErrKeyNotFound, err)
+	assert.Nil(t, reader.Close())
+
+	_, err = os.Stat(filepath.Join(options.Dir, ReadLockFileName))
+	assert.Nil(t, err)
+}
+
+func TestDB_ReadOnlyWithoutLockFiles(t *testing.T) {
+	dir := copyTestData(t, "baseline")
+	listFiles := func() map[string]int64 {
+		entries, err := os.ReadDir(dir)
+		assert.Nil(t, err)
+		files := make(map[string]int64)
+		for _, entry := range entries {
+			info, err := entry.Info()
+			assert.Nil(t, err)
+			files[entry.Name()] = info.Size()
+		}
+		return files
+	}
+	files := listFiles()
+
+	// the read-only DB and Verify do not create the lock files or the hint wal
+	options := DefaultOptions
+	options.Dir = dir
+	options.ReadOnly = true
+	db, err := Open(options)
+	assert.Nil(t, err)
+	value, err := db.Get([]byte("key300"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("new300"), value)
+	assert.Nil(t, db.Close())
+	report, err := Verify(dir, VerifyOptions{})
+	assert.Nil(t, err)
+	assert.True(t, report.OK())
+	assert.Equal(t, files, listFiles())
+}
+
+// copyTestData copies the files of the directory in testdata to a temporary directory.
+func copyTestData(t *testing.T, name string) string {
+	dir := t.TempDir()
+	entries, err := os.ReadDir(filepath.Join("testdata", name))
+	assert.Nil(t, err)
+	for _, entry := range entries {
+		data, err := os.ReadFile(filepath.Join("testdata", name, entry.Name()))
+		assert.Nil(t, err)
+		assert.Nil(t, os.WriteFile(filepath.Join(dir, entry.Name()), data, 0644))
+	}
+	return dir
+}
+
+// testdata/baseline is written by the version before the segment header is added, it has the segments merged
+// into the hint wal, and 299 keys: key0 ~ key299 except key1 and the multiples of 3 with 500 bytes values,
+// and key300 ~ key399 with the values "new" + i.
+func TestDB_OpenBaseline(t *testing.T) {
+	value := make([]byte, 500)
+	for i := range value {
+		value[i] = byte('a' + i%26)
+	}
+	check := func(db *DB) {
+		assert.Equal(t, 299, db.indexer.Size())
+		for i := 0; i < 400; i++ {
+			v, err := db.Get([]byte("key" + strconv.Itoa(i)))
+			switch {
+			case i >= 300:
+				assert.Nil(t, err)
+				assert.Equal(t, "new"+strconv.Itoa(i), string(v))
+			case i == 1 || i%3 == 0:
+				assert.Equal(t, ErrKeyNotFound, err)
+			default:
+				assert.Nil(t, err)
+				assert.Equal(t, value, v)
+			}
+		}
+	}
+
+	options := DefaultOptions
+	options.Dir = copyTestData(t, "baseline")
+	options.SegmentSize = 64 * 1024
+	report, err := Verify(options.Dir, VerifyOptions{})
+	assert.Nil(t, err)
+	assert.True(t, report.OK(), report.Issues)
+	assert.Equal(t, 3, report.Segments)
+
+	db, err := Open(options)
+	assert.Nil(t, err)
+	defer deleteDB(db)
+	check(db)
+
+	// the new records are appended to the active segment without header
+	assert.Nil(t, db.Put([]byte("key300"), []byte("new300")))
+	assert.Nil(t, db.Close())
+	db, err = Open(options)
+	assert.Nil(t, err)
+	defer deleteDB(db)
+	check(db)
+
+	// the merge rewrites the segments with headers
+	assert.Nil(t, db.Merge())
+	check(db)
+	assert.Nil(t, db.Close())
+	_, err = os.Stat(filepath.Join(options.Dir, MergeFinSuffix))
+	assert.True(t, os.IsNotExist(err))
+
+	report, err = Verify(options.Dir, VerifyOptions{})
+	assert.Nil(t, err)
+	assert.True(t, report.OK(), report.Issues)
+
+	db, err = Open(options)
+	assert.Nil(t, err)
+	defer deleteDB(db)
+	check(db)
+}
+
+func TestDB_OpenInvalidAutoMergeExpr(t *testing.T) {
+	options := DefaultOptions
+	options.Dir = t.TempDir()
+	options.AutoMergeExpr = "invalid"
+
+	// no background job is left running
+	n := runtime.NumGoroutine()
+	_, err := Open(options)
+	assert.NotNil(t, err)
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(t, n, runtime.NumGoroutine())
+
+	options.AutoMergeExpr = ""
+	db, err := Open(options)
+	assert.Nil(t, err)
+	assert.Nil(t, db.Close())
+}
@@ -0,0 +1,214 @@
+package kv_db
+
+import (
+	"fmt"
+	"kv-db/wal"
+	"log"
+	"time"
+)
+
+// Logger logs the events and the errors of the background jobs of the DB, which are not returned to the callers.
+type Logger interface {
+	Infof(format string, args ...interface{})
+	Warnf(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+type stdLogger struct {
+	l *log.Logger
+}
+
+// NewStdLogger returns a Logger writing to l with the level as the prefix of the messages.
+func NewStdLogger(l *log.Logger) Logger {
+	return &stdLogger{l: l}
+}
+
+func (s *stdLogger) Infof(format string, args ...interface{}) {
+	s.l.Print("[INFO] " + fmt.Sprintf(format, args...))
+}
+
+func (s *stdLogger) Warnf(format string, args ...interface{}) {
+	s.l.Print("[WARN] " + fmt.Sprintf(format, args...))
+}
+
+func (s *stdLogger) Errorf(format string, args ...interface{}) {
+	s.l.Print("[ERROR] " + fmt.Sprintf(format, args...))
+}
+
+// EventListener is notified of the events of the DB, the nil callbacks are skipped. The callbacks are called
+// synchronously by the goroutine causing the event, maybe with the locks of the DB held, so they must return
+// quickly and must not call the DB.
+type EventListener struct {
+	// SegmentRotated is called after the active segment is sealed and a new one is created.
+	SegmentRotated func(info SegmentRotateInfo)
+
+	MergeStarted  func(info MergeInfo)
+	MergeFinished func(info MergeInfo)
+	MergeFailed   func(info MergeInfo)
+
+	// CorruptionFound is called when damaged data is read, the error is returned to the caller too
+	// unless the data can be rebuilt, e.g. a damaged hint file is replaced by reading its segment.
+	CorruptionFound func(info CorruptionInfo)
+
+	// ExpirationSweep is called after the expired keys are removed from the index, by a merge, or by a Get, Scan
+	// or Export reading them.
+	ExpirationSweep func(info ExpirationSweepInfo)
+
+	// SlowOperation is called when a Put, Get or Delete takes longer than Options.SlowOperationThreshold.
+	SlowOperation func(info SlowOperationInfo)
+}
+
+type SegmentRotateInfo struct {
+	SealedSegmentId uint32
+	NewSegmentId    uint32
+}
+
+// MergeInfo describes a merge. Segments are the merged segments, which are only known when a full merge finishes.
+type MergeInfo struct {
+	Full     bool
+	Segments []uint32
+	// Duration and Err are set when the merge finishes or fails.
+	Duration time.Duration
+	Err      error
+}
+
+type CorruptionInfo struct {
+	// Path is the path of the damaged file.
+	Path string
+	// Pos is the position of the damaged record, it is nil if the damage is not of a record.
+	Pos *wal.Chunk
+	Err error
+}
+
+type ExpirationSweepInfo struct {
+	// Op is "merge", "get" or "scan", which is Scan or Export.
+	Op string
+	// Keys is the number of the expired keys removed from the index.
+	Keys int
+}
+
+type SlowOperationInfo struct {
+	// Op is "put", "get" or "delete".
+	Op       string
+	Key      []byte
+	Duration time.Duration
+}
+
+func (db *DB) infof(format string, args ...interface{}) {
+	if db.options.Logger != nil {
+		db.options.Logger.Infof(format, args...)
+	}
+}
+
+func (db *DB) warnf(format string, args ...interface{}) {
+	if db.options.Logger != nil {
+		db.options.Logger.Warnf(format, args...)
+	}
+}
+
+func (db *DB) errorf(format string, args ...interface{}) {
+	if db.options.Logger != nil {
+		db.options.Logger.Errorf(format, args...)
+	}
+}
+
+// listener returns an empty listener if Options.EventListener is nil, so the callbacks can be checked directly.
+func (db *DB) listener() *EventListener {
+	if db.options.EventListener == nil {
+		return &EventListener{}
+	}
+	return db.options.EventListener
+}
+
+// segmentRotated is the wal.Options.SwitchObserver of the DB.
+func (db *DB) segmentRotated(sealedId uint32, newId uint32) {
+	db.infof("segment %d is sealed, the active segment is %d", sealedId, newId)
+	if fn := db.listener().SegmentRotated; fn != nil {
+		fn(SegmentRotateInfo{SealedSegmentId: sealedId, NewSegmentId: newId})
+	}
+}
+
+// runMerge runs a merge of the segments ids, which are nil for a full merge. fn checks and merges the segments and
+// returns the merged ones, every error of it is reported as a failed merge.
+func (db *DB) runMerge(full bool, ids []uint32, fn func() ([]uint32, error)) error {
+	info := MergeInfo{Full: full, Segments: ids}
+	if info.Full {
+		db.infof("merge started")
+	} else {
+		db.infof("merge of segments %v started", ids)
+	}
+	if l := db.listener().MergeStarted; l != nil {
+		l(info)
+	}
+
+	start := time.Now()
+	merged, err := fn()
+	db.stats.mergeFinished(start, err)
+	info.Duration = time.Since(start)
+	if err != nil {
+		info.Err = err
+		db.errorf("merge failed after %v: %v", info.Duration, err)
+		if l := db.listener().MergeFailed; l != nil {
+			l(info)
+		}
+		return err
+	}
+
+	info.Segments = merged
+	db.infof("merge of segments %v finished in %v", merged, info.Duration)
+	if l := db.listener().MergeFinished; l != nil {
+		l(info)
+	}
+	return nil
+}
+
+// expirationSweep reports the expired keys removed by op, only the ones removed by a merge are logged,
+// since a Get or a Scan removes a few keys at a time.
+func (db *DB) expirationSweep(op string, keys int) {
+	if keys == 0 {
+		return
+	}
+
+	if op == "merge" {
+		db.infof("%d expired keys are removed", keys)
+	}
+	if fn := db.listener().ExpirationSweep; fn != nil {
+		fn(ExpirationSweepInfo{Op: op, Keys: keys})
+	}
+}
+
+// corruptionFound reports err if it is returned because of damaged data.
+func (db *DB) corruptionFound(path string, pos *wal.Chunk, err error) {
+	if pos == nil {
+		db.errorf("%s is damaged: %v", path, err)
+	} else {
+		db.errorf("%s is damaged at block %d offset %d: %v", path, pos.BlockIndex, pos.BlockOffset, err)
+	}
+	if fn := db.listener().CorruptionFound; fn != nil {
+		fn(CorruptionInfo{Path: path, Pos: pos, Err: err})
+	}
+}
+
+// readRecord reads the record at pos from the wal, and reports the damage if it can not be read.
+func (db *DB) readRecord(pos *wal.Chunk) ([]byte, error) {
+	data, err := db.wal.Read(pos)
+	if err != nil && wal.IsCorruption(err) {
+		db.corruptionFound(wal.JoinSegmentPath(db.options.Dir, wal.SegmentSuffix, pos.SegmentId), pos, err)
+	}
+	return data, err
+}
+
+// finishOp observes the latency of the operation on key started at start, it is called by defer.
+func (db *DB) finishOp(op string, h *latencyHistogram, key []byte, start time.Time) {
+	d := time.Since(start)
+	h.observe(d)
+
+	threshold := db.options.SlowOperationThreshold
+	if threshold <= 0 || d < threshold {
+		return
+	}
+	db.warnf("slow %s of key %q took %v", op, key, d)
+	if fn := db.listener().SlowOperation; fn != nil {
+		fn(SlowOperationInfo{Op: op, Key: key, Duration: d})
+	}
+}
@@ -0,0 +1,269 @@
+package kv_db
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"kv-db/wal"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testLogger struct {
+	mu   sync.Mutex
+	logs []string
+}
+
+func (l *testLogger) add(level string, format string, args ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.logs = append(l.logs, level+" "+fmt.Sprintf(format, args...))
+}
+
+func (l *testLogger) Infof(format string, args ...interface{}) {
+	l.add("INFO", format, args...)
+}
+
+func (l *testLogger) Warnf(format string, args ...interface{}) {
+	l.add("WARN", format, args...)
+}
+
+func (l *testLogger) Errorf(format string, args ...interface{}) {
+	l.add("ERROR", format, args...)
+}
+
+func (l *testLogger) count(prefix string) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var n int
+	for _, line := range l.logs {
+		if strings.HasPrefix(line, prefix) {
+			n++
+		}
+	}
+	return n
+}
+
+// testListener records the events, the callbacks may be called by the background jobs.
+type testListener struct {
+	mu          sync.Mutex
+	rotated     []SegmentRotateInfo
+	merges      []MergeInfo
+	failed      []MergeInfo
+	corruptions []CorruptionInfo
+	expired     map[string]int
+	slow        []SlowOperationInfo
+}
+
+func (l *testListener) listener() *EventListener {
+	return &EventListener{
+		SegmentRotated: func(info SegmentRotateInfo) {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			l.rotated = append(l.rotated, info)
+		},
+		MergeStarted: func(info MergeInfo) {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			l.merges = append(l.merges, info)
+		},
+		MergeFinished: func(info MergeInfo) {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			l.merges = append(l.merges, info)
+		},
+		MergeFailed: func(info MergeInfo) {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			l.failed = append(l.failed, info)
+		},
+		CorruptionFound: func(info CorruptionInfo) {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			l.corruptions = append(l.corruptions, info)
+		},
+		ExpirationSweep: func(info ExpirationSweepInfo) {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			if l.expired == nil {
+				l.expired = make(map[string]int)
+			}
+			l.expired[info.Op] += info.Keys
+		},
+		SlowOperation: func(info SlowOperationInfo) {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			l.slow = append(l.slow, info)
+		},
+	}
+}
+
+func TestDB_EventListener(t *testing.T) {
+	logger := &testLogger{}
+	events := &testListener{}
+	options := DefaultOptions
+	options.Dir = t.TempDir()
+	options.SegmentSize = 64 * 1024
+	options.Logger = logger
+	options.EventListener = events.listener()
+	options.SlowOperationThreshold = time.Nanosecond
+	db, err := openDB(options)
+	assert.Nil(t, err)
+	defer deleteDB(db)
+
+	value := make([]byte, 1000)
+	for i := 0; i < 200; i++ {
+		var ttl time.Duration
+		if i%4 == 0 {
+			ttl = time.Millisecond
+		}
+		assert.Nil(t, db.PutWithTTL([]byte("key"+strconv.Itoa(i)), value, ttl))
+	}
+	time.Sleep(2 * time.Millisecond)
+
+	events.mu.Lock()
+	assert.True(t, len(events.rotated) > 1)
+	for i, info := range events.rotated {
+		assert.Equal(t, info.SealedSegmentId+1, info.NewSegmentId)
+		if i > 0 {
+			assert.Equal(t, events.rotated[i-1].NewSegmentId, info.SealedSegmentId)
+		}
+	}
+	assert.Equal(t, 200, len(events.slow))
+	assert.Equal(t, "put", events.slow[0].Op)
+	assert.Equal(t, []byte("key0"), events.slow[0].Key)
+	events.mu.Unlock()
+	assert.Equal(t, 200, logger.count("WARN slow put"))
+
+	assert.Nil(t, db.Merge())
+	events.mu.Lock()
+	assert.Equal(t, 2, len(events.merges))
+	assert.True(t, events.merges[0].Full)
+	assert.Nil(t, events.merges[0].Segments)
+	assert.True(t, len(events.merges[1].Segments) > 1)
+	assert.True(t, events.merges[1].Duration > 0)
+	assert.Nil(t, events.merges[1].Err)
+	assert.Equal(t, 0, len(events.failed))
+	assert.Equal(t, map[string]int{"merge": 50}, events.expired)
+	events.mu.Unlock()
+
+	// the expired keys removed by Get and Scan are reported too
+	assert.Nil(t, db.PutWithTTL([]byte("ttl1"), value, time.Millisecond))
+	assert.Nil(t, db.PutWithTTL([]byte("ttl2"), value, time.Millisecond))
+	assert.Nil(t, db.PutWithTTL([]byte("ttl3"), value, time.Millisecond))
+	time.Sleep(2 * time.Millisecond)
+	_, err = db.Get([]byte("ttl1"))
+	assert.Equal(t, ErrKeyNotFound, err)
+	assert.Nil(t, db.Scan([]byte("ttl"), func(key []byte, value []byte) bool {
+		return true
+	}))
+	events.mu.Lock()
+	assert.Equal(t, map[string]int{"merge": 50, "get": 1, "scan": 2}, events.expired)
+	events.mu.Unlock()
+	assert.Equal(t, 1, logger.count("INFO 50 expired keys are removed"))
+
+	// the damaged hint file is reported when the DB is reopened
+	mergedId := db.wal.SegmentIds()[0]
+	assert.Nil(t, db.Close())
+	hintPath := wal.JoinSegmentPath(options.Dir, SegmentHintSuffix, mergedId)
+	data, err := os.ReadFile(hintPath)
+	assert.Nil(t, err)
+	data[len(data)-1] ^= 0xff
+	assert.Nil(t, os.WriteFile(hintPath, data, 0644))
+
+	db, err = openDB(options)
+	assert.Nil(t, err)
+	defer deleteDB(db)
+	events.mu.Lock()
+	assert.Equal(t, 1, len(events.corruptions))
+	assert.Equal(t, hintPath, events.corruptions[0].Path)
+	assert.Nil(t, events.corruptions[0].Pos)
+	events.mu.Unlock()
+	assert.Equal(t, 150, db.indexer.Size())
+}
+
+func TestDB_EventListenerCorruption(t *testing.T) {
+	logger := &testLogger{}
+	events := &testListener{}
+	options := DefaultOptions
+	options.Dir = t.TempDir()
+	options.Logger = logger
+	options.EventListener = events.listener()
+	db, err := openDB(options)
+	assert.Nil(t, err)
+	defer deleteDB(db)
+
+	for i := 0; i < 10; i++ {
+		assert.Nil(t, db.Put([]byte("key"+strconv.Itoa(i)), []byte("value")))
+	}
+	_, err = db.wal.SwitchNewSegmentForce()
+	assert.Nil(t, err)
+
+	// damage the first record
+	path := wal.JoinSegmentPath(options.Dir, wal.SegmentSuffix, 1)
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	assert.Nil(t, err)
+	_, err = f.WriteAt([]byte("xx"), 32+10)
+	assert.Nil(t, err)
+	assert.Nil(t, f.Close())
+
+	_, err = db.Get([]byte("key0"))
+	assert.True(t, wal.IsCorruption(err))
+	events.mu.Lock()
+	assert.Equal(t, 1, len(events.corruptions))
+	assert.Equal(t, path, events.corruptions[0].Path)
+	assert.Equal(t, &wal.Chunk{SegmentId: 1, BlockIndex: 0, BlockOffset: 0, Size: events.corruptions[0].Pos.Size}, events.corruptions[0].Pos)
+	events.mu.Unlock()
+
+	// the failed auto merge is logged
+	db.autoMerge()
+	events.mu.Lock()
+	assert.Equal(t, 1, len(events.failed))
+	assert.True(t, wal.IsCorruption(events.failed[0].Err))
+	events.mu.Unlock()
+	// the failure is logged once, the other error is the damage found by Get
+	assert.Equal(t, 1, logger.count("ERROR merge failed"))
+	assert.Equal(t, 2, logger.count("ERROR"))
+}
+
+func TestDB_EventListenerMergeCheckFailed(t *testing.T) {
+	logger := &testLogger{}
+	events := &testListener{}
+	options := DefaultOptions
+	options.Dir = t.TempDir()
+	options.Logger = logger
+	options.EventListener = events.listener()
+	db, err := openDB(options)
+	assert.Nil(t, err)
+	defer deleteDB(db)
+
+	assert.Nil(t, db.Put([]byte("a"), []byte("1")))
+
+	// the segments are checked after the merge is started, so the error is reported
+	activeId := db.wal.ActiveSegmentId()
+	err = db.MergeSegments([]uint32{activeId})
+	assert.NotNil(t, err)
+	events.mu.Lock()
+	assert.Equal(t, 1, len(events.merges))
+	assert.Equal(t, []uint32{activeId}, events.merges[0].Segments)
+	assert.Equal(t, 1, len(events.failed))
+	assert.Equal(t, err, events.failed[0].Err)
+	events.mu.Unlock()
+	assert.Equal(t, 1, logger.count("ERROR merge failed"))
+}
+
+func TestNewStdLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger := NewStdLogger(log.New(&buf, "", 0))
+	logger.Infof("a %d", 1)
+	logger.Warnf("b")
+	logger.Errorf("c %s", filepath.Base("/x/y"))
+	assert.Equal(t, "[INFO] a 1\n[WARN] b\n[ERROR] c y\n", buf.String())
+}
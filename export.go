@@ -0,0 +1,258 @@
+package kv_db
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"kv-db/wal"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+)
+
+const scanBatchSize = 1024
+
+type ExportOptions struct {
+	// Prefix exports only the keys with the prefix, nil exports all keys.
+	Prefix []byte
+
+	// IncludeTTL exports the remaining time to live of the keys which expire, or else they are imported without TTL.
+	IncludeTTL bool
+}
+
+// exportRecord is a line of the export, the keys and values which are not valid UTF-8 are encoded in base64.
+type exportRecord struct {
+	Key         string `json:"key,omitempty"`
+	KeyBase64   string `json:"key_base64,omitempty"`
+	Value       string `json:"value,omitempty"`
+	ValueBase64 string `json:"value_base64,omitempty"`
+	// TTL is the remaining time to live in milliseconds, 0 means the key does not expire.
+	TTL int64 `json:"ttl_ms,omitempty"`
+}
+
+// Export writes the live keys in ascending order as JSON Lines, one JSON object per key, which can be loaded
+// by Import. The keys are read in batches, so the writes during Export may be exported partially.
+func (db *DB) Export(w io.Writer, options ExportOptions) error {
+	bw := bufio.NewWriter(w)
+	encoder := json.NewEncoder(bw)
+	var err error
+	scanErr := db.scan(options.Prefix, func(r *logRecord, now int64) bool {
+		record := &exportRecord{}
+		record.Key, record.KeyBase64 = encodeExportBytes(r.key)
+		record.Value, record.ValueBase64 = encodeExportBytes(r.value)
+		if options.IncludeTTL && r.expire > 0 {
+			// a key expiring within a millisecond keeps a TTL, or else it would never expire after it is imported
+			record.TTL = (r.expire - now + int64(time.Millisecond) - 1) / int64(time.Millisecond)
+		}
+		err = encoder.Encode(record)
+		return err == nil
+	})
+	if scanErr != nil {
+		return scanErr
+	}
+	if err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// Scan calls fn for the live keys with the prefix in ascending order until fn returns false, like Export
+// the keys are read in batches. The key and the value must not be modified.
+func (db *DB) Scan(prefix []byte, fn func(key []byte, value []byte) bool) error {
+	return db.scan(prefix, func(r *logRecord, _ int64) bool {
+		return fn(r.key, r.value)
+	})
+}
+
+func (db *DB) scan(prefix []byte, fn func(r *logRecord, now int64) bool) error {
+	if db.closed {
+		return ErrDBClosed
+	}
+
+	start := prefix
+	for {
+		records, positions, next, err := db.scanBatch(start, prefix)
+		if err != nil {
+			return err
+		}
+
+		now := time.Now().UnixNano()
+		live := make([]*logRecord, 0, len(records))
+		var expired []int
+		for i, r := range records {
+			if r.isExpired(now) {
+				expired = append(expired, i)
+			} else {
+				live = append(live, r)
+			}
+		}
+		if len(expired) > 0 {
+			db.removeExpired(records, positions, expired)
+		}
+
+		for _, r := range live {
+			if !fn(r, now) {
+				return nil
+			}
+		}
+		if next == nil {
+			return nil
+		}
+		start = next
+	}
+}
+
+// scanBatch reads the records of at most scanBatchSize keys from start and their positions, it returns the key
+// to read from next, which is nil if all keys have been read.
+func (db *DB) scanBatch(start []byte, prefix []byte) ([]*logRecord, []*wal.Chunk, []byte, error) {
+	// the positions are not changed by merge while the lock is held
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	var keys [][]byte
+	var positions []*wal.Chunk
+	var next []byte
+	db.indexer.Ascend(start, func(key []byte, chunk *wal.Chunk) bool {
+		if !bytes.HasPrefix(key, prefix) {
+			return false
+		}
+		if len(keys) == scanBatchSize {
+			next = key
+			return false
+		}
+		keys = append(keys, key)
+		positions = append(positions, chunk)
+		return true
+	})
+
+	records := make([]*logRecord, 0, len(keys))
+	for i, pos := range positions {
+		data, err := db.readRecord(pos)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("read key %q: %w", keys[i], err)
+		}
+		atomic.AddUint64(&db.stats.bytesRead, uint64(pos.Size))
+		records = append(records, decodeLogRecord(data))
+	}
+	return records, positions, next, nil
+}
+
+// removeExpired removes the expired keys found by scan from the index, which are records[i] for i in expired.
+// The keys written since they are read are kept.
+func (db *DB) removeExpired(records []*logRecord, positions []*wal.Chunk, expired []int) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	var removed int
+	for _, i := range expired {
+		if !samePos(db.indexer.Get(records[i].key), positions[i]) {
+			continue
+		}
+		old, _ := db.indexer.Delete(records[i].key)
+		db.garbage.dead(old)
+		db.valueCache.remove(records[i].key)
+		removed++
+	}
+	db.expiredRemoved(removed)
+	db.expirationSweep("scan", removed)
+}
+
+func encodeExportBytes(b []byte) (string, string) {
+	if utf8.Valid(b) {
+		return string(b), ""
+	}
+	return "", base64.StdEncoding.EncodeToString(b)
+}
+
+func decodeExportBytes(s string, b64 string) ([]byte, error) {
+	if len(b64) > 0 {
+		return base64.StdEncoding.DecodeString(b64)
+	}
+	return []byte(s), nil
+}
+
+// importBatchSize is the number of records written by a single write of Import.
+const importBatchSize = 256
+
+// Import puts the keys exported by Export, the keys existing in the DB are overwritten. It returns the error
+// of the first invalid line, the lines before it have been imported.
+func (db *DB) Import(r io.Reader) error {
+	batch := make([]*logRecord, 0, importBatchSize)
+	br := bufio.NewReader(r)
+	for lineNum := 1; ; lineNum++ {
+		line, err := br.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+
+		if len(bytes.TrimSpace(line)) > 0 {
+			record, importErr := decodeImportRecord(line)
+			if importErr != nil {
+				if err := db.importRecords(batch); err != nil {
+					return err
+				}
+				return fmt.Errorf("import line %d: %w", lineNum, importErr)
+			}
+			batch = append(batch, record)
+		}
+		if len(batch) == importBatchSize || (err == io.EOF && len(batch) > 0) {
+			if err := db.importRecords(batch); err != nil {
+				return err
+			}
+			batch = batch[:0]
+		}
+		if err == io.EOF {
+			return nil
+		}
+	}
+}
+
+func decodeImportRecord(line []byte) (*logRecord, error) {
+	record := &exportRecord{}
+	if err := json.Unmarshal(line, record); err != nil {
+		return nil, err
+	}
+
+	key, err := decodeExportBytes(record.Key, record.KeyBase64)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) == 0 {
+		return nil, ErrEmptyKey
+	}
+	value, err := decodeExportBytes(record.Value, record.ValueBase64)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &logRecord{key: key, value: value, recordType: recordModified}
+	if record.TTL != 0 {
+		r.expire = time.Now().Add(time.Duration(record.TTL) * time.Millisecond).UnixNano()
+	}
+	return r, nil
+}
+
+// importRecords puts the records decoded by Import.
+func (db *DB) importRecords(records []*logRecord) error {
+	if len(records) == 0 {
+		return nil
+	}
+	if db.closed {
+		return ErrDBClosed
+	}
+	if db.options.ReadOnly {
+		return ErrReadOnly
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if err := db.writeRecords(records); err != nil {
+		return err
+	}
+	atomic.AddUint64(&db.stats.puts, uint64(len(records)))
+	return nil
+}
@@ -0,0 +1,145 @@
+package kv_db
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"kv-db/wal"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDB_ExportImport(t *testing.T) {
+	options := DefaultOptions
+	options.Dir = t.TempDir()
+	options.SegmentSize = 64 * wal.KB
+	db, err := openDB(options)
+	assert.Nil(t, err)
+	defer deleteDB(db)
+
+	for i := 0; i < 3000; i++ {
+		assert.Nil(t, db.Put([]byte("key"+strconv.Itoa(i)), []byte("value"+strconv.Itoa(i))))
+	}
+	assert.Nil(t, db.Delete([]byte("key1")))
+	assert.Nil(t, db.PutWithTTL([]byte("key2"), []byte("ttl"), time.Hour))
+	assert.Nil(t, db.PutWithTTL([]byte("key3"), []byte("expired"), time.Nanosecond))
+	assert.Nil(t, db.Put([]byte{0xff, 0x00}, []byte{0xfe}))
+
+	buf := &bytes.Buffer{}
+	assert.Nil(t, db.Export(buf, ExportOptions{IncludeTTL: true}))
+	assert.Equal(t, 2999, strings.Count(buf.String(), "\n"))
+	assert.Contains(t, buf.String(), `{"key_base64":"/wA=","value_base64":"/g=="}`)
+
+	options2 := options
+	options2.Dir = t.TempDir()
+	db2, err := openDB(options2)
+	assert.Nil(t, err)
+	defer deleteDB(db2)
+	assert.Nil(t, db2.Import(buf))
+
+	for _, key := range []string{"key0", "key2", "key2999", "\xff\x00"} {
+		value, err := db.Get([]byte(key))
+		assert.Nil(t, err)
+		value2, err := db2.Get([]byte(key))
+		assert.Nil(t, err)
+		assert.Equal(t, value, value2)
+	}
+	for _, key := range []string{"key1", "key3"} {
+		_, err = db2.Get([]byte(key))
+		assert.Equal(t, ErrKeyNotFound, err)
+	}
+
+	// the TTL is kept
+	r := decodeLogRecord(mustRead(t, db2, []byte("key2")))
+	assert.True(t, r.expire > time.Now().Add(59*time.Minute).UnixNano())
+
+	buf.Reset()
+	assert.Nil(t, db.Export(buf, ExportOptions{Prefix: []byte("key29")}))
+	assert.Equal(t, 111, strings.Count(buf.String(), "\n"))
+	assert.True(t, strings.HasPrefix(buf.String(), `{"key":"key29","value":"value29"}`))
+
+	err = db2.Import(strings.NewReader("{\"key\":\"a\"}\n\nnot json\n"))
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "line 3")
+	// the lines before the invalid one are imported
+	_, err = db2.Get([]byte("a"))
+	assert.Nil(t, err)
+}
+
+func TestDB_ImportBatch(t *testing.T) {
+	options := DefaultOptions
+	options.Dir = t.TempDir()
+	options.SegmentSize = 64 * wal.KB
+	db, err := openDB(options)
+	assert.Nil(t, err)
+	defer func() {
+		deleteDB(db)
+	}()
+	assert.Nil(t, db.Put([]byte("key1"), []byte("old")))
+
+	// more than a batch, written across the segments
+	buf := &bytes.Buffer{}
+	n := 2*importBatchSize + 10
+	for i := 0; i < n; i++ {
+		buf.WriteString(`{"key":"key` + strconv.Itoa(i) + `","value":"` + strings.Repeat("v", 300) + strconv.Itoa(i) + `"}` + "\n")
+	}
+	buf.WriteString(`{"key":""}` + "\n")
+	err = db.Import(buf)
+	assert.ErrorIs(t, err, ErrEmptyKey)
+	assert.Contains(t, err.Error(), "line "+strconv.Itoa(n+1))
+	assert.True(t, len(db.wal.SegmentIds()) > 1)
+
+	for i := 0; i < n; i++ {
+		value, err := db.Get([]byte("key" + strconv.Itoa(i)))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte(strings.Repeat("v", 300)+strconv.Itoa(i)), value)
+	}
+	stats, err := db.Stats()
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(n+1), stats.Puts)
+	assert.Equal(t, n, db.indexer.Size())
+
+	// the imported keys are loaded again
+	assert.Nil(t, db.Close())
+	db, err = openDB(options)
+	assert.Nil(t, err)
+	value, err := db.Get([]byte("key1"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte(strings.Repeat("v", 300)+"1"), value)
+}
+
+func mustRead(t *testing.T, db *DB, key []byte) []byte {
+	data, err := db.wal.Read(db.indexer.Get(key))
+	assert.Nil(t, err)
+	return data
+}
+
+func TestDB_Scan(t *testing.T) {
+	options := DefaultOptions
+	options.Dir = t.TempDir()
+	db, err := openDB(options)
+	assert.Nil(t, err)
+	defer deleteDB(db)
+
+	for i := 0; i < 3000; i++ {
+		assert.Nil(t, db.Put([]byte("key"+strconv.Itoa(i)), []byte("value"+strconv.Itoa(i))))
+	}
+	assert.Nil(t, db.Put([]byte("other"), []byte("value")))
+
+	var keys []string
+	assert.Nil(t, db.Scan([]byte("key1"), func(key []byte, value []byte) bool {
+		assert.Equal(t, "value"+string(key[3:]), string(value))
+		keys = append(keys, string(key))
+		return true
+	}))
+	assert.Equal(t, 1111, len(keys))
+	assert.Equal(t, "key1", keys[0])
+
+	var count int
+	assert.Nil(t, db.Scan(nil, func(key []byte, value []byte) bool {
+		count++
+		return count < 2000
+	}))
+	assert.Equal(t, 2000, count)
+}
@@ -0,0 +1,212 @@
+package kv_db
+
+import (
+	"encoding/json"
+	"kv-db/util"
+	"kv-db/wal"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// SegmentStatsFileName is the file of the garbage stats of the segments, it is saved when the DB is closed and
+// after a merge, so the garbage can be inspected without opening the DB. The DB rebuilds the stats on Open.
+const SegmentStatsFileName = "SEGSTATS"
+
+// SegmentStat is the bytes of the records in a segment. Dead is the bytes of the records which are overwritten,
+// deleted or expired, they are reclaimed by any merge. Tombstones is the bytes of the delete records and the expired
+// records, which are kept by the incremental merges for the older records of their keys, so only a full merge reclaims them.
+type SegmentStat struct {
+	Total      int64 `json:"total"`
+	Dead       int64 `json:"dead"`
+	Tombstones int64 `json:"tombstones"`
+}
+
+// garbageStats tracks the stale bytes of every segment, it is rebuilt when the index is loaded and saved to
+// SegmentStatsFileName.
+type garbageStats struct {
+	mu       sync.Mutex
+	segments map[uint32]*SegmentStat
+	// sum is the sum of the stats of all segments, it is checked on every write so the segments are not iterated
+	sum SegmentStat
+}
+
+func newGarbageStats() *garbageStats {
+	return &garbageStats{segments: make(map[uint32]*SegmentStat)}
+}
+
+func (g *garbageStats) segmentLocked(id uint32) *SegmentStat {
+	stat, ok := g.segments[id]
+	if !ok {
+		stat = &SegmentStat{}
+		g.segments[id] = stat
+	}
+	return stat
+}
+
+// written counts a record written at pos, tombstone is true for a delete record or an expired record.
+func (g *garbageStats) written(pos *wal.Chunk, tombstone bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	stat := g.segmentLocked(pos.SegmentId)
+	stat.Total += int64(pos.Size)
+	g.sum.Total += int64(pos.Size)
+	if tombstone {
+		stat.Tombstones += int64(pos.Size)
+		g.sum.Tombstones += int64(pos.Size)
+	}
+}
+
+// dead counts the record at pos as dead, pos is the old position returned by the indexer and may be nil.
+func (g *garbageStats) dead(pos *wal.Chunk) {
+	if pos == nil {
+		return
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.segmentLocked(pos.SegmentId).Dead += int64(pos.Size)
+	g.sum.Dead += int64(pos.Size)
+}
+
+// remove removes the stats of the segments removed by a merge.
+func (g *garbageStats) remove(ids []uint32) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	for _, id := range ids {
+		if stat, ok := g.segments[id]; ok {
+			g.sum.Total -= stat.Total
+			g.sum.Dead -= stat.Dead
+			g.sum.Tombstones -= stat.Tombstones
+			delete(g.segments, id)
+		}
+	}
+}
+
+// total returns the bytes of all records and the bytes of the stale ones, including the tombstones.
+func (g *garbageStats) total() (int64, int64) {
+	return g.reclaimable(true, 0)
+}
+
+// reclaimable returns the bytes of all records and the bytes reclaimed by a full merge, or by the incremental merges
+// if full is false. The segment activeId is skipped, since the active segment is not merged.
+func (g *garbageStats) reclaimable(full bool, activeId uint32) (int64, int64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	sum := g.sum
+	if stat, ok := g.segments[activeId]; ok {
+		sum.Total -= stat.Total
+		sum.Dead -= stat.Dead
+		sum.Tombstones -= stat.Tombstones
+	}
+	if full {
+		return sum.Total, sum.Dead + sum.Tombstones
+	}
+	return sum.Total, sum.Dead
+}
+
+func (g *garbageStats) save(dir string) error {
+	g.mu.Lock()
+	data, err := json.Marshal(g.segments)
+	g.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return util.WriteFileAtomic(filepath.Join(dir, SegmentStatsFileName), data)
+}
+
+// ReadSegmentStats reads the garbage stats of the segments saved in dir, which may be older than the segments
+// if the DB is open or it has crashed.
+func ReadSegmentStats(dir string) (map[uint32]*SegmentStat, error) {
+	data, err := os.ReadFile(filepath.Join(dir, SegmentStatsFileName))
+	if err != nil {
+		return nil, err
+	}
+
+	stats := make(map[uint32]*SegmentStat)
+	if err = json.Unmarshal(data, &stats); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// needMerge reports whether the garbage of the sealed segments exceeds the thresholds in the options.
+func (db *DB) needMerge() bool {
+	if db.options.MergeGarbageRatio <= 0 && db.options.MergeReclaimableBytes <= 0 {
+		return false
+	}
+
+	total, dead := db.garbage.reclaimable(db.options.MergeSegmentsLimit <= 0, db.wal.ActiveSegmentId())
+	if dead == 0 || dead < db.options.MergeMinReclaimableBytes {
+		return false
+	}
+	if db.options.MergeReclaimableBytes > 0 && dead >= db.options.MergeReclaimableBytes {
+		return true
+	}
+	return db.options.MergeGarbageRatio > 0 && total > 0 && float64(dead)/float64(total) >= db.options.MergeGarbageRatio
+}
+
+// mergeCooldown returns how long the auto merge must wait for Options.MergeMinInterval after the last merge.
+func (db *DB) mergeCooldown() time.Duration {
+	if db.options.MergeMinInterval <= 0 {
+		return 0
+	}
+
+	db.stats.mergeMu.Lock()
+	last := db.stats.lastMerge.Time
+	db.stats.mergeMu.Unlock()
+	if last.IsZero() {
+		return 0
+	}
+	return time.Until(last.Add(db.options.MergeMinInterval))
+}
+
+// scheduleMerge wakes up the auto merge goroutine if the garbage exceeds the thresholds.
+func (db *DB) scheduleMerge() {
+	if db.mergeSignal == nil || !db.needMerge() {
+		return
+	}
+
+	select {
+	case db.mergeSignal <- struct{}{}:
+	default:
+	}
+}
+
+// autoMerge runs the merge of the auto merge jobs, the failures are logged by runMerge since there is no caller
+// to return them to.
+func (db *DB) autoMerge() {
+	_ = db.merge()
+}
+
+func (db *DB) runAutoMerge() {
+	defer db.mergeWg.Done()
+
+	// retry is set when a merge is needed during the cooldown, so it runs after the cooldown without new writes
+	var retry <-chan time.Time
+	for {
+		select {
+		case <-db.mergeSignal:
+		case <-retry:
+			retry = nil
+		case <-db.mergeStop:
+			return
+		}
+
+		// the garbage may have been reclaimed by a merge after the signal
+		if !db.needMerge() {
+			continue
+		}
+		if wait := db.mergeCooldown(); wait > 0 {
+			if retry == nil {
+				retry = time.After(wait)
+			}
+			continue
+		}
+		db.autoMerge()
+	}
+}
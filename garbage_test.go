@@ -0,0 +1,188 @@
+package kv_db
+
+import (
+	"github.com/stretchr/testify/assert"
+	"kv-db/wal"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestDB_GarbageStats(t *testing.T) {
+	options := DefaultOptions
+	options.Dir = t.TempDir()
+	options.SegmentSize = 64 * wal.KB
+	db, err := openDB(options)
+	assert.Nil(t, err)
+	defer deleteDB(db)
+
+	for i := 0; i < 10000; i++ {
+		assert.Nil(t, db.Put([]byte(strconv.Itoa(i)), []byte("abc")))
+	}
+	total, dead := db.garbage.total()
+	assert.True(t, total > 0)
+	assert.Equal(t, int64(0), dead)
+
+	for i := 0; i < 5000; i++ {
+		assert.Nil(t, db.Delete([]byte(strconv.Itoa(i))))
+	}
+	total, dead = db.garbage.total()
+	assert.True(t, dead > 0)
+
+	// the stats are saved when the DB is closed, and are the same after they are rebuilt when the DB is opened
+	assert.Nil(t, db.Close())
+	saved, err := ReadSegmentStats(options.Dir)
+	assert.Nil(t, err)
+	var savedTotal, savedDead int64
+	for _, stat := range saved {
+		savedTotal += stat.Total
+		savedDead += stat.Dead + stat.Tombstones
+	}
+	assert.Equal(t, total, savedTotal)
+	assert.Equal(t, dead, savedDead)
+	db, err = openDB(options)
+	assert.Nil(t, err)
+	defer deleteDB(db)
+	total2, dead2 := db.garbage.total()
+	assert.Equal(t, total, total2)
+	assert.Equal(t, dead, dead2)
+
+	m, err := readManifest(options.Dir)
+	assert.Nil(t, err)
+	assert.Nil(t, m)
+
+	// only the live records are left after merge, the saved stats are updated
+	assert.Nil(t, db.merge())
+	total, dead = db.garbage.total()
+	assert.True(t, total > 0)
+	assert.Equal(t, int64(0), dead)
+	saved, err = ReadSegmentStats(options.Dir)
+	assert.Nil(t, err)
+	for id, stat := range saved {
+		assert.Equal(t, int64(0), stat.Dead, id)
+	}
+	_, ok := saved[1]
+	assert.False(t, ok)
+}
+
+func TestDB_MergeByGarbageRatio(t *testing.T) {
+	options := DefaultOptions
+	options.Dir = t.TempDir()
+	options.SegmentSize = 64 * wal.KB
+	options.MergeGarbageRatio = 0.5
+	options.MergeMinReclaimableBytes = 0
+	// a merge may start before all keys are deleted, the next one must not wait for the cooldown
+	options.MergeMinInterval = 0
+	db, err := openDB(options)
+	assert.Nil(t, err)
+	defer deleteDB(db)
+
+	for i := 0; i < 10000; i++ {
+		assert.Nil(t, db.Put([]byte(strconv.Itoa(i)), []byte("abc")))
+	}
+	for i := 0; i < 10000; i++ {
+		assert.Nil(t, db.Delete([]byte(strconv.Itoa(i))))
+	}
+
+	// the tombstones written during the last merge may be left in the active segment, which is not merged
+	assert.Eventually(t, func() bool {
+		_, dead := db.garbage.reclaimable(true, db.wal.ActiveSegmentId())
+		return dead == 0
+	}, 10*time.Second, 10*time.Millisecond)
+
+	for i := 0; i < 10000; i++ {
+		_, err := db.Get([]byte(strconv.Itoa(i)))
+		assert.Equal(t, ErrKeyNotFound, err)
+	}
+}
+
+func TestDB_NeedMerge(t *testing.T) {
+	options := DefaultOptions
+	options.Dir = t.TempDir()
+	options.SegmentSize = 64 * wal.KB
+	db, err := openDB(options)
+	assert.Nil(t, err)
+	defer deleteDB(db)
+
+	// the garbage of the active segment is not counted
+	db.options.MergeReclaimableBytes = 1
+	db.options.MergeMinReclaimableBytes = 0
+	assert.Nil(t, db.Put([]byte("a"), []byte("abc")))
+	assert.Nil(t, db.Put([]byte("a"), []byte("abc")))
+	assert.False(t, db.needMerge())
+
+	for i := 0; i < 10000; i++ {
+		assert.Nil(t, db.Put([]byte(strconv.Itoa(i)), []byte("abc")))
+	}
+	assert.True(t, db.needMerge())
+
+	// too few dead bytes
+	_, dead := db.garbage.total()
+	db.options.MergeMinReclaimableBytes = dead + 1
+	assert.False(t, db.needMerge())
+}
+
+func TestDB_MergeMinInterval(t *testing.T) {
+	options := DefaultOptions
+	options.Dir = t.TempDir()
+	options.SegmentSize = 64 * wal.KB
+	options.MergeGarbageRatio = 0.5
+	options.MergeMinReclaimableBytes = 0
+	options.MergeMinInterval = time.Second
+	db, err := openDB(options)
+	assert.Nil(t, err)
+	defer deleteDB(db)
+
+	putAndDelete := func() {
+		for i := 0; i < 10000; i++ {
+			assert.Nil(t, db.Put([]byte(strconv.Itoa(i)), []byte("abc")))
+		}
+		for i := 0; i < 10000; i++ {
+			assert.Nil(t, db.Delete([]byte(strconv.Itoa(i))))
+		}
+	}
+	lastMerge := func() MergeStats {
+		stats, err := db.Stats()
+		assert.Nil(t, err)
+		return stats.LastMerge
+	}
+	putAndDelete()
+	assert.Eventually(t, func() bool {
+		return !lastMerge().Time.IsZero()
+	}, 10*time.Second, 10*time.Millisecond)
+	first := lastMerge().Time
+
+	// the next merge waits for the interval, and runs after it without more writes
+	putAndDelete()
+	assert.Eventually(t, func() bool {
+		return lastMerge().Time.After(first)
+	}, 10*time.Second, 10*time.Millisecond)
+	assert.True(t, lastMerge().Time.Sub(first) >= time.Second)
+}
+
+func TestGarbageStats_Sum(t *testing.T) {
+	g := newGarbageStats()
+	g.written(&wal.Chunk{SegmentId: 1, Size: 10}, false)
+	g.written(&wal.Chunk{SegmentId: 1, Size: 20}, true)
+	g.written(&wal.Chunk{SegmentId: 2, Size: 30}, false)
+	g.written(&wal.Chunk{SegmentId: 3, Size: 40}, false)
+	g.dead(&wal.Chunk{SegmentId: 1, Size: 10})
+	g.dead(&wal.Chunk{SegmentId: 3, Size: 40})
+
+	total, dead := g.reclaimable(true, 0)
+	assert.Equal(t, int64(100), total)
+	assert.Equal(t, int64(70), dead)
+	total, dead = g.reclaimable(false, 0)
+	assert.Equal(t, int64(100), total)
+	assert.Equal(t, int64(50), dead)
+
+	// the active segment is skipped
+	total, dead = g.reclaimable(true, 3)
+	assert.Equal(t, int64(60), total)
+	assert.Equal(t, int64(30), dead)
+
+	g.remove([]uint32{1, 4})
+	total, dead = g.total()
+	assert.Equal(t, int64(70), total)
+	assert.Equal(t, int64(40), dead)
+}
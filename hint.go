@@ -0,0 +1,189 @@
+package kv_db
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"kv-db/util"
+	"kv-db/wal"
+	"os"
+)
+
+// SegmentHintSuffix is the suffix of the hint file of a segment, which has the same id as the segment.
+const SegmentHintSuffix = ".hnt"
+
+const hintFileVersion = 1
+
+var errInvalidHintFile = errors.New("invalid hint file")
+
+// hintEntry indexes a record of a segment, so the segment does not need to be read when the index is loaded.
+type hintEntry struct {
+	recordType recordType
+	expire     int64
+	key        []byte
+	pos        *wal.Chunk
+}
+
+// hint file:
+//
+//	version   entry   entry   ...   checksum
+//	   1                               4
+//
+// entry:
+//
+//	length   type   expire   hint record
+//	5 max     1     10 max       ...
+func writeHintFile(dir string, id uint32, entries []*hintEntry) error {
+	data := []byte{hintFileVersion}
+	length := make([]byte, binary.MaxVarintLen32)
+	buf := make([]byte, binary.MaxVarintLen64+1)
+	for _, e := range entries {
+		buf[0] = e.recordType
+		n := 1 + binary.PutVarint(buf[1:], e.expire)
+		record := encodeHintRecord(e.key, e.pos)
+
+		m := binary.PutUvarint(length, uint64(n+len(record)))
+		data = append(data, length[:m]...)
+		data = append(data, buf[:n]...)
+		data = append(data, record...)
+	}
+
+	checksum := make([]byte, 4)
+	binary.LittleEndian.PutUint32(checksum, crc32.ChecksumIEEE(data))
+	data = append(data, checksum...)
+	return util.WriteFileAtomic(wal.JoinSegmentPath(dir, SegmentHintSuffix, id), data)
+}
+
+// readHintFile returns an error satisfying os.IsNotExist if the segment has no hint file.
+func readHintFile(dir string, id uint32) ([]*hintEntry, error) {
+	path := wal.JoinSegmentPath(dir, SegmentHintSuffix, id)
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) < 5 || data[0] != hintFileVersion {
+		return nil, fmt.Errorf("%s: %w", path, errInvalidHintFile)
+	}
+	n := len(data) - 4
+	if crc32.ChecksumIEEE(data[:n]) != binary.LittleEndian.Uint32(data[n:]) {
+		return nil, fmt.Errorf("%s: %w", path, errInvalidHintFile)
+	}
+
+	var entries []*hintEntry
+	for idx := 1; idx < n; {
+		length, m := binary.Uvarint(data[idx:n])
+		if m <= 0 || length < 2 || idx+m+int(length) > n {
+			return nil, fmt.Errorf("%s: %w", path, errInvalidHintFile)
+		}
+		idx += m
+		entry := data[idx : idx+int(length)]
+		idx += int(length)
+
+		expire, k := binary.Varint(entry[1:])
+		if k <= 0 {
+			return nil, fmt.Errorf("%s: %w", path, errInvalidHintFile)
+		}
+		key, pos := decodeHintRecord(entry[1+k:])
+		entries = append(entries, &hintEntry{recordType: entry[0], expire: expire, key: key, pos: pos})
+	}
+	return entries, nil
+}
+
+// scheduleHintFiles builds the hint files of the sealed segments in background, the segments with one are skipped.
+func (db *DB) scheduleHintFiles(ids []uint32) {
+	if len(ids) == 0 {
+		return
+	}
+
+	db.hintMu.Lock()
+	db.hintPending = append(db.hintPending, ids...)
+	db.hintMu.Unlock()
+
+	select {
+	case db.hintSignal <- struct{}{}:
+	default:
+	}
+}
+
+func (db *DB) runHintBuilder() {
+	defer db.hintWg.Done()
+
+	for {
+		select {
+		case <-db.hintSignal:
+			for {
+				db.hintMu.Lock()
+				if len(db.hintPending) == 0 {
+					db.hintMu.Unlock()
+					break
+				}
+				id := db.hintPending[0]
+				db.hintPending = db.hintPending[1:]
+				db.hintMu.Unlock()
+
+				if err := db.buildHintFile(id); err == ErrDBClosed {
+					return
+				} else if err != nil {
+					db.errorf("build the hint file of segment %d: %v", id, err)
+				}
+
+				select {
+				case <-db.hintStop:
+					return
+				default:
+				}
+			}
+		case <-db.hintStop:
+			return
+		}
+	}
+}
+
+// buildHintFile reads the sealed segment and writes its hint file, it does not run with merge which rewrites the segments.
+func (db *DB) buildHintFile(id uint32) error {
+	db.mergeMu.Lock()
+	defer db.mergeMu.Unlock()
+
+	// the segment has been merged, or it is indexed by the hint wal of the old versions
+	if _, err := os.Stat(wal.JoinSegmentPath(db.options.Dir, SegmentHintSuffix, id)); err == nil {
+		return nil
+	}
+	mergeFinSegId, err := db.readMergeFinFile(db.options.Dir)
+	if err != nil || id <= mergeFinSegId {
+		return err
+	}
+	// the segment has been removed by a merge, or its id is reserved for a merge and not used
+	if _, err = os.Stat(wal.JoinSegmentPath(db.options.Dir, wal.SegmentSuffix, id)); os.IsNotExist(err) {
+		return nil
+	}
+
+	walIter, err := db.wal.NewSegmentIterator(id)
+	if err != nil {
+		return err
+	}
+
+	var entries []*hintEntry
+	for {
+		data, pos, err := walIter.Next()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			if wal.IsCorruption(err) {
+				db.corruptionFound(wal.JoinSegmentPath(db.options.Dir, wal.SegmentSuffix, id), nil, err)
+			}
+			return err
+		}
+		if !db.readLimiter.Wait(int(pos.Size), db.closing) {
+			return ErrDBClosed
+		}
+
+		record := decodeLogRecord(data)
+		entries = append(entries, &hintEntry{recordType: record.recordType, expire: record.expire, key: record.key, pos: pos})
+	}
+	return writeHintFile(db.options.Dir, id, entries)
+}
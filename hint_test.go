@@ -0,0 +1,134 @@
+package kv_db
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"kv-db/wal"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestHintFile(t *testing.T) {
+	dir := t.TempDir()
+	entries := []*hintEntry{
+		{recordType: recordModified, key: []byte("a"), pos: &wal.Chunk{SegmentId: 3, BlockIndex: 1, BlockOffset: 2, Size: 10}},
+		{recordType: recordDeleted, key: []byte("b"), pos: &wal.Chunk{SegmentId: 3, BlockIndex: 4, BlockOffset: 5, Size: 8}},
+	}
+	assert.Nil(t, writeHintFile(dir, 3, entries))
+
+	ret, err := readHintFile(dir, 3)
+	assert.Nil(t, err)
+	assert.Equal(t, entries, ret)
+
+	_, err = readHintFile(dir, 4)
+	assert.True(t, os.IsNotExist(err))
+
+	// damaged
+	path := wal.JoinSegmentPath(dir, SegmentHintSuffix, 3)
+	data, err := ioutil.ReadFile(path)
+	assert.Nil(t, err)
+	data[1] ^= 0xff
+	assert.Nil(t, ioutil.WriteFile(path, data, 0644))
+	_, err = readHintFile(dir, 3)
+	assert.True(t, errors.Is(err, errInvalidHintFile))
+}
+
+func TestDB_HintFilesOnRollover(t *testing.T) {
+	options := DefaultOptions
+	options.Dir = t.TempDir()
+	options.SegmentSize = 64 * wal.KB
+	db, err := openDB(options)
+	assert.Nil(t, err)
+	defer deleteDB(db)
+
+	for i := 0; i < 10000; i++ {
+		assert.Nil(t, db.PutWithTTL([]byte(strconv.Itoa(i)), []byte("abc"), 0))
+	}
+	// the new records expire, the old ones must not be loaded again
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.PutWithTTL([]byte(strconv.Itoa(i)), []byte("abc"), time.Millisecond))
+	}
+	for i := 10000; i < 15000; i++ {
+		assert.Nil(t, db.Put([]byte(strconv.Itoa(i)), []byte("abc")))
+	}
+
+	segmentIds := db.wal.SegmentIds()
+	assert.True(t, len(segmentIds) > 2)
+	assert.Eventually(t, func() bool {
+		for _, id := range segmentIds[:len(segmentIds)-1] {
+			if _, err := os.Stat(wal.JoinSegmentPath(options.Dir, SegmentHintSuffix, id)); err != nil {
+				return false
+			}
+		}
+		return true
+	}, 5*time.Second, 10*time.Millisecond)
+	_, err = os.Stat(wal.JoinSegmentPath(options.Dir, SegmentHintSuffix, segmentIds[len(segmentIds)-1]))
+	assert.True(t, os.IsNotExist(err))
+
+	time.Sleep(10 * time.Millisecond)
+	assert.Nil(t, db.Close())
+	db, err = openDB(options)
+	assert.Nil(t, err)
+	defer deleteDB(db)
+	assert.Equal(t, 14900, db.indexer.Size())
+	for i := 0; i < 15000; i++ {
+		_, err := db.Get([]byte(strconv.Itoa(i)))
+		assert.Equal(t, i < 100, err == ErrKeyNotFound)
+	}
+}
+
+func TestDB_HintFileDamaged(t *testing.T) {
+	options := DefaultOptions
+	options.Dir = t.TempDir()
+	options.SegmentSize = 64 * wal.KB
+	db, err := openDB(options)
+	assert.Nil(t, err)
+	defer deleteDB(db)
+
+	mergeTestPutAndDelete(t, db)
+	assert.Nil(t, db.merge())
+	assert.Nil(t, db.Close())
+
+	// the segment is read if its hint file is damaged
+	assert.Nil(t, ioutil.WriteFile(wal.JoinSegmentPath(options.Dir, SegmentHintSuffix, 1), []byte("xx"), 0644))
+	db, err = openDB(options)
+	assert.Nil(t, err)
+	defer deleteDB(db)
+	mergeTestCheck(t, db)
+}
+
+func TestDB_HintFilesAfterMerge(t *testing.T) {
+	logger := &testLogger{}
+	options := DefaultOptions
+	options.Dir = t.TempDir()
+	options.SegmentSize = 64 * wal.KB
+	options.Logger = logger
+	db, err := openDB(options)
+	assert.Nil(t, err)
+	defer deleteDB(db)
+
+	mergeTestPutAndDelete(t, db)
+	segmentIds := db.wal.SegmentIds()
+	assert.Nil(t, db.merge())
+
+	// the segments scheduled before the merge are removed, and the reserved ids are skipped
+	assert.Nil(t, db.buildHintFile(segmentIds[0]))
+	_, err = os.Stat(wal.JoinSegmentPath(options.Dir, SegmentHintSuffix, segmentIds[0]))
+	assert.True(t, os.IsNotExist(err))
+	for i := 0; i < 10000; i++ {
+		assert.Nil(t, db.Put([]byte(strconv.Itoa(i)), []byte("new")))
+	}
+	ids := db.wal.SegmentIds()
+	assert.Eventually(t, func() bool {
+		for _, id := range ids[:len(ids)-1] {
+			if _, err := os.Stat(wal.JoinSegmentPath(options.Dir, SegmentHintSuffix, id)); err != nil {
+				return false
+			}
+		}
+		return true
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, 0, logger.count("ERROR"))
+}
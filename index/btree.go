@@ -66,3 +66,13 @@ func (mBTree *memoryBTree) Size() int {
 	defer mBTree.mu.RUnlock()
 	return mBTree.btree.Len()
 }
+
+func (mBTree *memoryBTree) Ascend(start []byte, fn func(key []byte, chunk *wal.Chunk) bool) {
+	mBTree.mu.RLock()
+	defer mBTree.mu.RUnlock()
+
+	mBTree.btree.AscendGreaterOrEqual(&keyChunkPair{key: start}, func(item btree.Item) bool {
+		pair := item.(*keyChunkPair)
+		return fn(pair.key, pair.chunk)
+	})
+}
@@ -93,3 +93,24 @@ func TestMemoryBTree_Size(t *testing.T) {
 		assert.Equal(t, 100-i-1, mBTree.Size())
 	}
 }
+
+func TestMemoryBTree_Ascend(t *testing.T) {
+	mBTree := newMemoryBTree()
+	for _, key := range []string{"b", "a", "d", "c"} {
+		mBTree.Put([]byte(key), &wal.Chunk{SegmentId: 1})
+	}
+
+	var keys []string
+	mBTree.Ascend(nil, func(key []byte, chunk *wal.Chunk) bool {
+		keys = append(keys, string(key))
+		return true
+	})
+	assert.Equal(t, []string{"a", "b", "c", "d"}, keys)
+
+	keys = nil
+	mBTree.Ascend([]byte("b"), func(key []byte, chunk *wal.Chunk) bool {
+		keys = append(keys, string(key))
+		return len(keys) < 2
+	})
+	assert.Equal(t, []string{"b", "c"}, keys)
+}
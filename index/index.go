@@ -10,6 +10,10 @@ type Indexer interface {
 	Delete(key []byte) (*wal.Chunk, bool)
 
 	Size() int
+
+	// Ascend calls fn for the keys greater than or equal to start in ascending order until fn returns false,
+	// the index must not be changed by fn.
+	Ascend(start []byte, fn func(key []byte, chunk *wal.Chunk) bool)
 }
 
 func NewIndexer() Indexer {
@@ -0,0 +1,63 @@
+package kv_db
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// latencyBuckets are the upper bounds of the buckets of the latency histograms.
+var latencyBuckets = [...]time.Duration{
+	10 * time.Microsecond,
+	50 * time.Microsecond,
+	100 * time.Microsecond,
+	500 * time.Microsecond,
+	time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	5 * time.Second,
+	10 * time.Second,
+	time.Minute,
+}
+
+// LatencyHistogram counts the latencies of an operation. Counts[i] is the number of the latencies not greater
+// than Bounds[i] and greater than the previous bound, the last count is of the latencies greater than all bounds.
+// Count is the sum of Counts.
+type LatencyHistogram struct {
+	Bounds []time.Duration
+	Counts []uint64
+	Count  uint64
+	Sum    time.Duration
+}
+
+// latencyHistogram is updated atomically, so a snapshot may miss the latencies being observed.
+type latencyHistogram struct {
+	// one more bucket for the latencies greater than all bounds
+	counts [len(latencyBuckets) + 1]uint64
+	sum    int64
+}
+
+func (h *latencyHistogram) observe(d time.Duration) {
+	i := 0
+	for i < len(latencyBuckets) && d > latencyBuckets[i] {
+		i++
+	}
+	atomic.AddUint64(&h.counts[i], 1)
+	atomic.AddInt64(&h.sum, int64(d))
+}
+
+func (h *latencyHistogram) snapshot() LatencyHistogram {
+	s := LatencyHistogram{
+		Bounds: append([]time.Duration(nil), latencyBuckets[:]...),
+		Counts: make([]uint64, len(h.counts)),
+		Sum:    time.Duration(atomic.LoadInt64(&h.sum)),
+	}
+	for i := range h.counts {
+		s.Counts[i] = atomic.LoadUint64(&h.counts[i])
+		s.Count += s.Counts[i]
+	}
+	return s
+}
@@ -0,0 +1,25 @@
+package kv_db
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestLatencyHistogram(t *testing.T) {
+	h := &latencyHistogram{}
+
+	h.observe(time.Microsecond)
+	h.observe(10 * time.Microsecond)
+	h.observe(2 * time.Millisecond)
+	h.observe(time.Hour)
+
+	s := h.snapshot()
+	assert.Equal(t, latencyBuckets[:], s.Bounds)
+	assert.Equal(t, len(s.Bounds)+1, len(s.Counts))
+	assert.Equal(t, uint64(4), s.Count)
+	assert.Equal(t, time.Hour+2*time.Millisecond+11*time.Microsecond, s.Sum)
+	assert.Equal(t, uint64(2), s.Counts[0])
+	assert.Equal(t, uint64(1), s.Counts[5])
+	assert.Equal(t, uint64(1), s.Counts[len(latencyBuckets)])
+}
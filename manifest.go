@@ -0,0 +1,74 @@
+package kv_db
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"kv-db/util"
+	"os"
+	"path/filepath"
+)
+
+const ManifestFileName = "MANIFEST"
+
+// manifest records the result of the last merge. The segments whose id is not greater than MergedUpTo,
+// or only the ones in Segments if it is not empty, were rewritten by the merge, they are leftovers once the merged
+// segments are installed. Every merged segment has a hint file in HintFiles.
+// The manifest in the merge directory is the commit point of a merge, once it is written the merge
+// is installed even if the process crashes, by installMerge when the DB is opened again.
+type manifest struct {
+	MergedUpTo uint32   `json:"merged_up_to"`
+	HintFiles  []string `json:"hint_files"`
+	Segments   []uint32 `json:"segments,omitempty"`
+}
+
+func writeManifest(dir string, m *manifest) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return util.WriteFileAtomic(filepath.Join(dir, ManifestFileName), data)
+}
+
+// readManifest returns nil if there is no manifest in the directory.
+func readManifest(dir string) (*manifest, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, ManifestFileName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	m := &manifest{}
+	if err = json.Unmarshal(data, m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// mergedSegments returns the ids of the segments written by the merge, which are the ids of the hint files.
+func (m *manifest) mergedSegments() ([]uint32, error) {
+	ids := make([]uint32, 0, len(m.HintFiles))
+	for _, name := range m.HintFiles {
+		var id uint32
+		if _, err := fmt.Sscanf(name, "%d"+SegmentHintSuffix, &id); err != nil {
+			return nil, fmt.Errorf("invalid hint file %q in the manifest: %w", name, err)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// inputs returns the ids of the segments rewritten by the merge.
+func (m *manifest) inputs() []uint32 {
+	if len(m.Segments) > 0 {
+		return m.Segments
+	}
+
+	ids := make([]uint32, 0, m.MergedUpTo)
+	for id := uint32(1); id <= m.MergedUpTo; id++ {
+		ids = append(ids, id)
+	}
+	return ids
+}
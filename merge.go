@@ -1,149 +1,697 @@
 package kv_db
 
 import (
+	"fmt"
 	"io"
 	"io/ioutil"
-	"kv-db/index"
 	"kv-db/util"
 	"kv-db/wal"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
+	"sync"
 	"time"
 )
 
+const mergeDirName = "merge"
+
+// mergedRecord is a record whose position is changed by a merge, newPos is nil if the record is dropped.
+// The key is removed from the index if the record is deleted, i.e. it is expired or a delete record.
+type mergedRecord struct {
+	key     []byte
+	oldPos  *wal.Chunk
+	newPos  *wal.Chunk
+	deleted bool
+}
+
+// mergeResult is the output of a merge which is committed in the merge directory.
+type mergeResult struct {
+	// inputs are the ids of the segments replaced by the merge, merged are the ids of the segments written by it
+	inputs  []uint32
+	merged  []uint32
+	records []mergedRecord
+}
+
+// mergeIndexBatchSize is the number of the merged records whose positions are replaced in the index at a time,
+// so the reads and writes are not blocked until the whole index is updated.
+const mergeIndexBatchSize = 1024
+
+// Merge rewrites the sealed segments to reclaim the space of the stale records, like the auto merges it only
+// rewrites the segments with the most garbage if Options.MergeSegmentsLimit is set.
+func (db *DB) Merge() error {
+	if db.closed {
+		return ErrDBClosed
+	}
+	return db.merge()
+}
+
+// merge is run by the auto merge jobs, it merges the segments with the most garbage if Options.MergeSegmentsLimit is set,
+// otherwise all sealed segments.
 func (db *DB) merge() error {
-	mergeDir := filepath.Join(db.options.Dir, "merge")
+	if db.options.ReadOnly {
+		return ErrReadOnly
+	}
+
+	db.mergeMu.Lock()
+	defer db.mergeMu.Unlock()
+	if db.stopped() {
+		return ErrDBClosed
+	}
+
+	if db.options.MergeSegmentsLimit > 0 {
+		ids, err := db.pickMergeSegments(db.options.MergeSegmentsLimit)
+		if err == nil && len(ids) == 0 {
+			return nil
+		}
+		// the error of picking the segments fails the merge, so it is reported like the other failures
+		return db.runMerge(false, ids, func() ([]uint32, error) {
+			if err != nil {
+				return nil, fmt.Errorf("pick the segments to merge: %w", err)
+			}
+			return db.mergeSegments(ids)
+		})
+	}
+
+	return db.runMerge(true, nil, db.mergeAll)
+}
+
+func (db *DB) mergeAll() ([]uint32, error) {
+	mergeDir := filepath.Join(db.options.Dir, mergeDirName)
 	if err := db.cleanDir(mergeDir); err != nil {
+		return nil, err
+	}
+	result, err := db.doMerge(mergeDir)
+	if err != nil {
+		return nil, err
+	}
+	return result.inputs, db.finishMerge(mergeDir, result)
+}
+
+// MergeSegments rewrites the given sealed segments with their live records only, the other segments are untouched.
+// The merged segments get new ids after all segments, since they only keep the latest records of the keys.
+func (db *DB) MergeSegments(ids []uint32) error {
+	if db.closed {
+		return ErrDBClosed
+	}
+	if db.options.ReadOnly {
+		return ErrReadOnly
+	}
+
+	db.mergeMu.Lock()
+	defer db.mergeMu.Unlock()
+	if db.stopped() {
+		return ErrDBClosed
+	}
+
+	if len(ids) == 0 {
+		return nil
+	}
+
+	return db.runMerge(false, ids, func() ([]uint32, error) {
+		ids, err := db.checkMergeSegments(ids)
+		if err != nil {
+			return nil, err
+		}
+		return db.mergeSegments(ids)
+	})
+}
+
+func (db *DB) mergeSegments(ids []uint32) ([]uint32, error) {
+	mergeDir := filepath.Join(db.options.Dir, mergeDirName)
+	if err := db.cleanDir(mergeDir); err != nil {
+		return nil, err
+	}
+	_, firstId, err := db.sealForMerge(func(int) int {
+		return len(ids)
+	})
+	if err != nil {
+		return nil, err
+	}
+	result, err := db.doMergeSegments(mergeDir, ids, firstId, false)
+	if err != nil {
+		return nil, err
+	}
+	return result.inputs, db.finishMerge(mergeDir, result)
+}
+
+// checkMergeSegments returns the sorted ids without duplicates, all of them must be sealed segments.
+func (db *DB) checkMergeSegments(ids []uint32) ([]uint32, error) {
+	// the segments merged by the old versions are indexed by the hint wal, they can only be merged all together
+	mergeFinSegId, err := db.readMergeFinFile(db.options.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	segmentIds := db.wal.SegmentIds()
+	sealed := make(map[uint32]bool, len(segmentIds))
+	for _, id := range segmentIds[:len(segmentIds)-1] {
+		sealed[id] = true
+	}
+
+	var ret []uint32
+	for _, id := range ids {
+		if !sealed[id] {
+			return nil, fmt.Errorf("segment %d is not a sealed segment", id)
+		}
+		if id <= mergeFinSegId {
+			return nil, fmt.Errorf("segment %d is indexed by the hint wal, it can only be merged by a full merge", id)
+		}
+		sealed[id] = false
+		ret = append(ret, id)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i] < ret[j]
+	})
+	return ret, nil
+}
+
+// pickMergeSegments returns at most n sealed segments with the highest garbage ratio,
+// the tombstones are not counted since the incremental merges keep them.
+func (db *DB) pickMergeSegments(n int) ([]uint32, error) {
+	mergeFinSegId, err := db.readMergeFinFile(db.options.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	segmentIds := db.wal.SegmentIds()
+	type candidate struct {
+		id    uint32
+		ratio float64
+	}
+	var candidates []candidate
+	db.garbage.mu.Lock()
+	for _, id := range segmentIds[:len(segmentIds)-1] {
+		if stat, ok := db.garbage.segments[id]; ok && id > mergeFinSegId && stat.Dead > 0 {
+			candidates = append(candidates, candidate{id, float64(stat.Dead) / float64(stat.Total)})
+		}
+	}
+	db.garbage.mu.Unlock()
+
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].ratio > candidates[j].ratio
+	})
+	if len(candidates) > n {
+		candidates = candidates[:n]
+	}
+
+	ids := make([]uint32, 0, len(candidates))
+	for _, c := range candidates {
+		ids = append(ids, c.id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i] < ids[j]
+	})
+	return ids, nil
+}
+
+// finishMerge installs the merge, and replaces the positions of the merged records in the index. The merged segments
+// are added beside the old ones, so the index is updated in batches while the reads go on, and the old segments
+// are removed at last.
+func (db *DB) finishMerge(mergeDir string, result *mergeResult) error {
+	if err := db.installMerge(mergeDir); err != nil {
 		return err
 	}
-	if err := db.doMerge(mergeDir); err != nil {
+	if err := db.wal.ReplaceSegments(result.merged); err != nil {
 		return err
 	}
 
+	// the indexed records are never delete records, so the deleted ones are expired
+	var expired int
+	for start := 0; start < len(result.records); start += mergeIndexBatchSize {
+		end := start + mergeIndexBatchSize
+		if end > len(result.records) {
+			end = len(result.records)
+		}
+		expired += db.replaceMergedRecords(result.records[start:end])
+	}
+
+	if err := db.removeMergeInputs(result.inputs, expired); err != nil {
+		return err
+	}
+
+	// the merge has been installed, the stats are only for inspection so a failed save does not fail it
+	if err := db.garbage.save(db.options.Dir); err != nil {
+		db.warnf("save the segment stats: %v", err)
+	}
+	return nil
+}
+
+// removeMergeInputs removes the segments replaced by a merge, no position in the index points to them now.
+func (db *DB) removeMergeInputs(inputs []uint32, expired int) error {
 	db.mu.Lock()
 	defer db.mu.Unlock()
 
-	if err := db.replaceSegmentFile(mergeDir); err != nil {
+	if err := db.removeMergeLeftovers(); err != nil {
 		return err
 	}
-
-	walFile, err := db.openWalFiles()
-	if err != nil {
+	if err := db.wal.ReplaceSegments(inputs); err != nil {
 		return err
 	}
-	db.wal = walFile
+	db.garbage.remove(inputs)
+	db.expiredRemoved(expired)
+	db.expirationSweep("merge", expired)
+	return nil
+}
+
+// replaceMergedRecords replaces the positions of the merged records in the index, and returns the number of the expired
+// keys removed. The keys written or deleted during the merge point to the new records, they are kept.
+func (db *DB) replaceMergedRecords(records []mergedRecord) int {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	var expired int
+	for _, r := range records {
+		replaced := samePos(db.indexer.Get(r.key), r.oldPos)
+		if replaced && r.deleted {
+			db.indexer.Delete(r.key)
+			db.valueCache.remove(r.key)
+			expired++
+		} else if replaced {
+			db.indexer.Put(r.key, r.newPos)
+		}
+
+		if r.newPos != nil {
+			db.garbage.written(r.newPos, r.deleted)
+			if !replaced && !r.deleted {
+				db.garbage.dead(r.newPos)
+			}
+		}
+	}
+	return expired
+}
 
-	db.indexer = index.NewIndexer()
-	return db.loadIndex()
+// sealForMerge seals the active segment and reserves the ids after it for the merged segments, so the merged segments
+// are ordered after all the segments written before the merge and before the ones written during the merge.
+// reserve returns the number of the ids for the given number of the sealed segments. It returns the ids of the sealed
+// segments, the last one is the segment sealed by it, and the first reserved id.
+func (db *DB) sealForMerge(reserve func(sealed int) int) ([]uint32, uint32, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	ids := db.wal.SegmentIds()
+	prevSegId, err := db.wal.SwitchNewSegmentReserve(uint32(reserve(len(ids))))
+	if err != nil {
+		return nil, 0, err
+	}
+	return ids, prevSegId + 1, nil
 }
 
-func (db *DB) doMerge(mergeDir string) error {
-	mergeDB, err := Open(Options{
-		Dir:           mergeDir,
-		SegmentSize:   db.options.SegmentSize,
-		AutoMergeExpr: "",
+// doMerge merges all sealed segments, the merged segments get the ids reserved after the active segment.
+func (db *DB) doMerge(mergeDir string) (*mergeResult, error) {
+	if db.options.MergeWorkers > 1 {
+		segmentIds, firstId, err := db.sealForMerge(func(sealed int) int {
+			return sealed
+		})
+		if err != nil {
+			return nil, err
+		}
+		return db.doMergeSegments(mergeDir, segmentIds, firstId, true)
+	}
+
+	// the merged records are never more than the old ones, but they may be packed worse into the segments,
+	// e.g. if the segment size is reduced, so twice the ids are reserved
+	segmentIds, firstId, err := db.sealForMerge(func(sealed int) int {
+		return 2 * sealed
 	})
 	if err != nil {
-		return err
+		return nil, err
+	}
+	prevSegId := segmentIds[len(segmentIds)-1]
+	lastId := firstId + 2*uint32(len(segmentIds)) - 1
+
+	mergeWal, err := db.openMergeWal(mergeDir, firstId)
+	if err != nil {
+		return nil, err
 	}
 	defer func() {
-		_ = mergeDB.Close()
+		_ = mergeWal.Close()
 	}()
 
-	if mergeDB.hintWal, err = mergeDB.openHintWal(); err != nil {
-		return err
+	result := &mergeResult{}
+	hints := make(map[uint32][]*hintEntry)
+	now := time.Now().UnixNano()
+	for _, id := range segmentIds {
+		walIter, err := db.wal.NewSegmentIterator(id)
+		if err != nil {
+			return nil, err
+		}
+
+		for {
+			data, oldPos, err := walIter.Next()
+			if err != nil {
+				if err == io.EOF {
+					break
+				}
+				return nil, err
+			}
+			if !db.readLimiter.Wait(int(oldPos.Size), db.closing) {
+				return nil, ErrDBClosed
+			}
+
+			// the delete records are not needed any more, since all the older records are merged
+			record := decodeLogRecord(data)
+			if record.recordType != recordModified || !db.isIndexed(record.key, oldPos) {
+				continue
+			}
+
+			if record.isExpired(now) {
+				result.records = append(result.records, mergedRecord{key: record.key, oldPos: oldPos, deleted: true})
+				continue
+			}
+
+			if !db.writeLimiter.Wait(len(data), db.closing) {
+				return nil, ErrDBClosed
+			}
+			newChunk, err := mergeWal.Write(data)
+			if err != nil {
+				return nil, err
+			}
+			hints[newChunk.SegmentId] = append(hints[newChunk.SegmentId], &hintEntry{recordType: recordModified, expire: record.expire, key: record.key, pos: newChunk})
+			result.records = append(result.records, mergedRecord{key: record.key, oldPos: oldPos, newPos: newChunk})
+		}
 	}
 
-	prevSegId, err := db.wal.SwitchNewSegmentForce()
-	if err != nil {
-		return err
+	// the merged segments must not overwrite the segments written during the merge
+	mergedIds := mergeWal.SegmentIds()
+	if mergedIds[len(mergedIds)-1] > lastId {
+		return nil, fmt.Errorf("merged segment %d overlaps the active segments", mergedIds[len(mergedIds)-1])
+	}
+	if err = mergeWal.Sync(); err != nil {
+		return nil, err
+	}
+
+	m := &manifest{MergedUpTo: prevSegId}
+	result.inputs = m.inputs()
+	result.merged = mergedIds
+	if err = db.commitMerge(mergeDir, m, hints); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// doMergeSegments merges the given segments by Options.MergeWorkers goroutines, the segment ids[i] is merged to the segment
+// firstId+i. The delete records are dropped if full is true, which means all sealed segments are merged.
+func (db *DB) doMergeSegments(mergeDir string, ids []uint32, firstId uint32, full bool) (*mergeResult, error) {
+	type segmentResult struct {
+		records []mergedRecord
+		entries []*hintEntry
+		err     error
+	}
+	results := make([]segmentResult, len(ids))
+
+	workers := db.options.MergeWorkers
+	if workers < 1 {
+		workers = 1
+	}
+	if workers > len(ids) {
+		workers = len(ids)
 	}
 
+	// only the record pointed by the index is live, so a key is written by one worker at most
 	now := time.Now().UnixNano()
-	walIter := db.wal.NewIteratorLessEqual(prevSegId)
+	tasks := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for idx := range tasks {
+				r := &results[idx]
+				r.records, r.entries, r.err = db.mergeSegment(mergeDir, ids[idx], firstId+uint32(idx), now, !full)
+			}
+		}()
+	}
+	for idx := range ids {
+		tasks <- idx
+	}
+	close(tasks)
+	wg.Wait()
+
+	result := &mergeResult{inputs: ids}
+	hints := make(map[uint32][]*hintEntry)
+	m := &manifest{MergedUpTo: ids[len(ids)-1]}
+	if !full {
+		m.Segments = ids
+	}
+	for idx := range ids {
+		r := results[idx]
+		if r.err != nil {
+			return nil, r.err
+		}
+		if len(r.entries) > 0 {
+			result.merged = append(result.merged, firstId+uint32(idx))
+			hints[firstId+uint32(idx)] = r.entries
+		}
+		result.records = append(result.records, r.records...)
+	}
+
+	if err := db.commitMerge(mergeDir, m, hints); err != nil {
+		return nil, err
+	}
+	result.inputs = m.inputs()
+	return result, nil
+}
+
+// mergeSegment writes the live records of the segment to the segment newId in the merge directory,
+// no segment is written if there is no live record.
+func (db *DB) mergeSegment(mergeDir string, id uint32, newId uint32, now int64, keepDeleted bool) ([]mergedRecord, []*hintEntry, error) {
+	walIter, err := db.wal.NewSegmentIterator(id)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// the merged segment is written in its own directory, since a wal can not share the directory with others
+	segmentDir := filepath.Join(mergeDir, strconv.Itoa(int(newId)))
+	mergeWal, err := db.openMergeWal(segmentDir, newId)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer func() {
+		_ = mergeWal.Close()
+		_ = os.RemoveAll(segmentDir)
+	}()
+
+	var records []mergedRecord
+	var entries []*hintEntry
 	for {
 		data, oldPos, err := walIter.Next()
 		if err != nil {
 			if err == io.EOF {
 				break
 			}
-			return err
+			return nil, nil, err
+		}
+		if !db.readLimiter.Wait(int(oldPos.Size), db.closing) {
+			return nil, nil, ErrDBClosed
 		}
 
 		record := decodeLogRecord(data)
-		if record.recordType == recordModified && (record.expire == 0 || !record.isExpired(now)) {
-			db.mu.Lock()
-			newPos := db.indexer.Get(record.key)
-			db.mu.Unlock()
-
-			if newPos != nil &&
-				newPos.SegmentId == oldPos.SegmentId &&
-				newPos.BlockIndex == oldPos.BlockIndex &&
-				newPos.BlockOffset == oldPos.BlockOffset {
-
-				newChunk, err := mergeDB.wal.Write(data)
-				if err != nil {
-					return err
-				}
+		deleted := record.recordType == recordDeleted || record.isExpired(now)
+		indexed := db.isIndexed(record.key, oldPos)
+		if !deleted && !indexed {
+			continue
+		}
 
-				_, err = mergeDB.hintWal.Write(encodeHintRecord(record.key, newChunk))
-				if err != nil {
-					return err
-				}
+		if deleted {
+			// an expired record may still be in the index
+			if indexed {
+				records = append(records, mergedRecord{key: record.key, oldPos: oldPos, deleted: true})
 			}
+
+			// the delete records and the expired records are kept, since the older records of the keys
+			// may be in the segments which are not merged, unless the key is written again
+			if !keepDeleted || (!indexed && db.isIndexed(record.key, nil)) {
+				continue
+			}
+		}
+
+		if !db.writeLimiter.Wait(len(data), db.closing) {
+			return nil, nil, ErrDBClosed
+		}
+		newChunk, err := mergeWal.Write(data)
+		if err != nil {
+			return nil, nil, err
+		}
+		if newChunk.SegmentId != newId {
+			return nil, nil, fmt.Errorf("merged segment %d is larger than the segment size", id)
+		}
+		entries = append(entries, &hintEntry{recordType: record.recordType, expire: record.expire, key: record.key, pos: newChunk})
+		if deleted {
+			// the record is not indexed, it is only counted as garbage
+			records = append(records, mergedRecord{key: record.key, newPos: newChunk, deleted: true})
+		} else {
+			records = append(records, mergedRecord{key: record.key, oldPos: oldPos, newPos: newChunk})
 		}
 	}
 
-	return db.writeMergeFinFile(mergeDir, prevSegId)
+	if len(entries) == 0 {
+		return records, nil, nil
+	}
+	if err = mergeWal.Sync(); err != nil {
+		return nil, nil, err
+	}
+	err = os.Rename(wal.JoinSegmentPath(segmentDir, wal.SegmentSuffix, newId), wal.JoinSegmentPath(mergeDir, wal.SegmentSuffix, newId))
+	if err != nil {
+		return nil, nil, err
+	}
+	return records, entries, nil
 }
 
-func (db *DB) replaceSegmentFile(mergeDir string) error {
-	dbDir := db.options.Dir
+// isIndexed reports whether the index points to pos, or whether the key is indexed if pos is nil.
+func (db *DB) isIndexed(key []byte, pos *wal.Chunk) bool {
+	db.mu.RLock()
+	indexed := db.indexer.Get(key)
+	db.mu.RUnlock()
+
+	if pos == nil {
+		return indexed != nil
+	}
+	return samePos(indexed, pos)
+}
+
+func samePos(a, b *wal.Chunk) bool {
+	return a != nil && b != nil &&
+		a.SegmentId == b.SegmentId &&
+		a.BlockIndex == b.BlockIndex &&
+		a.BlockOffset == b.BlockOffset
+}
+
+func (db *DB) openMergeWal(dir string, firstSegmentId uint32) (*wal.Wal, error) {
+	return wal.Open(wal.Options{
+		Dir:               dir,
+		SegmentSize:       db.options.SegmentSize,
+		SegmentFileSuffix: wal.SegmentSuffix,
+		Checksum:          db.options.Checksum,
+		RecordHash:        db.options.RecordHash,
+		BlockSize:         db.options.BlockSize,
+		FirstSegmentId:    firstSegmentId,
+		SyncObserver:      db.stats.syncLatency.observe,
+	})
+}
+
+// commitMerge writes the hint files and then the manifest into the merge directory,
+// after that the merge is installed even if the process crashes.
+func (db *DB) commitMerge(mergeDir string, m *manifest, hints map[uint32][]*hintEntry) error {
+	for id, entries := range hints {
+		if err := writeHintFile(mergeDir, id, entries); err != nil {
+			return err
+		}
+		m.HintFiles = append(m.HintFiles, filepath.Base(wal.JoinSegmentPath("", SegmentHintSuffix, id)))
+	}
+	sort.Strings(m.HintFiles)
+
+	if err := util.SyncDir(mergeDir); err != nil {
+		return err
+	}
+	return writeManifest(mergeDir, m)
+}
+
+// installMerge moves the output of a committed merge into the DB directory, the output of an uncommitted merge is discarded.
+// It is idempotent, so an install interrupted by a crash is completed by installing again when the DB is opened.
+func (db *DB) installMerge(mergeDir string) error {
 	if _, err := os.Stat(mergeDir); err != nil {
 		if os.IsNotExist(err) {
 			return nil
 		}
 		return err
 	}
-	defer func() {
-		_ = os.RemoveAll(mergeDir)
-	}()
 
-	maxSegId, err := db.readMergeFinFile(mergeDir)
+	m, err := readManifest(mergeDir)
 	if err != nil {
 		return err
 	}
+	if m == nil {
+		return os.RemoveAll(mergeDir)
+	}
 
-	for i := uint32(1); i <= maxSegId; i++ {
-		path := wal.JoinSegmentPath(dbDir, wal.SegmentSuffix, i)
-		if _, err = os.Stat(path); err == nil {
-			if err = os.Remove(path); err != nil {
-				return err
-			}
+	// the old segments are kept, they are removed by removeMergeLeftovers once they are not read any more
+	mergedIds, err := m.mergedSegments()
+	if err != nil {
+		return err
+	}
+	dbDir := db.options.Dir
+	for _, id := range mergedIds {
+		// the segment has been moved if it is not in the merge directory
+		if err = util.CopyFile(wal.JoinSegmentPath(mergeDir, wal.SegmentSuffix, id), wal.JoinSegmentPath(dbDir, wal.SegmentSuffix, id)); err != nil {
+			return err
+		}
+	}
+	for _, name := range m.HintFiles {
+		if err = util.CopyFile(filepath.Join(mergeDir, name), filepath.Join(dbDir, name)); err != nil {
+			return err
 		}
 	}
 
-	for i := uint32(1); i <= maxSegId; i++ {
-		err := util.CopyFile(wal.JoinSegmentPath(mergeDir, wal.SegmentSuffix, i), wal.JoinSegmentPath(dbDir, wal.SegmentSuffix, i))
-		if err != nil {
+	// all segments indexed by the hint wal of the old versions are merged
+	if len(m.Segments) == 0 {
+		if err = removeLegacyHintFiles(dbDir); err != nil {
+			return err
+		}
+	}
+	if err = util.SyncDir(dbDir); err != nil {
+		return err
+	}
+
+	// the manifest is moved at last, the merge is installed completely after that
+	if err = util.CopyFile(filepath.Join(mergeDir, ManifestFileName), filepath.Join(dbDir, ManifestFileName)); err != nil {
+		return err
+	}
+	if err = util.SyncDir(dbDir); err != nil {
+		return err
+	}
+	return os.RemoveAll(mergeDir)
+}
+
+// removeMergeLeftovers removes the old segments of the last merge.
+func (db *DB) removeMergeLeftovers() error {
+	m, err := readManifest(db.options.Dir)
+	if err != nil || m == nil {
+		return err
+	}
+
+	for _, id := range m.inputs() {
+		if err = removeSegmentFiles(db.options.Dir, id); err != nil {
 			return err
 		}
 	}
+	return nil
+}
 
-	err = util.CopyFile(wal.JoinSegmentPath(mergeDir, HintSuffix, 1), wal.JoinSegmentPath(dbDir, HintSuffix, 1))
+// removeSegmentFiles removes the segment and its hint file.
+func removeSegmentFiles(dir string, id uint32) error {
+	for _, suffix := range []string{wal.SegmentSuffix, SegmentHintSuffix} {
+		err := os.Remove(wal.JoinSegmentPath(dir, suffix, id))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeLegacyHintFiles removes the hint wal and the merge fin file written by the old versions.
+func removeLegacyHintFiles(dir string) error {
+	paths, err := filepath.Glob(filepath.Join(dir, "*"+HintSuffix))
 	if err != nil {
 		return err
 	}
 
-	return util.CopyFile(filepath.Join(mergeDir, MergeFinSuffix), filepath.Join(dbDir, MergeFinSuffix))
+	for _, path := range append(paths, filepath.Join(dir, MergeFinSuffix)) {
+		if err = os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
 }
 
+// openHintWal opens the hint wal written by the old versions, which indexes the segments merged by them.
 func (db *DB) openHintWal() (*wal.Wal, error) {
 	w, err := wal.Open(wal.Options{
 		Dir:               db.options.Dir,
 		SegmentSize:       1 * wal.GB,
 		SegmentFileSuffix: HintSuffix,
+		Checksum:          db.options.Checksum,
+		ReadOnly:          db.options.ReadOnly,
 	})
 
 	if err != nil {
@@ -164,19 +712,6 @@ func (db *DB) cleanDir(mergeDir string) error {
 	return nil
 }
 
-func (db *DB) writeMergeFinFile(dir string, maxSegmentId uint32) error {
-	f, err := os.OpenFile(filepath.Join(dir, MergeFinSuffix), os.O_CREATE|os.O_RDWR, os.ModePerm)
-	if err != nil {
-		return err
-	}
-	defer func() {
-		_ = f.Close()
-	}()
-
-	_, err = f.WriteString(strconv.Itoa(int(maxSegmentId)))
-	return err
-}
-
 func (db *DB) readMergeFinFile(dir string) (uint32, error) {
 	bytes, err := ioutil.ReadFile(filepath.Join(dir, MergeFinSuffix))
 	if err != nil {
@@ -2,9 +2,13 @@ package kv_db
 
 import (
 	"github.com/stretchr/testify/assert"
+	"kv-db/wal"
 	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
 	"testing"
+	"time"
 )
 
 func deleteDB(db *DB) {
@@ -18,6 +22,7 @@ func openDB(options Options) (*DB, error) {
 
 func TestDB_MergeAllValid(t *testing.T) {
 	options := DefaultOptions
+	options.Dir = t.TempDir()
 	db, err := openDB(options)
 	assert.Nil(t, err)
 	defer deleteDB(db)
@@ -38,6 +43,7 @@ func TestDB_MergeAllValid(t *testing.T) {
 	assert.Nil(t, err)
 	db, err = openDB(options)
 	assert.Nil(t, err)
+	defer deleteDB(db)
 
 	assert.Equal(t, 10000, db.indexer.Size())
 	for i := 0; i < 10000; i++ {
@@ -49,6 +55,7 @@ func TestDB_MergeAllValid(t *testing.T) {
 
 func TestDB_MergeAllInvalid(t *testing.T) {
 	options := DefaultOptions
+	options.Dir = t.TempDir()
 	db, err := openDB(options)
 	assert.Nil(t, err)
 	defer deleteDB(db)
@@ -77,6 +84,7 @@ func TestDB_MergeAllInvalid(t *testing.T) {
 	err = db.Close()
 	assert.Nil(t, err)
 	db, err = openDB(options)
+	defer deleteDB(db)
 
 	// empty keys
 	assert.Equal(t, 0, db.indexer.Size())
@@ -84,6 +92,7 @@ func TestDB_MergeAllInvalid(t *testing.T) {
 
 func TestDB_Merge(t *testing.T) {
 	options := DefaultOptions
+	options.Dir = t.TempDir()
 	db, err := openDB(options)
 	assert.Nil(t, err)
 	defer deleteDB(db)
@@ -125,3 +134,524 @@ func TestDB_Merge(t *testing.T) {
 		assert.Equal(t, val, data)
 	}
 }
+
+func TestDB_MergeWithBlockCache(t *testing.T) {
+	options := DefaultOptions
+	options.Dir = t.TempDir()
+	options.BlockCacheSize = 1 * wal.MB
+	db, err := openDB(options)
+	assert.Nil(t, err)
+	defer deleteDB(db)
+
+	val := []byte("abc")
+	for i := 0; i < 10000; i++ {
+		err := db.Put([]byte(strconv.Itoa(i)), val)
+		assert.Nil(t, err)
+	}
+
+	// delete the even keys and fill the cache with the old blocks
+	for i := 0; i < 10000; i += 2 {
+		err := db.Delete([]byte(strconv.Itoa(i)))
+		assert.Nil(t, err)
+	}
+	for i := 1; i < 10000; i += 2 {
+		_, err := db.Get([]byte(strconv.Itoa(i)))
+		assert.Nil(t, err)
+	}
+
+	// merge moves the records, the cached blocks must not be used any more
+	err = db.merge()
+	assert.Nil(t, err)
+
+	for i := 0; i < 10000; i++ {
+		data, err := db.Get([]byte(strconv.Itoa(i)))
+		if i%2 == 0 {
+			assert.Equal(t, ErrKeyNotFound, err)
+		} else {
+			assert.Nil(t, err)
+			assert.Equal(t, val, data)
+		}
+	}
+}
+
+func mergeTestPutAndDelete(t *testing.T, db *DB) {
+	val := []byte("abc")
+	for i := 0; i < 20000; i++ {
+		assert.Nil(t, db.Put([]byte(strconv.Itoa(i)), val))
+	}
+	for i := 10000; i < 20000; i++ {
+		assert.Nil(t, db.Delete([]byte(strconv.Itoa(i))))
+	}
+}
+
+func mergeTestCheck(t *testing.T, db *DB) {
+	assert.Equal(t, 10000, db.indexer.Size())
+	for i := 0; i < 20000; i++ {
+		data, err := db.Get([]byte(strconv.Itoa(i)))
+		if i < 10000 {
+			assert.Nil(t, err)
+			assert.Equal(t, []byte("abc"), data)
+		} else {
+			assert.Equal(t, ErrKeyNotFound, err)
+		}
+	}
+}
+
+func TestDB_MergeCrashBeforeInstall(t *testing.T) {
+	options := DefaultOptions
+	options.Dir = t.TempDir()
+	options.SegmentSize = 64 * wal.KB
+	db, err := openDB(options)
+	assert.Nil(t, err)
+	mergeTestPutAndDelete(t, db)
+
+	// the merge is committed, but the process crashes before installing it
+	mergeDir := filepath.Join(options.Dir, mergeDirName)
+	assert.Nil(t, db.cleanDir(mergeDir))
+	_, err = db.doMerge(mergeDir)
+	assert.Nil(t, err)
+	assert.Nil(t, db.Close())
+
+	db, err = openDB(options)
+	assert.Nil(t, err)
+	defer deleteDB(db)
+
+	_, err = os.Stat(mergeDir)
+	assert.True(t, os.IsNotExist(err))
+	m, err := readManifest(options.Dir)
+	assert.Nil(t, err)
+	assert.NotNil(t, m)
+	mergeTestCheck(t, db)
+}
+
+func TestDB_MergeCrashDuringInstall(t *testing.T) {
+	options := DefaultOptions
+	options.Dir = t.TempDir()
+	options.SegmentSize = 64 * wal.KB
+	db, err := openDB(options)
+	assert.Nil(t, err)
+	mergeTestPutAndDelete(t, db)
+
+	mergeDir := filepath.Join(options.Dir, mergeDirName)
+	assert.Nil(t, db.cleanDir(mergeDir))
+	_, err = db.doMerge(mergeDir)
+	assert.Nil(t, err)
+	assert.Nil(t, db.Close())
+
+	// the process crashes after the first merged segment is moved
+	m, err := readManifest(mergeDir)
+	assert.Nil(t, err)
+	mergedIds, err := m.mergedSegments()
+	assert.Nil(t, err)
+	first := mergedIds[0]
+	assert.True(t, first > m.MergedUpTo)
+	assert.Nil(t, os.Rename(wal.JoinSegmentPath(mergeDir, wal.SegmentSuffix, first), wal.JoinSegmentPath(options.Dir, wal.SegmentSuffix, first)))
+
+	db, err = openDB(options)
+	assert.Nil(t, err)
+	defer deleteDB(db)
+	mergeTestCheck(t, db)
+
+	// the old segments are removed, and the merged ones are installed
+	for i := uint32(1); i <= m.MergedUpTo; i++ {
+		_, err = os.Stat(wal.JoinSegmentPath(options.Dir, wal.SegmentSuffix, i))
+		assert.True(t, os.IsNotExist(err))
+	}
+	for _, id := range mergedIds {
+		_, err = os.Stat(wal.JoinSegmentPath(options.Dir, wal.SegmentSuffix, id))
+		assert.Nil(t, err)
+	}
+}
+
+func TestDB_MergeCrashBeforeCommit(t *testing.T) {
+	options := DefaultOptions
+	options.Dir = t.TempDir()
+	options.SegmentSize = 64 * wal.KB
+	db, err := openDB(options)
+	assert.Nil(t, err)
+	mergeTestPutAndDelete(t, db)
+
+	// the merge is not committed, so its output is discarded
+	mergeDir := filepath.Join(options.Dir, mergeDirName)
+	assert.Nil(t, db.cleanDir(mergeDir))
+	_, err = db.doMerge(mergeDir)
+	assert.Nil(t, err)
+	assert.Nil(t, os.Remove(filepath.Join(mergeDir, ManifestFileName)))
+	assert.Nil(t, db.Close())
+
+	db, err = openDB(options)
+	assert.Nil(t, err)
+	defer deleteDB(db)
+
+	_, err = os.Stat(mergeDir)
+	assert.True(t, os.IsNotExist(err))
+	m, err := readManifest(options.Dir)
+	assert.Nil(t, err)
+	assert.Nil(t, m)
+	mergeTestCheck(t, db)
+}
+
+func TestDB_MergeWithConcurrentWrites(t *testing.T) {
+	options := DefaultOptions
+	options.Dir = t.TempDir()
+	options.SegmentSize = 64 * wal.KB
+	options.MaxOpenSegments = 2
+	db, err := openDB(options)
+	assert.Nil(t, err)
+	defer deleteDB(db)
+	mergeTestPutAndDelete(t, db)
+
+	// the keys updated during the merge keep the new values
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 10000; i += 3 {
+			assert.Nil(t, db.Put([]byte(strconv.Itoa(i)), []byte("new")))
+		}
+	}()
+	assert.Nil(t, db.merge())
+	<-done
+
+	for i := 0; i < 20000; i++ {
+		data, err := db.Get([]byte(strconv.Itoa(i)))
+		switch {
+		case i >= 10000:
+			assert.Equal(t, ErrKeyNotFound, err)
+		case i%3 == 0:
+			assert.Nil(t, err)
+			assert.Equal(t, []byte("new"), data)
+		default:
+			assert.Nil(t, err)
+			assert.Equal(t, []byte("abc"), data)
+		}
+	}
+}
+
+func TestDB_MergeWithConcurrentReads(t *testing.T) {
+	options := DefaultOptions
+	options.Dir = t.TempDir()
+	options.SegmentSize = 64 * wal.KB
+	db, err := openDB(options)
+	assert.Nil(t, err)
+	defer deleteDB(db)
+	mergeTestPutAndDelete(t, db)
+	segmentIds := db.wal.SegmentIds()
+
+	// the old segments are read until the index points to the merged ones
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; ; i = (i + 7) % 10000 {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			data, err := db.Get([]byte(strconv.Itoa(i)))
+			assert.Nil(t, err)
+			assert.Equal(t, []byte("abc"), data)
+		}
+	}()
+	assert.Nil(t, db.merge())
+	close(stop)
+	<-done
+	mergeTestCheck(t, db)
+
+	// the merged segments are after the old ones, which are removed
+	for _, id := range segmentIds {
+		_, err = os.Stat(wal.JoinSegmentPath(options.Dir, wal.SegmentSuffix, id))
+		assert.True(t, os.IsNotExist(err))
+	}
+	assert.True(t, db.wal.SegmentIds()[0] > segmentIds[len(segmentIds)-1])
+
+	assert.Nil(t, db.Close())
+	db, err = openDB(options)
+	assert.Nil(t, err)
+	defer deleteDB(db)
+	mergeTestCheck(t, db)
+}
+
+func TestDB_MergeSegments(t *testing.T) {
+	options := DefaultOptions
+	options.Dir = t.TempDir()
+	options.SegmentSize = 64 * wal.KB
+	db, err := openDB(options)
+	assert.Nil(t, err)
+	defer deleteDB(db)
+
+	val := []byte("abc")
+	for i := 0; i < 10000; i++ {
+		assert.Nil(t, db.Put([]byte(strconv.Itoa(i)), val))
+	}
+	for i := 0; i < 5000; i++ {
+		assert.Nil(t, db.Delete([]byte(strconv.Itoa(i))))
+	}
+	for i := 5000; i < 6000; i++ {
+		assert.Nil(t, db.Put([]byte(strconv.Itoa(i)), []byte("new")))
+	}
+	check := func() {
+		for i := 0; i < 10000; i++ {
+			data, err := db.Get([]byte(strconv.Itoa(i)))
+			switch {
+			case i < 5000:
+				assert.Equal(t, ErrKeyNotFound, err)
+			case i < 6000:
+				assert.Nil(t, err)
+				assert.Equal(t, []byte("new"), data)
+			default:
+				assert.Nil(t, err)
+				assert.Equal(t, val, data)
+			}
+		}
+	}
+
+	segmentIds := db.wal.SegmentIds()
+	assert.True(t, len(segmentIds) > 4)
+	_, err = os.Stat(wal.JoinSegmentPath(options.Dir, wal.SegmentSuffix, segmentIds[0]))
+	assert.Nil(t, err)
+
+	// the segments with the delete records are merged, but the older segments with the deleted keys are not,
+	// so the delete records must be kept
+	ids, err := db.pickMergeSegments(2)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(ids))
+	var untouched uint32
+	for _, id := range segmentIds[:len(segmentIds)-1] {
+		if id != ids[0] && id != ids[1] {
+			untouched = id
+		}
+	}
+	info, err := os.Stat(wal.JoinSegmentPath(options.Dir, wal.SegmentSuffix, untouched))
+	assert.Nil(t, err)
+
+	total, dead := db.garbage.total()
+	assert.Nil(t, db.MergeSegments(ids))
+	total2, dead2 := db.garbage.total()
+	assert.True(t, total2 < total)
+	assert.True(t, dead2 < dead)
+	check()
+
+	// only the merged segments are rewritten, and they have hint files
+	info2, err := os.Stat(wal.JoinSegmentPath(options.Dir, wal.SegmentSuffix, untouched))
+	assert.Nil(t, err)
+	assert.Equal(t, info.ModTime(), info2.ModTime())
+	for _, id := range ids {
+		_, err = os.Stat(wal.JoinSegmentPath(options.Dir, SegmentHintSuffix, id))
+		_, err2 := os.Stat(wal.JoinSegmentPath(options.Dir, wal.SegmentSuffix, id))
+		assert.Equal(t, err2 == nil, err == nil)
+	}
+
+	// the merged segments are loaded from the hint files
+	assert.Nil(t, db.Close())
+	db, err = openDB(options)
+	assert.Nil(t, err)
+	defer deleteDB(db)
+	check()
+
+	// a full merge after the incremental ones
+	assert.Nil(t, db.MergeSegments(db.wal.SegmentIds()[:1]))
+	assert.Nil(t, db.merge())
+	check()
+	assert.Nil(t, db.Close())
+	db, err = openDB(options)
+	assert.Nil(t, err)
+	defer deleteDB(db)
+	check()
+}
+
+func TestDB_MergeSegmentsTombstones(t *testing.T) {
+	options := DefaultOptions
+	options.Dir = t.TempDir()
+	options.SegmentSize = 64 * wal.KB
+	options.MergeSegmentsLimit = 100
+	options.MergeMinReclaimableBytes = 0
+	db, err := openDB(options)
+	assert.Nil(t, err)
+	defer deleteDB(db)
+
+	for i := 0; i < 10000; i++ {
+		assert.Nil(t, db.Put([]byte(strconv.Itoa(i)), []byte("abc")))
+	}
+	for i := 0; i < 5000; i++ {
+		assert.Nil(t, db.Delete([]byte(strconv.Itoa(i))))
+	}
+
+	ids, err := db.pickMergeSegments(options.MergeSegmentsLimit)
+	assert.Nil(t, err)
+	assert.True(t, len(ids) > 0)
+	assert.Nil(t, db.MergeSegments(ids))
+
+	// the delete records kept by the merge are not picked again, until a full merge reclaims them
+	check := func() {
+		ids, err = db.pickMergeSegments(options.MergeSegmentsLimit)
+		assert.Nil(t, err)
+		assert.Equal(t, 0, len(ids))
+		db.options.MergeReclaimableBytes = 1
+		assert.False(t, db.needMerge())
+		db.options.MergeReclaimableBytes = 0
+		_, dead := db.garbage.total()
+		assert.True(t, dead > 0)
+	}
+	check()
+	assert.Nil(t, db.Close())
+	db, err = openDB(options)
+	assert.Nil(t, err)
+	defer deleteDB(db)
+	check()
+}
+
+func TestDB_MergeSegmentsInvalid(t *testing.T) {
+	options := DefaultOptions
+	options.Dir = t.TempDir()
+	db, err := openDB(options)
+	assert.Nil(t, err)
+	defer deleteDB(db)
+
+	assert.Nil(t, db.Put([]byte("a"), []byte("b")))
+	assert.NotNil(t, db.MergeSegments([]uint32{1}))
+	assert.NotNil(t, db.MergeSegments([]uint32{100}))
+	assert.Nil(t, db.MergeSegments(nil))
+}
+
+func TestDB_SetMergeRateLimit(t *testing.T) {
+	options := DefaultOptions
+	options.Dir = t.TempDir()
+	options.MergeWriteRateLimit = 100 * wal.KB
+	db, err := openDB(options)
+	assert.Nil(t, err)
+	defer deleteDB(db)
+
+	val := []byte(strings.Repeat("x", 1024))
+	for i := 0; i < 300; i++ {
+		assert.Nil(t, db.Put([]byte(strconv.Itoa(i)), val))
+	}
+
+	// about 300KB is written at 100KB/s, and the first 100KB is the burst
+	start := time.Now()
+	assert.Nil(t, db.merge())
+	assert.True(t, time.Since(start) >= 1500*time.Millisecond)
+
+	db.SetMergeRateLimit(0, 0)
+	start = time.Now()
+	assert.Nil(t, db.merge())
+	assert.True(t, time.Since(start) < time.Second)
+}
+
+func TestDB_CloseDuringThrottledMerge(t *testing.T) {
+	options := DefaultOptions
+	options.Dir = t.TempDir()
+	options.MergeWriteRateLimit = 10 * wal.KB
+	started := make(chan struct{})
+	options.EventListener = &EventListener{MergeStarted: func(MergeInfo) {
+		close(started)
+	}}
+	db, err := openDB(options)
+	assert.Nil(t, err)
+	defer deleteDB(db)
+
+	val := []byte(strings.Repeat("x", 1024))
+	for i := 0; i < 300; i++ {
+		assert.Nil(t, db.Put([]byte(strconv.Itoa(i)), val))
+	}
+
+	// the merge takes half a minute at 10KB/s, but it stops once the DB is closed
+	done := make(chan error)
+	go func() {
+		done <- db.Merge()
+	}()
+	<-started
+	time.Sleep(100 * time.Millisecond)
+	start := time.Now()
+	assert.Nil(t, db.Close())
+	assert.True(t, time.Since(start) < time.Second)
+	assert.Equal(t, ErrDBClosed, <-done)
+
+	// the merge is discarded
+	options.EventListener = nil
+	db, err = openDB(options)
+	assert.Nil(t, err)
+	defer deleteDB(db)
+	for i := 0; i < 300; i++ {
+		data, err := db.Get([]byte(strconv.Itoa(i)))
+		assert.Nil(t, err)
+		assert.Equal(t, val, data)
+	}
+}
+
+func TestDB_MergeParallel(t *testing.T) {
+	options := DefaultOptions
+	options.Dir = t.TempDir()
+	options.SegmentSize = 64 * wal.KB
+	options.MergeWorkers = 4
+	db, err := openDB(options)
+	assert.Nil(t, err)
+	defer deleteDB(db)
+
+	// the keys are written in several segments
+	mergeTestPutAndDelete(t, db)
+	for i := 0; i < 10000; i += 2 {
+		assert.Nil(t, db.Put([]byte(strconv.Itoa(i)), []byte("abc")))
+	}
+	segmentIds := db.wal.SegmentIds()
+
+	assert.Nil(t, db.merge())
+	mergeTestCheck(t, db)
+
+	// the delete records are dropped, and the merged segments keep their ids
+	_, dead := db.garbage.total()
+	assert.Equal(t, int64(0), dead)
+	for _, id := range db.wal.SegmentIds() {
+		assert.True(t, id >= segmentIds[0])
+	}
+
+	assert.Nil(t, db.Close())
+	db, err = openDB(options)
+	assert.Nil(t, err)
+	defer deleteDB(db)
+	mergeTestCheck(t, db)
+	_, dead = db.garbage.total()
+	assert.Equal(t, int64(0), dead)
+
+	// incremental merges run in parallel too
+	for i := 0; i < 10000; i += 3 {
+		assert.Nil(t, db.Delete([]byte(strconv.Itoa(i))))
+		assert.Nil(t, db.Put([]byte(strconv.Itoa(i)), []byte("abc")))
+	}
+	segmentIds = db.wal.SegmentIds()
+	assert.Nil(t, db.MergeSegments(segmentIds[:len(segmentIds)-1]))
+	mergeTestCheck(t, db)
+}
+
+func TestDB_MergeSegmentsExpired(t *testing.T) {
+	options := DefaultOptions
+	options.Dir = t.TempDir()
+	options.SegmentSize = 64 * wal.KB
+	db, err := openDB(options)
+	assert.Nil(t, err)
+	defer deleteDB(db)
+
+	val := []byte(strings.Repeat("x", 1024))
+	assert.Nil(t, db.Put([]byte("key"), []byte("old")))
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Put([]byte(strconv.Itoa(i)), val))
+	}
+	assert.Nil(t, db.PutWithTTL([]byte("key"), []byte("new"), time.Millisecond))
+	expiredSegId := db.wal.SegmentIds()[len(db.wal.SegmentIds())-1]
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Put([]byte(strconv.Itoa(i)), val))
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	// the expired record hides the old one, which is in a segment not merged
+	assert.Nil(t, db.MergeSegments([]uint32{expiredSegId}))
+	_, err = db.Get([]byte("key"))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	assert.Nil(t, db.Close())
+	db, err = openDB(options)
+	assert.Nil(t, err)
+	defer deleteDB(db)
+	_, err = db.Get([]byte("key"))
+	assert.Equal(t, ErrKeyNotFound, err)
+}
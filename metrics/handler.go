@@ -0,0 +1,140 @@
+// Package metrics renders the statistics of a DB in the Prometheus text exposition format.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	kvDB "kv-db"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const contentType = "text/plain; version=0.0.4; charset=utf-8"
+
+const namespace = "kvdb"
+
+// Handler serves the statistics of a DB, the DB is read when it is scraped.
+type Handler struct {
+	db *kvDB.DB
+}
+
+// NewHandler returns the handler of db, the names of the metrics start with "kvdb_".
+func NewHandler(db *kvDB.DB) *Handler {
+	return &Handler{db: db}
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	stats, err := h.db.Stats()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	tw := &textWriter{w: bufio.NewWriter(w)}
+	h.write(tw, stats)
+	_ = tw.w.Flush()
+}
+
+func (h *Handler) write(w *textWriter, stats *kvDB.Stats) {
+	w.family("keys", "gauge", "Number of keys in the index.")
+	w.sample("keys", "", float64(stats.Keys))
+	w.family("segments", "gauge", "Number of segments.")
+	w.sample("segments", "", float64(stats.Segments))
+	w.family("segments_bytes", "gauge", "Bytes of the records in all segments.")
+	w.sample("segments_bytes", "", float64(stats.SegmentsSize))
+	w.family("active_segment_id", "gauge", "Id of the active segment.")
+	w.sample("active_segment_id", "", float64(stats.ActiveSegmentId))
+	w.family("garbage_bytes", "gauge", "Estimated bytes of the stale records which can be reclaimed by merge.")
+	w.sample("garbage_bytes", "", float64(stats.GarbageBytes))
+	w.family("hint_files_bytes", "gauge", "Bytes of the hint files.")
+	w.sample("hint_files_bytes", "", float64(stats.HintFilesSize))
+
+	// the merge metrics are not written before the first merge finishes
+	if !stats.LastMerge.Time.IsZero() {
+		success := 1.0
+		if stats.LastMerge.Err != nil {
+			success = 0
+		}
+		w.family("last_merge_timestamp_seconds", "gauge", "Unix time when the last merge finished.")
+		w.sample("last_merge_timestamp_seconds", "", float64(stats.LastMerge.Time.UnixNano())/float64(time.Second))
+		w.family("last_merge_duration_seconds", "gauge", "Duration of the last merge.")
+		w.sample("last_merge_duration_seconds", "", stats.LastMerge.Duration.Seconds())
+		w.family("last_merge_success", "gauge", "1 if the last merge succeeded, 0 if it failed.")
+		w.sample("last_merge_success", "", success)
+	}
+
+	w.family("operations_total", "counter", "Number of operations.")
+	w.sample("operations_total", label("op", "put"), float64(stats.Puts))
+	w.sample("operations_total", label("op", "get"), float64(stats.Gets))
+	w.sample("operations_total", label("op", "delete"), float64(stats.Deletes))
+	w.family("misses_total", "counter", "Number of gets of the keys which are not found.")
+	w.sample("misses_total", "", float64(stats.Misses))
+	w.family("expirations_total", "counter", "Number of expired keys removed from the index by reads and merges.")
+	w.sample("expirations_total", "", float64(stats.Expirations))
+	w.family("written_bytes_total", "counter", "Bytes of the records written by put and delete.")
+	w.sample("written_bytes_total", "", float64(stats.BytesWritten))
+	w.family("read_bytes_total", "counter", "Bytes of the records read by get and scan.")
+	w.sample("read_bytes_total", "", float64(stats.BytesRead))
+
+	cache := h.db.BlockCacheStats()
+	w.family("block_cache_hits_total", "counter", "Number of reads of the blocks found in the block cache.")
+	w.sample("block_cache_hits_total", "", float64(cache.Hits))
+	w.family("block_cache_misses_total", "counter", "Number of reads of the blocks not found in the block cache.")
+	w.sample("block_cache_misses_total", "", float64(cache.Misses))
+	w.family("block_cache_bytes", "gauge", "Bytes of the blocks in the block cache.")
+	w.sample("block_cache_bytes", "", float64(cache.Bytes))
+
+	w.family("operation_duration_seconds", "histogram", "Latency of the operations.")
+	w.histogram("operation_duration_seconds", label("op", "put"), stats.PutLatency)
+	w.histogram("operation_duration_seconds", label("op", "get"), stats.GetLatency)
+	w.histogram("operation_duration_seconds", label("op", "delete"), stats.DeleteLatency)
+	w.family("merge_duration_seconds", "histogram", "Duration of the merges.")
+	w.histogram("merge_duration_seconds", "", stats.MergeLatency)
+	w.family("fsync_duration_seconds", "histogram", "Latency of the fsyncs of the segments.")
+	w.histogram("fsync_duration_seconds", "", stats.SyncLatency)
+}
+
+// textWriter writes the metrics in the text format, the errors of the writes are ignored
+// since the response can not be changed once it is written.
+type textWriter struct {
+	w *bufio.Writer
+}
+
+func (w *textWriter) family(name string, typ string, help string) {
+	fmt.Fprintf(w.w, "# HELP %s_%s %s\n", namespace, name, help)
+	fmt.Fprintf(w.w, "# TYPE %s_%s %s\n", namespace, name, typ)
+}
+
+// sample writes a sample, labels are the formatted labels without braces.
+func (w *textWriter) sample(name string, labels string, value float64) {
+	if len(labels) > 0 {
+		labels = "{" + labels + "}"
+	}
+	fmt.Fprintf(w.w, "%s_%s%s %s\n", namespace, name, labels, formatFloat(value))
+}
+
+func (w *textWriter) histogram(name string, labels string, h kvDB.LatencyHistogram) {
+	sep := ""
+	if len(labels) > 0 {
+		sep = ","
+	}
+
+	var cumulative uint64
+	for i, bound := range h.Bounds {
+		cumulative += h.Counts[i]
+		w.sample(name+"_bucket", labels+sep+label("le", formatFloat(bound.Seconds())), float64(cumulative))
+	}
+	w.sample(name+"_bucket", labels+sep+label("le", "+Inf"), float64(h.Count))
+	w.sample(name+"_sum", labels, h.Sum.Seconds())
+	w.sample(name+"_count", labels, float64(h.Count))
+}
+
+func label(name string, value string) string {
+	return name + "=" + strconv.Quote(value)
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,75 @@
+package metrics
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	kvDB "kv-db"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHandler(t *testing.T) {
+	options := kvDB.DefaultOptions
+	options.Dir = t.TempDir()
+	db, err := kvDB.Open(options)
+	assert.Nil(t, err)
+	defer func() {
+		_ = db.Close()
+	}()
+
+	assert.Nil(t, db.Put([]byte("a"), []byte("1")))
+	assert.Nil(t, db.Put([]byte("a"), []byte("2")))
+	_, err = db.Get([]byte("a"))
+	assert.Nil(t, err)
+	_, err = db.Get([]byte("b"))
+	assert.Equal(t, kvDB.ErrKeyNotFound, err)
+	assert.Nil(t, db.Merge())
+
+	rec := httptest.NewRecorder()
+	NewHandler(db).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, contentType, rec.Header().Get("Content-Type"))
+
+	body, err := ioutil.ReadAll(rec.Body)
+	assert.Nil(t, err)
+	lines := strings.Split(string(body), "\n")
+	for _, line := range []string{
+		"# TYPE kvdb_keys gauge",
+		"kvdb_keys 1",
+		"# TYPE kvdb_segments gauge",
+		"# TYPE kvdb_segments_bytes gauge",
+		`kvdb_operations_total{op="put"} 2`,
+		`kvdb_operations_total{op="get"} 2`,
+		"kvdb_misses_total 1",
+		"kvdb_last_merge_success 1",
+		"# TYPE kvdb_operation_duration_seconds histogram",
+		`kvdb_operation_duration_seconds_bucket{op="put",le="+Inf"} 2`,
+		`kvdb_operation_duration_seconds_count{op="get"} 2`,
+		`kvdb_merge_duration_seconds_bucket{le="+Inf"} 1`,
+		"kvdb_merge_duration_seconds_count 1",
+	} {
+		assert.Contains(t, lines, line)
+	}
+	// no series per segment, the number of segments is not bounded
+	assert.NotContains(t, string(body), "kvdb_segment_bytes")
+
+	// the samples of the same family are written together after its TYPE line
+	seen := make(map[string]bool)
+	var family string
+	for _, line := range lines {
+		if strings.HasPrefix(line, "# TYPE ") {
+			family = strings.Fields(line)[2]
+			assert.False(t, seen[family], family)
+			seen[family] = true
+		} else if len(line) > 0 && !strings.HasPrefix(line, "#") {
+			assert.True(t, strings.HasPrefix(line, family), line)
+		}
+	}
+
+	assert.Nil(t, db.Close())
+	rec = httptest.NewRecorder()
+	NewHandler(db).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+}
@@ -3,21 +3,98 @@ package kv_db
 import (
 	"kv-db/wal"
 	"os"
+	"time"
 )
 
 const (
 	HintSuffix     = ".hint"
 	MergeFinSuffix = ".fin"
+	LockFileName   = "LOCK"
+	// ReadLockFileName is locked shared by the read-only DBs, so the offline tools can tell whether the directory is read.
+	ReadLockFileName = "READLOCK"
 )
 
 type Options struct {
 	Dir           string
 	SegmentSize   int64
 	AutoMergeExpr string
+
+	// BlockCacheSize is the max bytes of sealed segment blocks cached in memory, 0 disables the cache.
+	BlockCacheSize int64
+
+	// ValueCacheSize is the max bytes of keys and values of hot keys cached by Get, 0 disables the cache.
+	ValueCacheSize int64
+
+	// MaxOpenSegments limits the open file descriptors of sealed segments, 0 means no limit.
+	MaxOpenSegments int
+
+	// Checksum is the checksum algorithm of new segments, existing segments keep their own one.
+	Checksum wal.ChecksumType
+
+	// RecordHash saves an extra 64-bit hash for records written across multiple blocks.
+	RecordHash bool
+
+	// BlockSize is the block size of new segments, from wal.MinBlockSize to wal.MaxBlockSize.
+	BlockSize uint32
+
+	// MergeGarbageRatio triggers a merge when the dead bytes reach this ratio of all bytes, 0 disables it.
+	MergeGarbageRatio float64
+
+	// MergeReclaimableBytes triggers a merge when the dead bytes reach it, 0 disables it.
+	MergeReclaimableBytes int64
+
+	// MergeMinReclaimableBytes is the least dead bytes for the thresholds above to trigger a merge,
+	// so a small DB with a high garbage ratio is not merged again and again.
+	MergeMinReclaimableBytes int64
+
+	// MergeMinInterval is the least time between the end of a merge and an auto merge triggered by the thresholds above.
+	MergeMinInterval time.Duration
+
+	// MergeSegmentsLimit makes the auto merges only rewrite at most this many sealed segments
+	// with the highest garbage ratio, 0 means all sealed segments are merged.
+	MergeSegmentsLimit int
+
+	// MergeReadRateLimit and MergeWriteRateLimit are the max bytes per second read and written by merge
+	// and the other background jobs, 0 means no limit. They can be changed by DB.SetMergeRateLimit.
+	MergeReadRateLimit  int64
+	MergeWriteRateLimit int64
+
+	// MergeWorkers is the number of goroutines merging the segments in parallel. If it is more than 1,
+	// every old segment is merged to a segment of its own, so the small segments are not combined.
+	MergeWorkers int
+
+	// ReadOnly opens the DB without writing anything to the directory, so it can be opened by many processes
+	// together with the writer. Put, Delete and merge return ErrReadOnly, and the records written by the writer
+	// after Open are visible after DB.Refresh.
+	ReadOnly bool
+
+	// Logger logs the events and the errors of the background jobs, e.g. the failed auto merges, nil disables the logs.
+	Logger Logger
+
+	// EventListener is notified of the events of the DB, nil ignores the events.
+	EventListener *EventListener
+
+	// SlowOperationThreshold logs a Put, Get or Delete taking at least this long as a slow operation, 0 disables it.
+	SlowOperationThreshold time.Duration
 }
 
 var DefaultOptions = Options{
-	Dir:           os.TempDir(),
-	SegmentSize:   1 * wal.GB,
-	AutoMergeExpr: "",
+	Dir:             os.TempDir(),
+	SegmentSize:     1 * wal.GB,
+	AutoMergeExpr:   "",
+	BlockCacheSize:  0,
+	ValueCacheSize:  0,
+	MaxOpenSegments: 0,
+	Checksum:        wal.ChecksumCastagnoli,
+	RecordHash:      false,
+	BlockSize:       wal.DefaultBlockSize,
+
+	MergeGarbageRatio:        0,
+	MergeReclaimableBytes:    0,
+	MergeMinReclaimableBytes: 64 * wal.MB,
+	MergeMinInterval:         time.Minute,
+	MergeSegmentsLimit:       0,
+	MergeReadRateLimit:       0,
+	MergeWriteRateLimit:      0,
+	MergeWorkers:             1,
 }
@@ -2,8 +2,10 @@ package kv_db
 
 import (
 	"encoding/binary"
+	"errors"
 	"github.com/valyala/bytebufferpool"
 	"kv-db/wal"
+	"math"
 )
 
 type recordType = byte
@@ -47,6 +49,32 @@ func encodeLogRecord(r *logRecord, header []byte, buf *bytebufferpool.ByteBuffer
 	return buf.B
 }
 
+var errInvalidRecord = errors.New("invalid record, the data may be damaged")
+
+// checkLogRecord returns errInvalidRecord if data can not be decoded by decodeLogRecord.
+func checkLogRecord(data []byte) error {
+	if len(data) == 0 || (data[0] != recordModified && data[0] != recordDeleted) {
+		return errInvalidRecord
+	}
+
+	var sizes [3]int64
+	index := 1
+	for i := range sizes {
+		size, n := binary.Varint(data[index:])
+		if n <= 0 {
+			return errInvalidRecord
+		}
+		sizes[i] = size
+		index += n
+	}
+
+	keySize, valueSize := sizes[1], sizes[2]
+	if keySize < 0 || valueSize < 0 || int64(len(data)-index) != keySize+valueSize {
+		return errInvalidRecord
+	}
+	return nil
+}
+
 func decodeLogRecord(data []byte) *logRecord {
 	recordType := data[0]
 	var index = 1
@@ -90,6 +118,19 @@ func encodeHintRecord(key []byte, pos *wal.Chunk) []byte {
 	return ret
 }
 
+// checkHintRecord returns errInvalidRecord if data can not be decoded by decodeHintRecord.
+func checkHintRecord(data []byte) error {
+	idx := 0
+	for i := 0; i < 4; i++ {
+		v, n := binary.Uvarint(data[idx:])
+		if n <= 0 || v > math.MaxUint32 {
+			return errInvalidRecord
+		}
+		idx += n
+	}
+	return nil
+}
+
 func decodeHintRecord(data []byte) ([]byte, *wal.Chunk) {
 	var idx = 0
 	segId, n := binary.Uvarint(data)
@@ -59,3 +59,21 @@ func TestRecord_encodeHintRecord(t *testing.T) {
 	assert.Equal(t, key, k)
 	assert.Equal(t, pos, v)
 }
+
+func TestRecord_checkLogRecord(t *testing.T) {
+	buffer := bytebufferpool.Get()
+	buffer.Reset()
+	defer bytebufferpool.Put(buffer)
+
+	r := &logRecord{recordType: recordModified, expire: 100, key: []byte("key"), value: []byte("value")}
+	data := encodeLogRecord(r, make([]byte, 21), buffer)
+	assert.Nil(t, checkLogRecord(data))
+
+	assert.Equal(t, errInvalidRecord, checkLogRecord(nil))
+	assert.Equal(t, errInvalidRecord, checkLogRecord(data[:len(data)-1]))
+	assert.Equal(t, errInvalidRecord, checkLogRecord(append([]byte{9}, data[1:]...)))
+
+	hint := encodeHintRecord([]byte("key"), &wal.Chunk{SegmentId: 1, BlockIndex: 2, BlockOffset: 3, Size: 4})
+	assert.Nil(t, checkHintRecord(hint))
+	assert.Equal(t, errInvalidRecord, checkHintRecord(hint[:2]))
+}
@@ -0,0 +1,311 @@
+package kv_db
+
+import (
+	"encoding/json"
+	"fmt"
+	"kv-db/util"
+	"kv-db/wal"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+const (
+	// RepairLostDirName is the directory where Repair moves the damaged files, they are kept for manual recovery.
+	RepairLostDirName = "lost"
+	// RepairReportFileName is the report written by Repair.
+	RepairReportFileName = "REPAIR"
+
+	repairDirName = "repair"
+)
+
+// RepairLoss is a damaged part of a segment which is dropped by Repair. The keys of the records written between
+// the intact records of KeyBefore and KeyAfter in the segment are lost, they are nil at the ends of the segment.
+type RepairLoss struct {
+	SegmentId   uint32 `json:"segment_id"`
+	BlockIndex  uint32 `json:"block_index"`
+	BlockOffset uint32 `json:"block_offset"`
+	Err         string `json:"error"`
+	KeyBefore   []byte `json:"key_before"`
+	KeyAfter    []byte `json:"key_after"`
+}
+
+type RepairReport struct {
+	Segments int `json:"segments"`
+	Records  int `json:"records"`
+	// RewrittenSegments are rewritten with their intact records.
+	RewrittenSegments []uint32 `json:"rewritten_segments"`
+	// LostSegments can not be read at all, e.g. their headers are damaged.
+	LostSegments []uint32     `json:"lost_segments"`
+	Losses       []RepairLoss `json:"losses"`
+	// DiscardedMerge is true if an interrupted merge could not be installed and is discarded.
+	DiscardedMerge bool `json:"discarded_merge"`
+}
+
+// salvagedRecord is an intact record, the value is not kept.
+type salvagedRecord struct {
+	pos    *wal.Chunk
+	record *logRecord
+}
+
+// Repair makes a damaged DB directory usable by dropping whatever can not be read. The damaged segments are
+// rewritten with their intact records and the originals are moved to the RepairLostDirName directory,
+// the hint files are rebuilt, and the report is returned and written to RepairReportFileName in dir.
+// The DB must not be open by any process.
+func Repair(dir string) (*RepairReport, error) {
+	lock, err := util.LockFile(filepath.Join(dir, LockFileName))
+	if err != nil {
+		if err == util.ErrLocked {
+			return nil, ErrDatabaseLocked
+		}
+		return nil, err
+	}
+	defer func() {
+		_ = lock.Unlock()
+	}()
+	readLock, err := util.LockFile(filepath.Join(dir, ReadLockFileName))
+	if err != nil {
+		if err == util.ErrLocked {
+			return nil, ErrDatabaseLocked
+		}
+		return nil, err
+	}
+	defer func() {
+		_ = readLock.Unlock()
+	}()
+
+	report := &RepairReport{}
+	if err = repairMerge(dir, report); err != nil {
+		return nil, err
+	}
+	if err = removeTempFiles(dir); err != nil {
+		return nil, err
+	}
+
+	segmentIds, err := listFileIds(dir, wal.SegmentSuffix)
+	if err != nil {
+		return nil, err
+	}
+	repairDir := filepath.Join(dir, repairDirName)
+	if err = os.RemoveAll(repairDir); err != nil {
+		return nil, err
+	}
+
+	hints := make(map[uint32][]*hintEntry)
+	var keptIds []uint32
+	for _, id := range segmentIds {
+		entries, ok, err := repairSegment(dir, id, report)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			hints[id] = entries
+			keptIds = append(keptIds, id)
+		}
+	}
+	if err = os.RemoveAll(repairDir); err != nil {
+		return nil, err
+	}
+
+	// the hint files of all sealed segments are rebuilt, so the hint wal of the old versions is not needed
+	if err = removeFiles(dir, "*"+SegmentHintSuffix); err != nil {
+		return nil, err
+	}
+	if err = removeLegacyHintFiles(dir); err != nil {
+		return nil, err
+	}
+	for i, id := range keptIds {
+		if i == len(keptIds)-1 {
+			break
+		}
+		if err = writeHintFile(dir, id, hints[id]); err != nil {
+			return nil, err
+		}
+	}
+
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err = util.WriteFileAtomic(filepath.Join(dir, RepairReportFileName), data); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// repairMerge installs the merge committed before a crash, or discards it if it can not be installed.
+func repairMerge(dir string, report *RepairReport) error {
+	db := &DB{options: Options{Dir: dir}}
+	mergeDir := filepath.Join(dir, mergeDirName)
+	if err := db.installMerge(mergeDir); err != nil {
+		report.DiscardedMerge = true
+		if err = os.RemoveAll(mergeDir); err != nil {
+			return err
+		}
+	}
+	return db.removeMergeLeftovers()
+}
+
+// removeTempFiles removes the files left by WriteFileAtomic.
+func removeTempFiles(dir string) error {
+	return removeFiles(dir, "*.tmp")
+}
+
+func removeFiles(dir string, pattern string) error {
+	paths, err := filepath.Glob(filepath.Join(dir, pattern))
+	if err != nil {
+		return err
+	}
+
+	for _, path := range paths {
+		if err = os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// repairSegment reads the segment and rewrites it if it is damaged, it returns the hint entries of the records
+// in the segment, and false if the segment is lost.
+func repairSegment(dir string, id uint32, report *RepairReport) ([]*hintEntry, bool, error) {
+	report.Segments++
+
+	var records []*salvagedRecord
+	var losses []RepairLoss
+	errs, err := wal.VerifySegment(dir, wal.SegmentSuffix, id, func(data []byte, pos *wal.Chunk) {
+		if err := checkLogRecord(data); err != nil {
+			losses = append(losses, RepairLoss{SegmentId: id, BlockIndex: pos.BlockIndex, BlockOffset: pos.BlockOffset, Err: err.Error()})
+			return
+		}
+		record := decodeLogRecord(data)
+		record.value = nil
+		records = append(records, &salvagedRecord{pos: pos, record: record})
+	})
+	if err != nil {
+		report.LostSegments = append(report.LostSegments, id)
+		report.Losses = append(report.Losses, RepairLoss{SegmentId: id, Err: err.Error()})
+		return nil, false, moveToLost(dir, id)
+	}
+	report.Records += len(records)
+
+	for _, e := range errs {
+		losses = append(losses, RepairLoss{SegmentId: id, BlockIndex: e.BlockIndex, BlockOffset: e.BlockOffset, Err: e.Err.Error()})
+	}
+	if len(losses) == 0 {
+		entries := make([]*hintEntry, 0, len(records))
+		for _, r := range records {
+			entries = append(entries, &hintEntry{recordType: r.record.recordType, expire: r.record.expire, key: r.record.key, pos: r.pos})
+		}
+		return entries, true, nil
+	}
+
+	for i := range losses {
+		setLossKeys(&losses[i], records)
+	}
+	sort.Slice(losses, func(i, j int) bool {
+		if losses[i].BlockIndex != losses[j].BlockIndex {
+			return losses[i].BlockIndex < losses[j].BlockIndex
+		}
+		return losses[i].BlockOffset < losses[j].BlockOffset
+	})
+	report.Losses = append(report.Losses, losses...)
+	report.RewrittenSegments = append(report.RewrittenSegments, id)
+
+	// the records are never larger than in the damaged segment, except the padding at the ends of the blocks
+	var size int64
+	for _, r := range records {
+		size += int64(r.pos.Size)
+	}
+	entries, err := rewriteSegment(dir, id, 2*size+wal.MaxBlockSize)
+	if err != nil {
+		return nil, false, err
+	}
+	return entries, true, nil
+}
+
+// setLossKeys sets the keys of the intact records around the loss, records are in the order of their positions.
+func setLossKeys(loss *RepairLoss, records []*salvagedRecord) {
+	idx := sort.Search(len(records), func(i int) bool {
+		pos := records[i].pos
+		return pos.BlockIndex > loss.BlockIndex || (pos.BlockIndex == loss.BlockIndex && pos.BlockOffset > loss.BlockOffset)
+	})
+	if idx > 0 {
+		loss.KeyBefore = records[idx-1].record.key
+	}
+	if idx < len(records) {
+		loss.KeyAfter = records[idx].record.key
+	}
+}
+
+// rewriteSegment reads the segment again and writes the intact records to a new segment with the same id,
+// which replaces the damaged one. The new segment keeps the checksum, block size and record hash of the damaged one.
+// The damaged segment is kept if the intact records can not be written.
+func rewriteSegment(dir string, id uint32, segmentSize int64) ([]*hintEntry, error) {
+	info, err := wal.ReadSegmentInfo(dir, wal.SegmentSuffix, id)
+	if err != nil {
+		return nil, err
+	}
+
+	segmentDir := filepath.Join(dir, repairDirName, fmt.Sprint(id))
+	w, err := wal.Open(wal.Options{
+		Dir:               segmentDir,
+		SegmentSize:       segmentSize,
+		SegmentFileSuffix: wal.SegmentSuffix,
+		Checksum:          info.Checksum,
+		RecordHash:        info.RecordHash,
+		BlockSize:         info.BlockSize,
+		FirstSegmentId:    id,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = w.Close()
+	}()
+
+	var entries []*hintEntry
+	var writeErr error
+	_, err = wal.VerifySegment(dir, wal.SegmentSuffix, id, func(data []byte, _ *wal.Chunk) {
+		if writeErr != nil || checkLogRecord(data) != nil {
+			return
+		}
+
+		pos, err := w.Write(data)
+		if err != nil {
+			writeErr = err
+			return
+		}
+		if pos.SegmentId != id {
+			writeErr = fmt.Errorf("repaired segment %d is larger than the segment size", id)
+			return
+		}
+		record := decodeLogRecord(data)
+		entries = append(entries, &hintEntry{recordType: record.recordType, expire: record.expire, key: record.key, pos: pos})
+	})
+	if err != nil {
+		return nil, err
+	}
+	if writeErr != nil {
+		return nil, writeErr
+	}
+	if err = w.Sync(); err != nil {
+		return nil, err
+	}
+
+	if err = moveToLost(dir, id); err != nil {
+		return nil, err
+	}
+	if err = os.Rename(wal.JoinSegmentPath(segmentDir, wal.SegmentSuffix, id), wal.JoinSegmentPath(dir, wal.SegmentSuffix, id)); err != nil {
+		return nil, err
+	}
+	return entries, util.SyncDir(dir)
+}
+
+// moveToLost moves the damaged segment to the lost directory.
+func moveToLost(dir string, id uint32) error {
+	lostDir := filepath.Join(dir, RepairLostDirName)
+	if err := os.MkdirAll(lostDir, os.ModePerm); err != nil {
+		return err
+	}
+	return os.Rename(wal.JoinSegmentPath(dir, wal.SegmentSuffix, id), wal.JoinSegmentPath(lostDir, wal.SegmentSuffix, id))
+}
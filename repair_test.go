@@ -0,0 +1,161 @@
+package kv_db
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"kv-db/wal"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestRepair(t *testing.T) {
+	options := DefaultOptions
+	options.Dir = t.TempDir()
+	options.SegmentSize = 64 * wal.KB
+	db, err := openDB(options)
+	assert.Nil(t, err)
+	for i := 0; i < 20000; i++ {
+		assert.Nil(t, db.Put([]byte(strconv.Itoa(i)), []byte("value"+strconv.Itoa(i))))
+	}
+	assert.Nil(t, db.Close())
+	assert.True(t, len(db.wal.SegmentIds()) > 3)
+
+	// a damaged chunk in segment 2, a damaged header of segment 3 and a stray merge directory
+	var entries []*hintEntry
+	_, err = wal.VerifySegment(options.Dir, wal.SegmentSuffix, 2, func(data []byte, pos *wal.Chunk) {
+		entries = append(entries, &hintEntry{key: decodeLogRecord(data).key, pos: pos})
+	})
+	assert.Nil(t, err)
+	damaged := entries[len(entries)/2]
+	f, err := os.OpenFile(wal.JoinSegmentPath(options.Dir, wal.SegmentSuffix, 2), os.O_RDWR, 0644)
+	assert.Nil(t, err)
+	_, err = f.WriteAt([]byte{0xff}, 32+int64(damaged.pos.BlockIndex)*int64(options.BlockSize)+int64(damaged.pos.BlockOffset)+10)
+	assert.Nil(t, err)
+	assert.Nil(t, f.Close())
+	seg3Path := wal.JoinSegmentPath(options.Dir, wal.SegmentSuffix, 3)
+	seg3, err := ioutil.ReadFile(seg3Path)
+	assert.Nil(t, err)
+	seg3[10] ^= 0xff
+	assert.Nil(t, ioutil.WriteFile(seg3Path, seg3, 0644))
+	assert.Nil(t, os.MkdirAll(filepath.Join(options.Dir, mergeDirName, "1"), os.ModePerm))
+
+	report, err := Repair(options.Dir)
+	assert.Nil(t, err)
+	assert.Equal(t, []uint32{2}, report.RewrittenSegments)
+	assert.Equal(t, []uint32{3}, report.LostSegments)
+	assert.Equal(t, 2, len(report.Losses))
+	assert.Equal(t, damaged.pos.BlockOffset, report.Losses[0].BlockOffset)
+	assert.Equal(t, entries[len(entries)/2-1].key, report.Losses[0].KeyBefore)
+	// the rest of the block after the damaged chunk is lost
+	for _, e := range entries {
+		if e.pos.BlockIndex > damaged.pos.BlockIndex {
+			assert.Equal(t, e.key, report.Losses[0].KeyAfter)
+			break
+		}
+	}
+
+	for _, name := range []string{RepairReportFileName, filepath.Join(RepairLostDirName, "000000002.seg"), filepath.Join(RepairLostDirName, "000000003.seg")} {
+		_, err = os.Stat(filepath.Join(options.Dir, name))
+		assert.Nil(t, err)
+	}
+	for _, name := range []string{mergeDirName, repairDirName, "000000003.hnt"} {
+		_, err = os.Stat(filepath.Join(options.Dir, name))
+		assert.True(t, os.IsNotExist(err))
+	}
+
+	verifyReport, err := Verify(options.Dir, VerifyOptions{})
+	assert.Nil(t, err)
+	assert.True(t, verifyReport.OK(), verifyReport.Issues)
+
+	// the damaged block and segment 3 are lost
+	lost := map[string]bool{string(damaged.key): true}
+	lostSeg3, err := ioutil.ReadFile(filepath.Join(options.Dir, RepairLostDirName, "000000003.seg"))
+	assert.Nil(t, err)
+	assert.Equal(t, seg3, lostSeg3)
+	db, err = openDB(options)
+	assert.Nil(t, err)
+	defer deleteDB(db)
+	var missing int
+	for i := 0; i < 20000; i++ {
+		value, err := db.Get([]byte(strconv.Itoa(i)))
+		if err == ErrKeyNotFound {
+			missing++
+			continue
+		}
+		assert.Nil(t, err)
+		assert.False(t, lost[strconv.Itoa(i)])
+		assert.Equal(t, []byte("value"+strconv.Itoa(i)), value)
+	}
+	assert.True(t, missing > 1 && missing < 20000/3)
+}
+
+func TestRepair_RewriteSegmentFailed(t *testing.T) {
+	options := DefaultOptions
+	options.Dir = t.TempDir()
+	db, err := openDB(options)
+	assert.Nil(t, err)
+	for i := 0; i < 5000; i++ {
+		assert.Nil(t, db.Put([]byte(strconv.Itoa(i)), []byte("value"+strconv.Itoa(i))))
+	}
+	assert.Nil(t, db.Close())
+
+	// the records do not fit in the rewritten segment, so the damaged segment is kept in place
+	path := wal.JoinSegmentPath(options.Dir, wal.SegmentSuffix, 1)
+	before, err := ioutil.ReadFile(path)
+	assert.Nil(t, err)
+	_, err = rewriteSegment(options.Dir, 1, 4*wal.KB)
+	assert.NotNil(t, err)
+	after, err := ioutil.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, before, after)
+	_, err = os.Stat(wal.JoinSegmentPath(filepath.Join(options.Dir, RepairLostDirName), wal.SegmentSuffix, 1))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestRepair_SegmentOptions(t *testing.T) {
+	options := DefaultOptions
+	options.Dir = t.TempDir()
+	options.SegmentSize = 256 * wal.KB
+	options.BlockSize = 8 * wal.KB
+	options.Checksum = wal.ChecksumIEEE
+	options.RecordHash = true
+	db, err := openDB(options)
+	assert.Nil(t, err)
+	for i := 0; i < 5000; i++ {
+		assert.Nil(t, db.Put([]byte(strconv.Itoa(i)), []byte("value"+strconv.Itoa(i))))
+	}
+	// a record across multiple blocks
+	large := make([]byte, 3*options.BlockSize)
+	assert.Nil(t, db.Put([]byte("large"), large))
+	assert.Nil(t, db.Close())
+
+	// damage a chunk in the second block of segment 1
+	f, err := os.OpenFile(wal.JoinSegmentPath(options.Dir, wal.SegmentSuffix, 1), os.O_RDWR, 0644)
+	assert.Nil(t, err)
+	_, err = f.WriteAt([]byte{0xff}, 32+int64(options.BlockSize)+100)
+	assert.Nil(t, err)
+	assert.Nil(t, f.Close())
+
+	report, err := Repair(options.Dir)
+	assert.Nil(t, err)
+	assert.Equal(t, []uint32{1}, report.RewrittenSegments)
+
+	info, errs, err := wal.ScanChunks(options.Dir, wal.SegmentSuffix, 1, func(*wal.ChunkInfo) {})
+	assert.Nil(t, err)
+	assert.Empty(t, errs)
+	assert.Equal(t, options.BlockSize, info.BlockSize)
+	assert.Equal(t, wal.ChecksumIEEE, info.Checksum)
+	assert.True(t, info.RecordHash)
+
+	db, err = openDB(options)
+	assert.Nil(t, err)
+	defer deleteDB(db)
+	value, err := db.Get([]byte("large"))
+	assert.Nil(t, err)
+	assert.Equal(t, large, value)
+	value, err = db.Get([]byte("0"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("value0"), value)
+}
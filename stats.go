@@ -0,0 +1,169 @@
+package kv_db
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Stats is a snapshot of the state and the counters of a DB, the counters are counted since the DB is opened.
+type Stats struct {
+	// Keys is the number of keys in the index, the expired keys are counted until they are removed by
+	// Get, Scan, Export or merge.
+	Keys int
+
+	Segments int
+	// SegmentSizes are the bytes of the records in each segment, SegmentsSize is the sum of them.
+	SegmentSizes    map[uint32]int64
+	SegmentsSize    int64
+	ActiveSegmentId uint32
+
+	// GarbageBytes is the estimated bytes of the stale records which can be reclaimed by merge.
+	GarbageBytes int64
+
+	// HintFilesSize is the bytes of the hint files of the sealed segments and of the hint wal.
+	HintFilesSize int64
+
+	LastMerge MergeStats
+
+	Puts    uint64
+	Gets    uint64
+	Deletes uint64
+	// Misses are the Gets of the keys which are not found.
+	Misses uint64
+	// Expirations are the expired keys removed from the index, by Get, Scan and Export when they are read,
+	// and by merge.
+	Expirations uint64
+
+	// BytesWritten are the bytes of the records written by Put and Delete, BytesRead are the bytes of the records
+	// read by Get, Scan and Export. The reads and writes of merge are not counted.
+	BytesWritten uint64
+	BytesRead    uint64
+
+	// The latencies of Put, Get, Delete, the merges and the fsyncs of the segments.
+	PutLatency    LatencyHistogram
+	GetLatency    LatencyHistogram
+	DeleteLatency LatencyHistogram
+	MergeLatency  LatencyHistogram
+	SyncLatency   LatencyHistogram
+}
+
+// MergeStats describes the last merge, Time is zero if no merge has finished since the DB is opened.
+type MergeStats struct {
+	Time     time.Time
+	Duration time.Duration
+	// Err is the error of the merge, nil if it succeeded.
+	Err error
+}
+
+// opStats are the counters updated by the operations, it is allocated alone so the counters are 64-bit aligned.
+type opStats struct {
+	puts         uint64
+	gets         uint64
+	deletes      uint64
+	misses       uint64
+	expirations  uint64
+	bytesWritten uint64
+	bytesRead    uint64
+
+	putLatency    latencyHistogram
+	getLatency    latencyHistogram
+	deleteLatency latencyHistogram
+	mergeLatency  latencyHistogram
+	syncLatency   latencyHistogram
+
+	mergeMu   sync.Mutex
+	lastMerge MergeStats
+}
+
+// mergeFinished records the merge started at start.
+func (s *opStats) mergeFinished(start time.Time, err error) {
+	d := time.Since(start)
+	s.mergeLatency.observe(d)
+
+	s.mergeMu.Lock()
+	defer s.mergeMu.Unlock()
+	s.lastMerge = MergeStats{Time: time.Now(), Duration: d, Err: err}
+}
+
+// expired counts a key found expired by Get, which is a miss too.
+func (db *DB) expired() {
+	db.expiredRemoved(1)
+	atomic.AddUint64(&db.stats.misses, 1)
+}
+
+// expiredRemoved counts the expired keys removed from the index by Get, Scan, Export or merge.
+func (db *DB) expiredRemoved(keys int) {
+	atomic.AddUint64(&db.stats.expirations, uint64(keys))
+}
+
+// Stats returns the statistics of the DB.
+func (db *DB) Stats() (*Stats, error) {
+	if db.closed {
+		return nil, ErrDBClosed
+	}
+
+	db.mu.RLock()
+	stats := &Stats{
+		Keys:         db.indexer.Size(),
+		SegmentSizes: db.wal.SegmentSizes(),
+	}
+	_, stats.GarbageBytes = db.garbage.total()
+	db.mu.RUnlock()
+
+	stats.Segments = len(stats.SegmentSizes)
+	for id, size := range stats.SegmentSizes {
+		stats.SegmentsSize += size
+		if id > stats.ActiveSegmentId {
+			stats.ActiveSegmentId = id
+		}
+	}
+
+	var err error
+	if stats.HintFilesSize, err = hintFilesSize(db.options.Dir); err != nil {
+		return nil, err
+	}
+
+	stats.Puts = atomic.LoadUint64(&db.stats.puts)
+	stats.Gets = atomic.LoadUint64(&db.stats.gets)
+	stats.Deletes = atomic.LoadUint64(&db.stats.deletes)
+	stats.Misses = atomic.LoadUint64(&db.stats.misses)
+	stats.Expirations = atomic.LoadUint64(&db.stats.expirations)
+	stats.BytesWritten = atomic.LoadUint64(&db.stats.bytesWritten)
+	stats.BytesRead = atomic.LoadUint64(&db.stats.bytesRead)
+	stats.PutLatency = db.stats.putLatency.snapshot()
+	stats.GetLatency = db.stats.getLatency.snapshot()
+	stats.DeleteLatency = db.stats.deleteLatency.snapshot()
+	stats.MergeLatency = db.stats.mergeLatency.snapshot()
+	stats.SyncLatency = db.stats.syncLatency.snapshot()
+
+	db.stats.mergeMu.Lock()
+	stats.LastMerge = db.stats.lastMerge
+	db.stats.mergeMu.Unlock()
+	return stats, nil
+}
+
+func hintFilesSize(dir string) (int64, error) {
+	var size int64
+	for _, pattern := range []string{"*" + SegmentHintSuffix, "*" + HintSuffix} {
+		paths, err := filepath.Glob(filepath.Join(dir, pattern))
+		if err != nil {
+			return 0, err
+		}
+
+		for _, path := range paths {
+			info, err := os.Stat(path)
+			if err != nil {
+				// the hint files may be replaced by merge
+				if os.IsNotExist(err) {
+					continue
+				}
+				return 0, err
+			}
+			size += info.Size()
+		}
+	}
+	return size, nil
+}
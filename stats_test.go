@@ -0,0 +1,109 @@
+package kv_db
+
+import (
+	"github.com/stretchr/testify/assert"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestDB_Stats(t *testing.T) {
+	options := DefaultOptions
+	options.Dir = t.TempDir()
+	options.SegmentSize = 64 * 1024
+	db, err := openDB(options)
+	assert.Nil(t, err)
+	defer deleteDB(db)
+
+	value := make([]byte, 1000)
+	for i := 0; i < 200; i++ {
+		assert.Nil(t, db.Put([]byte("key"+strconv.Itoa(i)), value))
+	}
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Delete([]byte("key"+strconv.Itoa(i))))
+	}
+	assert.Nil(t, db.PutWithTTL([]byte("expire"), value, time.Millisecond))
+	time.Sleep(2 * time.Millisecond)
+
+	_, err = db.Get([]byte("key150"))
+	assert.Nil(t, err)
+	_, err = db.Get([]byte("key1"))
+	assert.Equal(t, ErrKeyNotFound, err)
+	_, err = db.Get([]byte("expire"))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	stats, err := db.Stats()
+	assert.Nil(t, err)
+	assert.Equal(t, 100, stats.Keys)
+	assert.True(t, stats.Segments > 1)
+	assert.Equal(t, stats.Segments, len(stats.SegmentSizes))
+	var size int64
+	for _, s := range stats.SegmentSizes {
+		size += s
+	}
+	assert.Equal(t, size, stats.SegmentsSize)
+	ids := db.wal.SegmentIds()
+	assert.Equal(t, ids[len(ids)-1], stats.ActiveSegmentId)
+	assert.True(t, stats.GarbageBytes > 100*1000)
+	assert.Equal(t, uint64(201), stats.Puts)
+	assert.Equal(t, uint64(100), stats.Deletes)
+	assert.Equal(t, uint64(3), stats.Gets)
+	assert.Equal(t, uint64(2), stats.Misses)
+	assert.Equal(t, uint64(1), stats.Expirations)
+	assert.True(t, stats.BytesWritten > 201*1000)
+	assert.True(t, stats.BytesRead > 1000)
+	assert.True(t, stats.LastMerge.Time.IsZero())
+	assert.Equal(t, uint64(201), stats.PutLatency.Count)
+	assert.Equal(t, uint64(3), stats.GetLatency.Count)
+	assert.Equal(t, uint64(100), stats.DeleteLatency.Count)
+	// the sealed segments are synced when the active segment is switched
+	assert.True(t, stats.SyncLatency.Count > 0)
+
+	assert.Nil(t, db.Merge())
+	stats, err = db.Stats()
+	assert.Nil(t, err)
+	assert.False(t, stats.LastMerge.Time.IsZero())
+	assert.Nil(t, stats.LastMerge.Err)
+	assert.Equal(t, uint64(1), stats.MergeLatency.Count)
+	assert.Equal(t, int64(0), stats.GarbageBytes)
+	assert.True(t, stats.HintFilesSize > 0)
+
+	assert.Nil(t, db.Close())
+	_, err = db.Stats()
+	assert.Equal(t, ErrDBClosed, err)
+}
+
+func TestDB_StatsExpirations(t *testing.T) {
+	options := DefaultOptions
+	options.Dir = t.TempDir()
+	db, err := openDB(options)
+	assert.Nil(t, err)
+	defer deleteDB(db)
+
+	assert.Nil(t, db.Put([]byte("a"), []byte("1")))
+	assert.Nil(t, db.PutWithTTL([]byte("b"), []byte("2"), time.Millisecond))
+	assert.Nil(t, db.PutWithTTL([]byte("c"), []byte("3"), time.Millisecond))
+	time.Sleep(2 * time.Millisecond)
+
+	// the expired keys skipped by Scan are removed
+	var keys []string
+	assert.Nil(t, db.Scan(nil, func(key []byte, value []byte) bool {
+		keys = append(keys, string(key))
+		return true
+	}))
+	assert.Equal(t, []string{"a"}, keys)
+	stats, err := db.Stats()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, stats.Keys)
+	assert.Equal(t, uint64(2), stats.Expirations)
+	assert.Equal(t, uint64(0), stats.Misses)
+
+	// and the ones removed by merge
+	assert.Nil(t, db.PutWithTTL([]byte("d"), []byte("4"), time.Millisecond))
+	time.Sleep(2 * time.Millisecond)
+	assert.Nil(t, db.Merge())
+	stats, err = db.Stats()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, stats.Keys)
+	assert.Equal(t, uint64(3), stats.Expirations)
+}
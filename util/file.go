@@ -1,7 +1,9 @@
 package util
 
 import (
+	"io"
 	"os"
+	"path/filepath"
 )
 
 func CopyFile(srcFile string, destFile string) error {
@@ -13,3 +15,79 @@ func CopyFile(srcFile string, destFile string) error {
 	}
 	return os.Rename(srcFile, destFile)
 }
+
+// WriteFileAtomic writes the file to a temporary file and renames it, so readers see either the old or the new content.
+func WriteFileAtomic(path string, data []byte) error {
+	tmpPath := path + ".tmp"
+	f, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	if _, err = f.Write(data); err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(tmpPath)
+		return err
+	}
+
+	if err = os.Rename(tmpPath, path); err != nil {
+		return err
+	}
+	return SyncDir(filepath.Dir(path))
+}
+
+// TouchFile creates the file if it does not exist.
+func TouchFile(path string) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDONLY, 0644)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// SyncDir makes the creation, removal and renaming of the files in the directory durable.
+func SyncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = d.Close()
+	}()
+	return d.Sync()
+}
+
+// LinkOrCopyFile hard links the file, or copies it if it can not be linked, e.g. across file systems.
+func LinkOrCopyFile(srcFile string, destFile string) error {
+	if err := os.Link(srcFile, destFile); err == nil {
+		return nil
+	}
+
+	src, err := os.Open(srcFile)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = src.Close()
+	}()
+
+	dest, err := os.OpenFile(destFile, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(dest, src); err == nil {
+		err = dest.Sync()
+	}
+	if closeErr := dest.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(destFile)
+	}
+	return err
+}
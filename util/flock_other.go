@@ -0,0 +1,11 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd && !dragonfly
+// +build !linux,!darwin,!freebsd,!netbsd,!openbsd,!dragonfly
+
+package util
+
+import "os"
+
+// flock is not supported, the file is not locked.
+func flock(file *os.File, exclusive bool) error {
+	return nil
+}
@@ -0,0 +1,54 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+// +build linux darwin freebsd netbsd openbsd dragonfly
+
+package util
+
+import (
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLockFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "LOCK")
+
+	lock, err := LockFile(path)
+	assert.Nil(t, err)
+
+	_, err = LockFile(path)
+	assert.Equal(t, ErrLocked, err)
+
+	assert.Nil(t, lock.Unlock())
+	lock, err = LockFile(path)
+	assert.Nil(t, err)
+	assert.Nil(t, lock.Unlock())
+}
+
+func TestLockFileShared(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "LOCK")
+
+	// a missing file is not created
+	lock, err := LockFileShared(path)
+	assert.Nil(t, err)
+	assert.Nil(t, lock.Unlock())
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+
+	assert.Nil(t, TouchFile(path))
+	lock, err = LockFileShared(path)
+	assert.Nil(t, err)
+	lock2, err := LockFileShared(path)
+	assert.Nil(t, err)
+
+	_, err = LockFile(path)
+	assert.Equal(t, ErrLocked, err)
+
+	assert.Nil(t, lock.Unlock())
+	assert.Nil(t, lock2.Unlock())
+	lock, err = LockFile(path)
+	assert.Nil(t, err)
+	_, err = LockFileShared(path)
+	assert.Equal(t, ErrLocked, err)
+	assert.Nil(t, lock.Unlock())
+}
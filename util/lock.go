@@ -0,0 +1,52 @@
+package util
+
+import (
+	"errors"
+	"os"
+)
+
+var ErrLocked = errors.New("file is locked by another process")
+
+// FileLock is an advisory lock on a file, held by flock until it is unlocked or the process exits.
+type FileLock struct {
+	file *os.File
+}
+
+// LockFile creates the file if it does not exist and locks it exclusively, it returns ErrLocked at once
+// if the file is locked by another process, or by another FileLock of this process.
+func LockFile(path string) (*FileLock, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return lockFile(file, true)
+}
+
+// LockFileShared locks the file shared, the lock can be held by many processes together. The file is opened read-only
+// and never created, so it works in a read-only directory, and nothing is locked if the file does not exist.
+func LockFileShared(path string) (*FileLock, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &FileLock{}, nil
+		}
+		return nil, err
+	}
+	return lockFile(file, false)
+}
+
+func lockFile(file *os.File, exclusive bool) (*FileLock, error) {
+	if err := flock(file, exclusive); err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	return &FileLock{file: file}, nil
+}
+
+// Unlock releases the lock, the file is not removed so another process waiting for it can not lock a deleted file.
+func (l *FileLock) Unlock() error {
+	if l.file == nil {
+		return nil
+	}
+	return l.file.Close()
+}
@@ -0,0 +1,95 @@
+package util
+
+import (
+	"sync"
+	"time"
+)
+
+// RateLimiter is a token bucket limiting the bytes per second of I/O, it allows a burst of one second.
+// A nil RateLimiter or a rate of 0 does not limit anything.
+type RateLimiter struct {
+	mu      sync.Mutex
+	rate    float64
+	tokens  float64
+	last    time.Time
+	changed chan struct{}
+}
+
+func NewRateLimiter(bytesPerSec int64) *RateLimiter {
+	l := &RateLimiter{changed: make(chan struct{})}
+	l.SetRate(bytesPerSec)
+	return l
+}
+
+// SetRate changes the rate, the goroutines waiting in Wait return at once.
+func (l *RateLimiter) SetRate(bytesPerSec int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if bytesPerSec < 0 {
+		bytesPerSec = 0
+	}
+	l.rate = float64(bytesPerSec)
+	l.tokens = l.rate
+	l.last = time.Now()
+
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
+// Rate returns the bytes per second, 0 means no limit.
+func (l *RateLimiter) Rate() int64 {
+	if l == nil {
+		return 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return int64(l.rate)
+}
+
+// Wait takes n bytes from the bucket, and blocks until the bucket is not in debt any more.
+// n may be larger than the burst, the following calls wait for the debt to be paid.
+// It returns false without waiting if stop is closed, stop may be nil.
+func (l *RateLimiter) Wait(n int, stop <-chan struct{}) bool {
+	select {
+	case <-stop:
+		return false
+	default:
+	}
+	if l == nil {
+		return true
+	}
+
+	l.mu.Lock()
+	if l.rate <= 0 {
+		l.mu.Unlock()
+		return true
+	}
+
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+	l.last = now
+
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		l.mu.Unlock()
+		return true
+	}
+	wait := time.Duration(-l.tokens / l.rate * float64(time.Second))
+	changed := l.changed
+	l.mu.Unlock()
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-changed:
+	case <-stop:
+		return false
+	}
+	return true
+}
@@ -0,0 +1,68 @@
+package util
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter_Wait(t *testing.T) {
+	l := NewRateLimiter(1000)
+
+	// the burst is not limited
+	start := time.Now()
+	assert.True(t, l.Wait(1000, nil))
+	assert.True(t, time.Since(start) < 100*time.Millisecond)
+
+	start = time.Now()
+	assert.True(t, l.Wait(200, nil))
+	assert.True(t, time.Since(start) >= 150*time.Millisecond)
+}
+
+func TestRateLimiter_SetRate(t *testing.T) {
+	l := NewRateLimiter(1)
+	l.Wait(1, nil)
+
+	// the waiting goroutine returns once the limit is removed
+	done := make(chan struct{})
+	go func() {
+		assert.True(t, l.Wait(1000, nil))
+		close(done)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	l.SetRate(0)
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Wait is not woken up")
+	}
+	assert.Equal(t, int64(0), l.Rate())
+}
+
+func TestRateLimiter_Stop(t *testing.T) {
+	l := NewRateLimiter(1)
+	l.Wait(1, nil)
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		assert.False(t, l.Wait(1000, stop))
+		close(done)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	close(stop)
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Wait is not stopped")
+	}
+	assert.False(t, l.Wait(0, stop))
+}
+
+func TestRateLimiter_Nil(t *testing.T) {
+	var l *RateLimiter
+	assert.True(t, l.Wait(100, nil))
+	assert.Equal(t, int64(0), l.Rate())
+}
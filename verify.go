@@ -0,0 +1,298 @@
+package kv_db
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"kv-db/util"
+	"kv-db/wal"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+)
+
+type VerifyOptions struct {
+	// SkipHintFiles does not check the hint files against the segments, only the segments are read.
+	SkipHintFiles bool
+
+	// MaxIssues stops the verification after this many issues are found, 0 means no limit.
+	MaxIssues int
+}
+
+// VerifyIssue is a damage or an inconsistency found by Verify.
+type VerifyIssue struct {
+	// File is the name of the file in the directory.
+	File string
+	// Pos is the position of the damaged record in the segment, or of the record indexed by a wrong hint entry.
+	// It is nil if the issue is about the whole file.
+	Pos *wal.Chunk
+	Err error
+}
+
+func (i *VerifyIssue) String() string {
+	if i.Pos == nil {
+		return fmt.Sprintf("%s: %v", i.File, i.Err)
+	}
+	return fmt.Sprintf("%s: block %d offset %d: %v", i.File, i.Pos.BlockIndex, i.Pos.BlockOffset, i.Err)
+}
+
+type VerifyReport struct {
+	Segments  int
+	HintFiles int
+	Records   int
+	Issues    []*VerifyIssue
+
+	maxIssues int
+}
+
+// OK reports whether no issue is found.
+func (r *VerifyReport) OK() bool {
+	return len(r.Issues) == 0
+}
+
+func (r *VerifyReport) add(file string, pos *wal.Chunk, err error) {
+	if !r.full() {
+		r.Issues = append(r.Issues, &VerifyIssue{File: file, Pos: pos, Err: err})
+	}
+}
+
+func (r *VerifyReport) full() bool {
+	return r.maxIssues > 0 && len(r.Issues) >= r.maxIssues
+}
+
+// Verify reads every segment and hint file in dir without opening the DB, and checks the chunks, the records,
+// and that the hint files index the records of the segments. It returns ErrDatabaseLocked if the DB is open
+// for writes. The damages are returned in the report, the error is only returned if dir can not be read.
+func Verify(dir string, options VerifyOptions) (*VerifyReport, error) {
+	if _, err := os.Stat(dir); err != nil {
+		return nil, err
+	}
+	lock, err := util.LockFileShared(filepath.Join(dir, LockFileName))
+	if err != nil {
+		if err == util.ErrLocked {
+			return nil, ErrDatabaseLocked
+		}
+		return nil, err
+	}
+	defer func() {
+		_ = lock.Unlock()
+	}()
+
+	report := &VerifyReport{maxIssues: options.MaxIssues}
+	segmentIds, err := listFileIds(dir, wal.SegmentSuffix)
+	if err != nil {
+		return nil, err
+	}
+
+	// the segments up to fin are indexed by the hint wal written by the old versions
+	var legacy map[uint32][]*hintEntry
+	if !options.SkipHintFiles {
+		if legacy, err = verifyLegacyHint(dir, segmentIds, report); err != nil {
+			return nil, err
+		}
+		if err = verifyOrphanHintFiles(dir, segmentIds, report); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, id := range segmentIds {
+		if report.full() {
+			break
+		}
+		if err = verifySegment(dir, id, legacy[id], options, report); err != nil {
+			return nil, err
+		}
+	}
+	return report, nil
+}
+
+func listFileIds(dir string, suffix string) ([]uint32, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*"+suffix))
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []uint32
+	for _, path := range paths {
+		var id uint32
+		if _, err := fmt.Sscanf(filepath.Base(path), "%d"+suffix, &id); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i] < ids[j]
+	})
+	return ids, nil
+}
+
+// verifyLegacyHint checks the fin file and reads the hint wal, it returns the hint entries of each segment.
+func verifyLegacyHint(dir string, segmentIds []uint32, report *VerifyReport) (map[uint32][]*hintEntry, error) {
+	hintIds, err := listFileIds(dir, HintSuffix)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, MergeFinSuffix))
+	if os.IsNotExist(err) {
+		if len(hintIds) > 0 {
+			report.add(MergeFinSuffix, nil, fmt.Errorf("the fin file of the hint wal does not exist"))
+		}
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	fin, err := strconv.Atoi(string(data))
+	if err != nil || fin <= 0 {
+		report.add(MergeFinSuffix, nil, fmt.Errorf("invalid merged segment id %q", data))
+		return nil, nil
+	}
+	if len(hintIds) == 0 {
+		report.add(MergeFinSuffix, nil, fmt.Errorf("the hint wal does not exist"))
+		return nil, nil
+	}
+	if len(segmentIds) == 0 || uint32(fin) >= segmentIds[len(segmentIds)-1] {
+		report.add(MergeFinSuffix, nil, fmt.Errorf("merged segment %d is not sealed", fin))
+	}
+
+	entries := make(map[uint32][]*hintEntry)
+	for _, id := range hintIds {
+		name := filepath.Base(wal.JoinSegmentPath(dir, HintSuffix, id))
+		report.HintFiles++
+		errs, err := wal.VerifySegment(dir, HintSuffix, id, func(data []byte, pos *wal.Chunk) {
+			if err := checkHintRecord(data); err != nil {
+				report.add(name, pos, err)
+				return
+			}
+
+			key, segPos := decodeHintRecord(data)
+			if segPos.SegmentId > uint32(fin) {
+				report.add(name, pos, fmt.Errorf("key %q is in segment %d, which is not merged", key, segPos.SegmentId))
+				return
+			}
+			entries[segPos.SegmentId] = append(entries[segPos.SegmentId], &hintEntry{key: key, pos: segPos})
+		})
+		if err != nil {
+			report.add(name, nil, err)
+			continue
+		}
+		for _, e := range errs {
+			report.add(name, &wal.Chunk{SegmentId: e.SegmentId, BlockIndex: e.BlockIndex, BlockOffset: e.BlockOffset}, e.Err)
+		}
+	}
+	return entries, nil
+}
+
+func verifyOrphanHintFiles(dir string, segmentIds []uint32, report *VerifyReport) error {
+	hintIds, err := listFileIds(dir, SegmentHintSuffix)
+	if err != nil {
+		return err
+	}
+
+	segments := make(map[uint32]bool, len(segmentIds))
+	for _, id := range segmentIds {
+		segments[id] = true
+	}
+	for _, id := range hintIds {
+		if !segments[id] {
+			name := filepath.Base(wal.JoinSegmentPath(dir, SegmentHintSuffix, id))
+			report.add(name, nil, fmt.Errorf("segment %d does not exist", id))
+		}
+	}
+	return nil
+}
+
+// recordPos is the position of a record in a segment, the size is not compared since the hint wal
+// of the old versions saves the size of the data instead.
+type recordPos struct {
+	blockIndex  uint32
+	blockOffset uint32
+}
+
+func positionOf(pos *wal.Chunk) recordPos {
+	return recordPos{blockIndex: pos.BlockIndex, blockOffset: pos.BlockOffset}
+}
+
+// verifySegment reads the segment and checks its records against its hint file and the entries of the hint wal.
+func verifySegment(dir string, id uint32, legacy []*hintEntry, options VerifyOptions, report *VerifyReport) error {
+	name := filepath.Base(wal.JoinSegmentPath(dir, wal.SegmentSuffix, id))
+	hintName := filepath.Base(wal.JoinSegmentPath(dir, SegmentHintSuffix, id))
+
+	var hints map[recordPos]*hintEntry
+	if !options.SkipHintFiles {
+		entries, err := readHintFile(dir, id)
+		if err == nil {
+			report.HintFiles++
+			hints = make(map[recordPos]*hintEntry, len(entries))
+			for _, e := range entries {
+				hints[positionOf(e.pos)] = e
+			}
+		} else if !os.IsNotExist(err) {
+			report.HintFiles++
+			report.add(hintName, nil, err)
+		}
+	}
+	legacyHints := make(map[recordPos]*hintEntry, len(legacy))
+	for _, e := range legacy {
+		legacyHints[positionOf(e.pos)] = e
+	}
+
+	report.Segments++
+	errs, err := wal.VerifySegment(dir, wal.SegmentSuffix, id, func(data []byte, pos *wal.Chunk) {
+		report.Records++
+		if err := checkLogRecord(data); err != nil {
+			report.add(name, pos, err)
+			return
+		}
+
+		record := decodeLogRecord(data)
+		if hints != nil {
+			e, ok := hints[positionOf(pos)]
+			if !ok {
+				report.add(hintName, pos, fmt.Errorf("key %q is not in the hint file", record.key))
+			} else if !bytes.Equal(e.key, record.key) || e.recordType != record.recordType ||
+				e.expire != record.expire || e.pos.Size != pos.Size {
+				report.add(hintName, pos, fmt.Errorf("the hint entry of key %q does not match the record", e.key))
+			}
+			delete(hints, positionOf(pos))
+		}
+		if e, ok := legacyHints[positionOf(pos)]; ok {
+			if !bytes.Equal(e.key, record.key) {
+				report.add(name, pos, fmt.Errorf("the hint wal entry of key %q does not match the record", e.key))
+			}
+			delete(legacyHints, positionOf(pos))
+		}
+	})
+	if err != nil {
+		report.add(name, nil, err)
+		return nil
+	}
+	for _, e := range errs {
+		report.add(name, &wal.Chunk{SegmentId: e.SegmentId, BlockIndex: e.BlockIndex, BlockOffset: e.BlockOffset}, e.Err)
+	}
+
+	// the entries left do not index any record
+	for _, e := range sortedHintEntries(hints) {
+		report.add(hintName, e.pos, fmt.Errorf("the hint entry of key %q indexes no record", e.key))
+	}
+	for _, e := range sortedHintEntries(legacyHints) {
+		report.add(name, e.pos, fmt.Errorf("the hint wal entry of key %q indexes no record", e.key))
+	}
+	return nil
+}
+
+func sortedHintEntries(hints map[recordPos]*hintEntry) []*hintEntry {
+	entries := make([]*hintEntry, 0, len(hints))
+	for _, e := range hints {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].pos.BlockIndex != entries[j].pos.BlockIndex {
+			return entries[i].pos.BlockIndex < entries[j].pos.BlockIndex
+		}
+		return entries[i].pos.BlockOffset < entries[j].pos.BlockOffset
+	})
+	return entries
+}
@@ -0,0 +1,78 @@
+package kv_db
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"kv-db/wal"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestVerify(t *testing.T) {
+	options := DefaultOptions
+	options.Dir = t.TempDir()
+	options.SegmentSize = 64 * wal.KB
+	db, err := openDB(options)
+	assert.Nil(t, err)
+
+	mergeTestPutAndDelete(t, db)
+	assert.Nil(t, db.merge())
+	mergeTestPutAndDelete(t, db)
+
+	_, err = Verify(options.Dir, VerifyOptions{})
+	assert.Equal(t, ErrDatabaseLocked, err)
+	// the first segment is written by the merge
+	id := db.wal.SegmentIds()[0]
+	assert.Nil(t, db.Close())
+
+	report, err := Verify(options.Dir, VerifyOptions{})
+	assert.Nil(t, err)
+	assert.True(t, report.OK())
+	assert.True(t, report.Segments > 1)
+	assert.True(t, report.HintFiles > 0)
+	assert.True(t, report.Records > 0)
+
+	// a damaged chunk is reported with its position
+	entries, err := readHintFile(options.Dir, id)
+	assert.Nil(t, err)
+	pos := entries[len(entries)/2].pos
+	f, err := os.OpenFile(wal.JoinSegmentPath(options.Dir, wal.SegmentSuffix, id), os.O_RDWR, 0644)
+	assert.Nil(t, err)
+	_, err = f.WriteAt([]byte{0xff}, 32+int64(pos.BlockIndex)*int64(options.BlockSize)+int64(pos.BlockOffset)+10)
+	assert.Nil(t, err)
+	assert.Nil(t, f.Close())
+
+	// a hint entry which does not match the record
+	entries[0].key = []byte("wrong")
+	assert.Nil(t, writeHintFile(options.Dir, id, entries))
+	assert.Nil(t, writeHintFile(options.Dir, 10000, nil))
+
+	report, err = Verify(options.Dir, VerifyOptions{})
+	assert.Nil(t, err)
+	assert.False(t, report.OK())
+	segmentName := filepath.Base(wal.JoinSegmentPath("", wal.SegmentSuffix, id))
+	hintName := filepath.Base(wal.JoinSegmentPath("", SegmentHintSuffix, id))
+	var crcIssue, hintIssue, orphanIssue bool
+	for _, issue := range report.Issues {
+		switch {
+		case issue.File == segmentName && issue.Pos != nil && *issue.Pos == wal.Chunk{SegmentId: id, BlockIndex: pos.BlockIndex, BlockOffset: pos.BlockOffset}:
+			crcIssue = true
+		case issue.File == hintName && issue.Pos != nil && *issue.Pos == *entries[0].pos:
+			hintIssue = true
+		case issue.File == "000010000.hnt" && issue.Pos == nil:
+			orphanIssue = true
+		}
+	}
+	assert.True(t, crcIssue, report.Issues)
+	assert.True(t, hintIssue)
+	assert.True(t, orphanIssue)
+
+	report, err = Verify(options.Dir, VerifyOptions{SkipHintFiles: true, MaxIssues: 1})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(report.Issues))
+	assert.Equal(t, 1, report.Segments)
+
+	_, err = Verify(t.TempDir()+"/none", VerifyOptions{})
+	assert.True(t, errors.Is(err, os.ErrNotExist))
+}
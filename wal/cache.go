@@ -0,0 +1,127 @@
+package wal
+
+import (
+	"container/list"
+	"sync"
+)
+
+// BlockCache is a size-bounded LRU cache of sealed blocks, keyed by segment id and block index.
+// A single cache may be shared by every segment of a Wal. The segment id used by the cache is
+// unique for each opened segment, so a segment replaced by merge never reads the blocks of the old one.
+type BlockCache struct {
+	capacity  int64
+	used      int64
+	mu        sync.Mutex
+	lru       *list.List
+	blocks    map[uint64]*list.Element
+	segments  map[uint32]map[uint32]struct{} // 每个段缓存的块号，用于关闭段时不必遍历整个缓存
+	hits      uint64
+	misses    uint64
+	evictions uint64
+}
+
+type BlockCacheStats struct {
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+	Blocks    int
+	Bytes     int64
+}
+
+type cachedBlock struct {
+	key  uint64
+	data []byte
+}
+
+// NewBlockCache creates a cache holding at most size bytes of blocks, it returns nil if size is too small to hold a block.
+func NewBlockCache(size int64) *BlockCache {
+	if size < MinBlockSize {
+		return nil
+	}
+
+	return &BlockCache{
+		capacity: size,
+		lru:      list.New(),
+		blocks:   make(map[uint64]*list.Element),
+		segments: make(map[uint32]map[uint32]struct{}),
+	}
+}
+
+func blockCacheKey(segmentId uint32, blockIndex uint32) uint64 {
+	return uint64(segmentId)<<32 | uint64(blockIndex)
+}
+
+func (c *BlockCache) Get(segmentId uint32, blockIndex uint32) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.blocks[blockCacheKey(segmentId, blockIndex)]; ok {
+		c.lru.MoveToFront(e)
+		c.hits++
+		return e.Value.(*cachedBlock).data, true
+	}
+
+	c.misses++
+	return nil, false
+}
+
+// Put caches a block, the block must not be modified after it is put.
+func (c *BlockCache) Put(segmentId uint32, blockIndex uint32, block []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if int64(len(block)) > c.capacity {
+		return
+	}
+
+	key := blockCacheKey(segmentId, blockIndex)
+	c.removeLocked(key)
+	c.blocks[key] = c.lru.PushFront(&cachedBlock{key: key, data: block})
+	if c.segments[segmentId] == nil {
+		c.segments[segmentId] = make(map[uint32]struct{})
+	}
+	c.segments[segmentId][blockIndex] = struct{}{}
+	c.used += int64(len(block))
+
+	for c.used > c.capacity {
+		c.removeLocked(c.lru.Back().Value.(*cachedBlock).key)
+		c.evictions++
+	}
+}
+
+func (c *BlockCache) removeLocked(key uint64) {
+	if e, ok := c.blocks[key]; ok {
+		c.lru.Remove(e)
+		delete(c.blocks, key)
+		c.used -= int64(len(e.Value.(*cachedBlock).data))
+
+		segmentId := uint32(key >> 32)
+		delete(c.segments[segmentId], uint32(key))
+		if len(c.segments[segmentId]) == 0 {
+			delete(c.segments, segmentId)
+		}
+	}
+}
+
+// RemoveSegment drops all cached blocks of the segment.
+func (c *BlockCache) RemoveSegment(segmentId uint32) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for blockIndex := range c.segments[segmentId] {
+		c.removeLocked(blockCacheKey(segmentId, blockIndex))
+	}
+}
+
+func (c *BlockCache) Stats() BlockCacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return BlockCacheStats{
+		Hits:      c.hits,
+		Misses:    c.misses,
+		Evictions: c.evictions,
+		Blocks:    c.lru.Len(),
+		Bytes:     c.used,
+	}
+}
@@ -0,0 +1,106 @@
+package wal
+
+import (
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+func TestBlockCache_GetPut(t *testing.T) {
+	cache := NewBlockCache(2 * DefaultBlockSize)
+
+	block := make([]byte, DefaultBlockSize)
+	cache.Put(1, 0, block)
+
+	ret, ok := cache.Get(1, 0)
+	assert.True(t, ok)
+	assert.Equal(t, block, ret)
+
+	_, ok = cache.Get(1, 1)
+	assert.False(t, ok)
+
+	stats := cache.Stats()
+	assert.Equal(t, uint64(1), stats.Hits)
+	assert.Equal(t, uint64(1), stats.Misses)
+	assert.Equal(t, 1, stats.Blocks)
+}
+
+func TestBlockCache_Evict(t *testing.T) {
+	cache := NewBlockCache(2 * DefaultBlockSize)
+
+	cache.Put(1, 0, make([]byte, DefaultBlockSize))
+	cache.Put(1, 1, make([]byte, DefaultBlockSize))
+
+	// block 0 becomes the most recently used
+	_, ok := cache.Get(1, 0)
+	assert.True(t, ok)
+
+	cache.Put(1, 2, make([]byte, DefaultBlockSize))
+	_, ok = cache.Get(1, 1)
+	assert.False(t, ok)
+	_, ok = cache.Get(1, 0)
+	assert.True(t, ok)
+	assert.Equal(t, uint64(1), cache.Stats().Evictions)
+}
+
+func TestBlockCache_RemoveSegment(t *testing.T) {
+	cache := NewBlockCache(10 * DefaultBlockSize)
+	for id := uint32(1); id <= 3; id++ {
+		cache.Put(id, 0, make([]byte, DefaultBlockSize))
+	}
+
+	cache.Put(3, 1, make([]byte, DefaultBlockSize))
+
+	cache.RemoveSegment(3)
+	_, ok := cache.Get(3, 0)
+	assert.False(t, ok)
+	_, ok = cache.Get(3, 1)
+	assert.False(t, ok)
+	assert.Equal(t, 2, cache.Stats().Blocks)
+	assert.Equal(t, int64(2*DefaultBlockSize), cache.Stats().Bytes)
+	assert.Equal(t, 2, len(cache.segments))
+
+	// the evicted blocks are no longer indexed by their segment
+	cache.Put(4, 0, make([]byte, 9*DefaultBlockSize))
+	_, ok = cache.segments[1]
+	assert.False(t, ok)
+	cache.RemoveSegment(1)
+	assert.Equal(t, 2, cache.Stats().Blocks)
+}
+
+func TestBlockCache_TooSmall(t *testing.T) {
+	assert.Nil(t, NewBlockCache(MinBlockSize-1))
+}
+
+func TestWal_ReadWithBlockCache(t *testing.T) {
+	cache := NewBlockCache(4 * DefaultBlockSize)
+	wal, err := Open(Options{
+		Dir:         t.TempDir(),
+		SegmentSize: DefaultBlockSize * 15,
+		BlockCache:  cache,
+	})
+	assert.Nil(t, err)
+	defer removeWal(wal)
+
+	data := []byte(strings.Repeat("x", DefaultBlockSize))
+	chunk, err := wal.Write(data)
+	assert.Nil(t, err)
+	chunk2, err := wal.Write([]byte("abc"))
+	assert.Nil(t, err)
+
+	for i := 0; i < 3; i++ {
+		ret, err := wal.Read(chunk)
+		assert.Nil(t, err)
+		assert.Equal(t, data, ret)
+
+		ret, err = wal.Read(chunk2)
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("abc"), ret)
+	}
+
+	// only the first block is sealed, the second one is still being written
+	stats := cache.Stats()
+	assert.Equal(t, 1, stats.Blocks)
+	assert.Equal(t, uint64(2), stats.Hits)
+	assert.Equal(t, uint64(1), stats.Misses)
+}
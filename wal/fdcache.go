@@ -0,0 +1,125 @@
+package wal
+
+import (
+	"container/list"
+	"os"
+	"sync"
+)
+
+// fdCache keeps at most capacity file descriptors of sealed segments open.
+// Sealed segments are opened on demand when they are read, and the least recently used ones
+// are closed when there are too many open, segments which are being read are never closed.
+type fdCache struct {
+	capacity int
+	mu       sync.Mutex
+	lru      *list.List
+}
+
+func newFdCache(capacity int) *fdCache {
+	if capacity <= 0 {
+		return nil
+	}
+
+	return &fdCache{
+		capacity: capacity,
+		lru:      list.New(),
+	}
+}
+
+// add manages the fd of a sealed segment, the fd may be nil if the segment is not opened yet.
+func (c *fdCache) add(seg *segment) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	seg.fds = c
+	if seg.fd != nil {
+		seg.lruElem = c.lru.PushFront(seg)
+		c.evictLocked()
+	}
+}
+
+func (c *fdCache) acquire(seg *segment) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if seg.closed {
+		return segmentIsClosedErr
+	}
+
+	if seg.fd == nil {
+		fd, err := os.OpenFile(seg.path, os.O_RDONLY, fileModePerm)
+		if err != nil {
+			return err
+		}
+		seg.fd = fd
+		seg.lruElem = c.lru.PushFront(seg)
+	} else {
+		c.lru.MoveToFront(seg.lruElem)
+	}
+
+	seg.refs++
+	c.evictLocked()
+	return nil
+}
+
+func (c *fdCache) release(seg *segment) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	seg.refs--
+	if seg.retired && seg.refs == 0 {
+		seg.closed = true
+		_ = c.closeFdLocked(seg)
+	}
+	c.evictLocked()
+}
+
+// retire closes the segment once no reader uses it, the file of the segment is not opened again.
+func (c *fdCache) retire(seg *segment) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	seg.retired = true
+	if seg.refs > 0 {
+		return nil
+	}
+	seg.closed = true
+	return c.closeFdLocked(seg)
+}
+
+// close closes the fd of the segment and stops managing it.
+func (c *fdCache) close(seg *segment) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	seg.closed = true
+	return c.closeFdLocked(seg)
+}
+
+func (c *fdCache) closeFdLocked(seg *segment) error {
+	if seg.fd == nil {
+		return nil
+	}
+
+	c.lru.Remove(seg.lruElem)
+	seg.lruElem = nil
+	err := seg.fd.Close()
+	seg.fd = nil
+	return err
+}
+
+func (c *fdCache) evictLocked() {
+	for e := c.lru.Back(); e != nil && c.lru.Len() > c.capacity; {
+		prev := e.Prev()
+		if seg := e.Value.(*segment); seg.refs == 0 {
+			_ = c.closeFdLocked(seg)
+		}
+		e = prev
+	}
+}
+
+func (c *fdCache) openCount() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
@@ -0,0 +1,90 @@
+package wal
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestWal_MaxOpenSegments(t *testing.T) {
+	dir := t.TempDir()
+	options := Options{
+		Dir:             dir,
+		SegmentSize:     DefaultBlockSize + segmentHeaderSize,
+		MaxOpenSegments: 2,
+	}
+	wal, err := Open(options)
+	assert.Nil(t, err)
+
+	// every record fills a segment
+	data := []byte(strings.Repeat("x", DefaultBlockSize-chunkHeaderSize*2))
+	var positions []*Chunk
+	for i := 0; i < 10; i++ {
+		chunk, err := wal.Write(data)
+		assert.Nil(t, err)
+		positions = append(positions, chunk)
+	}
+	assert.Equal(t, 9, len(wal.olderSegments))
+	assert.Equal(t, 2, wal.fds.openCount())
+
+	for _, pos := range positions {
+		ret, err := wal.Read(pos)
+		assert.Nil(t, err)
+		assert.Equal(t, data, ret)
+		assert.True(t, wal.fds.openCount() <= 2)
+	}
+
+	// reopen, sealed segments are opened lazily
+	assert.Nil(t, wal.Close())
+	wal, err = Open(options)
+	assert.Nil(t, err)
+	defer removeWal(wal)
+	assert.Equal(t, 0, wal.fds.openCount())
+
+	count := 0
+	iter := wal.NewIterator()
+	for {
+		ret, _, err := iter.Next()
+		if err == io.EOF {
+			break
+		}
+		assert.Nil(t, err)
+		assert.Equal(t, data, ret)
+		assert.True(t, wal.fds.openCount() <= 2)
+		count++
+	}
+	assert.Equal(t, 10, count)
+}
+
+func TestFdCache_KeepAcquired(t *testing.T) {
+	wal, err := Open(Options{
+		Dir:             t.TempDir(),
+		SegmentSize:     DefaultBlockSize + segmentHeaderSize,
+		MaxOpenSegments: 1,
+	})
+	assert.Nil(t, err)
+	defer removeWal(wal)
+
+	data := []byte(strings.Repeat("x", DefaultBlockSize-chunkHeaderSize*2))
+	for i := 0; i < 3; i++ {
+		_, err := wal.Write(data)
+		assert.Nil(t, err)
+	}
+
+	seg1, seg2 := wal.olderSegments[1], wal.olderSegments[2]
+	assert.Nil(t, wal.fds.acquire(seg1))
+	assert.Nil(t, wal.fds.acquire(seg2))
+
+	// both are in use, so none of them can be closed
+	assert.Equal(t, 2, wal.fds.openCount())
+	assert.NotNil(t, seg1.fd)
+
+	wal.fds.release(seg1)
+	assert.Equal(t, 1, wal.fds.openCount())
+	assert.Nil(t, seg1.fd)
+
+	wal.fds.release(seg2)
+	assert.Equal(t, 1, wal.fds.openCount())
+	assert.NotNil(t, seg2.fd)
+}
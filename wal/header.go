@@ -0,0 +1,167 @@
+package wal
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"time"
+)
+
+// segment header, 32 Bytes:
+//
+//	magic   version   checksumType   flags   segmentId   blockSize   createTime   checksum   padding
+//	  4        2           1           1         4           4            8           4          4
+//
+// version 1 does not have checksumType and flags, its chunks always use IEEE checksums.
+// The files written before the header is added have no header, they are read as version 0 if their first chunk
+// is valid, which uses IEEE checksums and DefaultBlockSize blocks, and is never preallocated.
+const (
+	segmentHeaderSize = 32
+	segmentMagic      = 0x4B564442 // "KVDB"
+	segmentVersion    = 2
+)
+
+// flagRecordHash means a record written across multiple blocks is followed by the xxHash64 of the record.
+const flagRecordHash byte = 1 << 0
+
+var invalidSegmentHeader = errors.New("invalid segment header, the file is not a segment or it is damaged")
+
+type segmentHeader struct {
+	version      uint16
+	checksumType ChecksumType
+	flags        byte
+	segmentId    uint32
+	blockSize    uint32
+	createTime   int64
+}
+
+// legacySegmentHeader is the header of a segment file without header.
+func legacySegmentHeader(id uint32) *segmentHeader {
+	return &segmentHeader{
+		version:      0,
+		checksumType: ChecksumIEEE,
+		segmentId:    id,
+		blockSize:    DefaultBlockSize,
+	}
+}
+
+// size is the bytes of the header in the file.
+func (h *segmentHeader) size() int64 {
+	if h.version == 0 {
+		return 0
+	}
+	return segmentHeaderSize
+}
+
+func (h *segmentHeader) encode() []byte {
+	buf := make([]byte, segmentHeaderSize)
+	binary.LittleEndian.PutUint32(buf[0:4], segmentMagic)
+	binary.LittleEndian.PutUint16(buf[4:6], h.version)
+	buf[6] = byte(h.checksumType)
+	buf[7] = h.flags
+	binary.LittleEndian.PutUint32(buf[8:12], h.segmentId)
+	binary.LittleEndian.PutUint32(buf[12:16], h.blockSize)
+	binary.LittleEndian.PutUint64(buf[16:24], uint64(h.createTime))
+	binary.LittleEndian.PutUint32(buf[24:28], crc32.ChecksumIEEE(buf[0:24]))
+	return buf
+}
+
+func decodeSegmentHeader(buf []byte) (*segmentHeader, error) {
+	if len(buf) < segmentHeaderSize || binary.LittleEndian.Uint32(buf[0:4]) != segmentMagic {
+		return nil, invalidSegmentHeader
+	}
+
+	if crc32.ChecksumIEEE(buf[0:24]) != binary.LittleEndian.Uint32(buf[24:28]) {
+		return nil, invalidSegmentHeader
+	}
+
+	header := &segmentHeader{
+		version:    binary.LittleEndian.Uint16(buf[4:6]),
+		segmentId:  binary.LittleEndian.Uint32(buf[8:12]),
+		blockSize:  binary.LittleEndian.Uint32(buf[12:16]),
+		createTime: int64(binary.LittleEndian.Uint64(buf[16:24])),
+	}
+	if header.version >= 2 {
+		header.checksumType = ChecksumType(buf[6])
+		header.flags = buf[7]
+	}
+	return header, nil
+}
+
+func newSegmentHeader(id uint32) *segmentHeader {
+	return &segmentHeader{
+		version:      segmentVersion,
+		checksumType: ChecksumIEEE,
+		segmentId:    id,
+		blockSize:    DefaultBlockSize,
+		createTime:   time.Now().UnixNano(),
+	}
+}
+
+// readSegmentHeader reads and validates the header of the segment file with the given id, the file without header
+// is read as version 0 if it is empty or its first chunk is valid.
+func readSegmentHeader(file *os.File, id uint32) (*segmentHeader, error) {
+	buf := make([]byte, segmentHeaderSize)
+	n, err := file.ReadAt(buf, 0)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	// the files without the magic are written before the header is added, or they are not segments,
+	// e.g. a foreign file or a segment whose header is damaged
+	if n < 4 || binary.LittleEndian.Uint32(buf[0:4]) != segmentMagic {
+		ok, err := isLegacySegment(file, buf[:n])
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, fmt.Errorf("%s: %w", file.Name(), invalidSegmentHeader)
+		}
+		return legacySegmentHeader(id), nil
+	}
+
+	header, err := decodeSegmentHeader(buf[:n])
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", file.Name(), err)
+	}
+
+	switch {
+	case header.version > segmentVersion:
+		return nil, fmt.Errorf("%s: unsupported segment version %d", file.Name(), header.version)
+	case header.segmentId != id:
+		return nil, fmt.Errorf("%s: segment id %d in header does not match", file.Name(), header.segmentId)
+	case header.checksumType > ChecksumCastagnoli:
+		return nil, fmt.Errorf("%s: unsupported checksum type %d", file.Name(), header.checksumType)
+	case header.blockSize < MinBlockSize || header.blockSize > MaxBlockSize:
+		return nil, fmt.Errorf("%s: unsupported block size %d", file.Name(), header.blockSize)
+	}
+	return header, nil
+}
+
+// isLegacySegment reports whether the file without header is a segment of version 0, buf is the beginning of the file.
+// The first chunk of such a segment starts a record and passes the IEEE checksum, the empty file is an empty segment.
+func isLegacySegment(file *os.File, buf []byte) (bool, error) {
+	if len(buf) == 0 {
+		return true, nil
+	}
+	if len(buf) < chunkHeaderSize {
+		return false, nil
+	}
+
+	chunkType := buf[6]
+	end := chunkHeaderSize + int(binary.LittleEndian.Uint16(buf[4:6]))
+	if (chunkType != chunkTypeFull && chunkType != chunkTypeStart) || end > DefaultBlockSize {
+		return false, nil
+	}
+
+	chunk := make([]byte, end)
+	if _, err := file.ReadAt(chunk, 0); err != nil {
+		if err == io.EOF {
+			return false, nil
+		}
+		return false, err
+	}
+	return crc32.ChecksumIEEE(chunk[4:]) == binary.LittleEndian.Uint32(chunk[0:4]), nil
+}
@@ -0,0 +1,331 @@
+package wal
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestSegmentHeader_Encode(t *testing.T) {
+	header := newSegmentHeader(7)
+
+	ret, err := decodeSegmentHeader(header.encode())
+	assert.Nil(t, err)
+	assert.Equal(t, header, ret)
+
+	// damaged
+	buf := header.encode()
+	buf[10] ^= 0xFF
+	_, err = decodeSegmentHeader(buf)
+	assert.Equal(t, invalidSegmentHeader, err)
+}
+
+func TestSegment_OpenInvalidFile(t *testing.T) {
+	dir := t.TempDir()
+	path := JoinSegmentPath(dir, SegmentSuffix, 1)
+	buf := newSegmentHeader(1).encode()
+	buf[10] ^= 0xFF
+	err := os.WriteFile(path, append(buf, []byte(strings.Repeat("not a segment", 10))...), fileModePerm)
+	assert.Nil(t, err)
+
+	_, err = openSegment(dir, SegmentSuffix, 1)
+	assert.ErrorIs(t, err, invalidSegmentHeader)
+
+	_, err = Open(Options{
+		Dir:               dir,
+		SegmentSize:       DefaultBlockSize * 10,
+		SegmentFileSuffix: SegmentSuffix,
+	})
+	assert.ErrorIs(t, err, invalidSegmentHeader)
+}
+
+func TestSegment_OpenWithoutHeader(t *testing.T) {
+	dir := t.TempDir()
+	options := Options{
+		Dir:               dir,
+		SegmentSize:       DefaultBlockSize * 10,
+		SegmentFileSuffix: SegmentSuffix,
+		Preallocate:       true,
+	}
+
+	// write a segment in the format without header
+	seg, err := openSegment(dir, SegmentSuffix, 1)
+	assert.Nil(t, err)
+	data := []byte(strings.Repeat("x", 100))
+	for i := 0; i < 3; i++ {
+		_, err = seg.Write(data)
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, seg.Close())
+	path := JoinSegmentPath(dir, SegmentSuffix, 1)
+	content, err := os.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Nil(t, os.WriteFile(path, content[segmentHeaderSize:], fileModePerm))
+
+	wal, err := Open(options)
+	assert.Nil(t, err)
+	assert.Equal(t, uint16(0), wal.activeSegment.header.version)
+	chunk, err := wal.Write(data)
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(1), chunk.SegmentId)
+
+	// the segment without header is not preallocated
+	info, err := os.Stat(path)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(4*(len(data)+chunkHeaderSize)), info.Size())
+	assert.Nil(t, wal.Close())
+
+	wal, err = Open(options)
+	assert.Nil(t, err)
+	defer removeWal(wal)
+	iter := wal.NewIterator()
+	for i := 0; i < 4; i++ {
+		ret, _, err := iter.Next()
+		assert.Nil(t, err)
+		assert.Equal(t, data, ret)
+	}
+	_, _, err = iter.Next()
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestSegment_OpenWithoutMagic(t *testing.T) {
+	dir := t.TempDir()
+	path := JoinSegmentPath(dir, SegmentSuffix, 1)
+
+	// a foreign file is not read as a segment without header
+	assert.Nil(t, os.WriteFile(path, []byte(strings.Repeat("not a segment", 10)), fileModePerm))
+	_, err := openSegment(dir, SegmentSuffix, 1)
+	assert.ErrorIs(t, err, invalidSegmentHeader)
+
+	// neither is a segment whose magic is damaged
+	seg, err := openSegment(dir, SegmentSuffix, 2)
+	assert.Nil(t, err)
+	_, err = seg.Write([]byte("abc"))
+	assert.Nil(t, err)
+	assert.Nil(t, seg.Close())
+	path = JoinSegmentPath(dir, SegmentSuffix, 2)
+	content, err := os.ReadFile(path)
+	assert.Nil(t, err)
+	content[0] ^= 0xFF
+	assert.Nil(t, os.WriteFile(path, content, fileModePerm))
+	_, err = openSegment(dir, SegmentSuffix, 2)
+	assert.ErrorIs(t, err, invalidSegmentHeader)
+
+	// the empty file is an empty segment without header
+	assert.Nil(t, os.WriteFile(JoinSegmentPath(dir, SegmentSuffix, 3), nil, fileModePerm))
+	seg, err = openSegmentReadOnly(dir, SegmentSuffix, 3)
+	assert.Nil(t, err)
+	assert.Equal(t, uint16(0), seg.header.version)
+	assert.Nil(t, seg.Close())
+}
+
+func TestSegment_OpenMismatchedId(t *testing.T) {
+	dir := t.TempDir()
+	segment, err := openSegment(dir, SegmentSuffix, 1)
+	assert.Nil(t, err)
+	assert.Nil(t, segment.Close())
+
+	err = os.Rename(JoinSegmentPath(dir, SegmentSuffix, 1), JoinSegmentPath(dir, SegmentSuffix, 2))
+	assert.Nil(t, err)
+
+	_, err = openSegment(dir, SegmentSuffix, 2)
+	assert.NotNil(t, err)
+}
+
+func TestWal_Preallocate(t *testing.T) {
+	options := Options{
+		Dir:               t.TempDir(),
+		SegmentSize:       DefaultBlockSize * 2,
+		SegmentFileSuffix: SegmentSuffix,
+		Preallocate:       true,
+	}
+	wal, err := Open(options)
+	assert.Nil(t, err)
+
+	info, err := os.Stat(JoinSegmentPath(options.Dir, SegmentSuffix, 1))
+	assert.Nil(t, err)
+	assert.Equal(t, options.SegmentSize, info.Size())
+
+	data := []byte(strings.Repeat("x", DefaultBlockSize))
+	for i := 0; i < 3; i++ {
+		_, err = wal.Write(data)
+		assert.Nil(t, err)
+	}
+
+	// the sealed segment is truncated to its data size
+	info, err = os.Stat(JoinSegmentPath(options.Dir, SegmentSuffix, 1))
+	assert.Nil(t, err)
+	assert.Equal(t, segmentHeaderSize+wal.olderSegments[1].Size(), info.Size())
+
+	// reopen without closing, the end of the preallocated active segment is recovered
+	size := wal.activeSegment.Size()
+	assert.Nil(t, wal.activeSegment.Sync())
+	assert.Nil(t, wal.activeSegment.fd.Close())
+	wal, err = Open(options)
+	assert.Nil(t, err)
+	defer removeWal(wal)
+	assert.Equal(t, size, wal.activeSegment.Size())
+
+	_, err = wal.Write([]byte("abc"))
+	assert.Nil(t, err)
+
+	var ret [][]byte
+	iter := wal.NewIterator()
+	for {
+		val, _, err := iter.Next()
+		if err == io.EOF {
+			break
+		}
+		assert.Nil(t, err)
+		ret = append(ret, val)
+	}
+	assert.Equal(t, [][]byte{data, data, data, []byte("abc")}, ret)
+
+	// close releases the preallocated space
+	assert.Nil(t, wal.Close())
+	info, err = os.Stat(JoinSegmentPath(options.Dir, SegmentSuffix, wal.activeSegment.id))
+	assert.Nil(t, err)
+	assert.Equal(t, segmentHeaderSize+wal.activeSegment.Size(), info.Size())
+}
+
+func TestWal_PreallocateCrashTail(t *testing.T) {
+	options := Options{
+		Dir:               t.TempDir(),
+		SegmentSize:       DefaultBlockSize * 4,
+		SegmentFileSuffix: SegmentSuffix,
+		Preallocate:       true,
+	}
+	wal, err := Open(options)
+	assert.Nil(t, err)
+
+	_, err = wal.Write([]byte("abc"))
+	assert.Nil(t, err)
+	_, err = wal.Write([]byte(strings.Repeat("x", DefaultBlockSize*2)))
+	assert.Nil(t, err)
+	assert.Nil(t, wal.activeSegment.Sync())
+	assert.Nil(t, wal.activeSegment.fd.Close())
+
+	// crash after the start chunk of the large record is written, its other blocks are still zero
+	path := JoinSegmentPath(options.Dir, SegmentSuffix, 1)
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	assert.Nil(t, err)
+	_, err = f.WriteAt(make([]byte, DefaultBlockSize*2), segmentHeaderSize+DefaultBlockSize)
+	assert.Nil(t, err)
+	assert.Nil(t, f.Close())
+
+	readAll := func() [][]byte {
+		var ret [][]byte
+		iter := wal.NewIterator()
+		for {
+			val, _, err := iter.Next()
+			if err == io.EOF {
+				return ret
+			}
+			assert.Nil(t, err)
+			ret = append(ret, val)
+		}
+	}
+
+	// the torn record is dropped, and the new records are written over it
+	wal, err = Open(options)
+	assert.Nil(t, err)
+	assert.Equal(t, [][]byte{[]byte("abc")}, readAll())
+	_, err = wal.Write([]byte("def"))
+	assert.Nil(t, err)
+	assert.Nil(t, wal.Close())
+
+	wal, err = Open(options)
+	assert.Nil(t, err)
+	defer removeWal(wal)
+	assert.Equal(t, [][]byte{[]byte("abc"), []byte("def")}, readAll())
+}
+
+func TestSegmentHeader_DecodeVersion1(t *testing.T) {
+	header := newSegmentHeader(1)
+	header.version = 1
+	header.checksumType = ChecksumCastagnoli
+	header.flags = flagRecordHash
+
+	// version 1 has no checksum type and flags, they must be ignored
+	ret, err := decodeSegmentHeader(header.encode())
+	assert.Nil(t, err)
+	assert.Equal(t, ChecksumIEEE, ret.checksumType)
+	assert.Equal(t, byte(0), ret.flags)
+}
+
+func TestWal_MixedChecksum(t *testing.T) {
+	options := Options{
+		Dir:               t.TempDir(),
+		SegmentSize:       DefaultBlockSize * 2,
+		SegmentFileSuffix: SegmentSuffix,
+		Checksum:          ChecksumIEEE,
+	}
+	wal, err := Open(options)
+	assert.Nil(t, err)
+
+	data := []byte(strings.Repeat("x", DefaultBlockSize))
+	var positions []*Chunk
+	for i := 0; i < 2; i++ {
+		chunk, err := wal.Write(data)
+		assert.Nil(t, err)
+		positions = append(positions, chunk)
+	}
+
+	// segments created after reopen use CRC32C, the old ones are still readable
+	assert.Nil(t, wal.Close())
+	options.Checksum = ChecksumCastagnoli
+	options.RecordHash = true
+	wal, err = Open(options)
+	assert.Nil(t, err)
+	defer removeWal(wal)
+
+	for i := 0; i < 2; i++ {
+		chunk, err := wal.Write(data)
+		assert.Nil(t, err)
+		positions = append(positions, chunk)
+	}
+	assert.Equal(t, ChecksumIEEE, wal.olderSegments[1].header.checksumType)
+	assert.Equal(t, ChecksumCastagnoli, wal.activeSegment.header.checksumType)
+	assert.Equal(t, flagRecordHash, wal.activeSegment.header.flags)
+
+	for _, pos := range positions {
+		ret, err := wal.Read(pos)
+		assert.Nil(t, err)
+		assert.Equal(t, data, ret)
+	}
+}
+
+func TestSegment_RecordHash(t *testing.T) {
+	header := newSegmentHeader(1)
+	header.checksumType = ChecksumCastagnoli
+	header.flags = flagRecordHash
+	segment, err := openSegmentWithHeader(t.TempDir(), SegmentSuffix, header)
+	assert.Nil(t, err)
+	defer func() {
+		_ = segment.Remove()
+	}()
+
+	small := []byte("abc")
+	large := []byte(strings.Repeat("z", DefaultBlockSize*2))
+	chunk, err := segment.Write(small)
+	assert.Nil(t, err)
+	chunk2, err := segment.Write(large)
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(len(large)+recordHashSize+3*chunkHeaderSize), chunk2.Size)
+
+	ret, err := segment.Read(chunk.BlockIndex, chunk.BlockOffset)
+	assert.Nil(t, err)
+	assert.Equal(t, small, ret)
+
+	ret, err = segment.Read(chunk2.BlockIndex, chunk2.BlockOffset)
+	assert.Nil(t, err)
+	assert.Equal(t, large, ret)
+
+	// damaged data
+	hashed := appendRecordHash(large)
+	hashed[10] = 'y'
+	_, ok := verifyRecordHash(hashed)
+	assert.False(t, ok)
+}
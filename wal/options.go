@@ -1,6 +1,10 @@
 package wal
 
-import "os"
+import (
+	"hash/crc32"
+	"os"
+	"time"
+)
 
 const (
 	B             = 1
@@ -8,8 +12,31 @@ const (
 	MB            = 1024 * KB
 	GB            = 1024 * MB
 	SegmentSuffix = ".seg"
+
+	DefaultBlockSize = 32 * KB
+	MinBlockSize     = 4 * KB
+	MaxBlockSize     = 1 * MB
+)
+
+// ChecksumType is the checksum algorithm of the chunks, it is saved in the header of each segment,
+// so segments written with different algorithms can be read by the same Wal.
+type ChecksumType byte
+
+const (
+	ChecksumIEEE ChecksumType = iota
+	// ChecksumCastagnoli is CRC32C, which is hardware accelerated on modern CPUs.
+	ChecksumCastagnoli
 )
 
+var castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+
+func (t ChecksumType) table() *crc32.Table {
+	if t == ChecksumCastagnoli {
+		return castagnoliTable
+	}
+	return crc32.IEEETable
+}
+
 type Options struct {
 	Dir               string
 	SegmentSize       int64
@@ -18,6 +45,37 @@ type Options struct {
 	// 0-不需要同步数据到硬盘，1-每次写入都需要同步数据到硬盘，2-当写入多少字节后需要同步硬盘，与BytesBeforeSync配合使用
 	Sync            int
 	BytesBeforeSync uint32
+
+	// 已写满的 block 的缓存，可以被多个 Wal 共享，为 nil 时不缓存
+	BlockCache *BlockCache
+
+	// 最多同时打开的已封存 segment 文件数，超过时关闭最久未使用的文件，0 表示不限制
+	MaxOpenSegments int
+
+	// 新建 segment 时预分配 SegmentSize 大小的磁盘空间，segment 封存时释放未使用的部分
+	Preallocate bool
+
+	// 新建 segment 使用的 chunk 校验算法
+	Checksum ChecksumType
+
+	// 跨越多个 block 的记录额外保存 64 位的 xxHash 校验值
+	RecordHash bool
+
+	// 新建 segment 的 block 大小，范围为 MinBlockSize ~ MaxBlockSize，0 表示使用 DefaultBlockSize
+	BlockSize uint32
+
+	// 目录为空时创建的第一个 segment 的 id，0 表示从 1 开始
+	FirstSegmentId uint32
+
+	// 每次把 segment 同步到硬盘后以耗时调用，为 nil 时不调用
+	SyncObserver func(d time.Duration)
+
+	// 活跃 segment 被封存、新的活跃 segment 创建后调用，调用时持有 Wal 的锁，不能再调用 Wal 的方法
+	SwitchObserver func(sealedId uint32, newId uint32)
+
+	// 只读打开，不创建、不修改任何文件，Write 返回 ErrReadOnly。所有 segment 的文件一直保持打开（忽略 MaxOpenSegments），
+	// 其他进程合并后替换的 segment 文件不影响已打开的 Wal，活跃 segment 末尾未写完的记录被忽略
+	ReadOnly bool
 }
 
 var DefaultOptions = &Options{
@@ -25,4 +83,5 @@ var DefaultOptions = &Options{
 	SegmentSize:       GB,
 	SegmentFileSuffix: SegmentSuffix,
 	Sync:              0,
+	BlockSize:         DefaultBlockSize,
 }
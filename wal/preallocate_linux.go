@@ -0,0 +1,18 @@
+//go:build linux
+// +build linux
+
+package wal
+
+import (
+	"os"
+	"syscall"
+)
+
+func preallocate(file *os.File, size int64) error {
+	err := syscall.Fallocate(int(file.Fd()), 0, 0, size)
+	if err == syscall.EOPNOTSUPP || err == syscall.ENOSYS {
+		// the file system does not support fallocate, the file just grows by appends
+		return nil
+	}
+	return err
+}
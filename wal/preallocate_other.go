@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package wal
+
+import "os"
+
+func preallocate(file *os.File, size int64) error {
+	return nil
+}
@@ -0,0 +1,176 @@
+package wal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+)
+
+var (
+	ErrWalClosed = errors.New("wal is closed")
+	// ErrStalePosition is returned by Reader if the segment of its position has been rewritten or removed, e.g. by merge.
+	ErrStalePosition = errors.New("the segment of the reader position has been rewritten")
+)
+
+// ReaderPos is the position of the next record of a Reader. SegmentCreateTime identifies the segment, since a segment
+// rewritten by a merge or a repair may have the same id, it is 0 if the segment is not read yet or has no header,
+// and is not checked then.
+type ReaderPos struct {
+	SegmentId         uint32
+	SegmentCreateTime int64
+	BlockIndex        uint32
+	BlockOffset       uint32
+}
+
+// started reports whether some records of the segment are read before the position.
+func (p *ReaderPos) started() bool {
+	return p.BlockIndex != 0 || p.BlockOffset != 0
+}
+
+// Reader reads the records of a Wal in order from a position, across segment switches.
+// Unlike Iterator it is not limited to the segments existing when it is created, so it can tail the Wal.
+type Reader struct {
+	wal *Wal
+	pos ReaderPos
+}
+
+// NewReaderFrom creates a reader whose first record is the one at pos, the reader starts from the oldest segment if pos is nil.
+// The segment of pos is identified when the reader is created, so Next returns ErrStalePosition if it is rewritten later.
+func (wal *Wal) NewReaderFrom(pos *Chunk) *Reader {
+	r := &Reader{wal: wal}
+	if pos == nil {
+		return r
+	}
+
+	r.pos = ReaderPos{SegmentId: pos.SegmentId, BlockIndex: pos.BlockIndex, BlockOffset: pos.BlockOffset}
+	wal.mu.RLock()
+	defer wal.mu.RUnlock()
+	if !wal.closed {
+		if seg := wal.segmentFrom(pos.SegmentId); seg != nil && seg.id == pos.SegmentId {
+			r.pos.SegmentCreateTime = seg.header.createTime
+		}
+	}
+	return r
+}
+
+// NewReaderFromPos creates a reader which goes on from pos returned by Reader.Pos, e.g. after a restart.
+func (wal *Wal) NewReaderFromPos(pos *ReaderPos) *Reader {
+	return &Reader{wal: wal, pos: *pos}
+}
+
+// Pos returns the position of the next record, a reader created from it later goes on from there.
+func (r *Reader) Pos() *ReaderPos {
+	pos := r.pos
+	return &pos
+}
+
+// Next returns the next record and its position, it returns io.EOF when all records written so far have been read.
+// Next can be called again after io.EOF to read the records written later. It returns ErrStalePosition if the segment
+// being read is rewritten or removed, the reader can not go on then.
+func (r *Reader) Next() ([]byte, *Chunk, error) {
+	r.wal.mu.RLock()
+	defer r.wal.mu.RUnlock()
+
+	if r.wal.closed {
+		return nil, nil, ErrWalClosed
+	}
+
+	for {
+		seg := r.wal.segmentFrom(r.pos.SegmentId)
+		if seg == nil {
+			return nil, nil, fmt.Errorf("inexistent segment: %d", r.pos.SegmentId)
+		}
+		if seg.id != r.pos.SegmentId {
+			if r.pos.started() {
+				return nil, nil, ErrStalePosition
+			}
+			// the segment of the position does not exist, go on from the first one newer than it
+			r.pos = ReaderPos{SegmentId: seg.id}
+		} else if r.pos.SegmentCreateTime != 0 && seg.header.createTime != r.pos.SegmentCreateTime {
+			return nil, nil, ErrStalePosition
+		}
+		r.pos.SegmentCreateTime = seg.header.createTime
+
+		data, size, next, err := seg.doRead(r.pos.BlockIndex, r.pos.BlockOffset)
+		if err == nil {
+			pos := &Chunk{
+				SegmentId:   seg.id,
+				BlockIndex:  r.pos.BlockIndex,
+				BlockOffset: r.pos.BlockOffset,
+				Size:        size,
+			}
+			r.pos.BlockIndex, r.pos.BlockOffset = next.BlockIndex, next.BlockOffset
+			return data, pos, nil
+		}
+
+		if err != io.EOF || seg == r.wal.activeSegment {
+			return nil, nil, err
+		}
+
+		// the sealed segment has been read completely
+		r.pos = ReaderPos{SegmentId: seg.id + 1}
+	}
+}
+
+// NextWait is Next in follow mode, it blocks until a record is written, the context is done or the Wal is closed.
+func (r *Reader) NextWait(ctx context.Context) ([]byte, *Chunk, error) {
+	for {
+		// get the notification before reading, so a write after the read can not be missed
+		written := r.wal.writeNotify()
+
+		data, pos, err := r.Next()
+		if err != io.EOF {
+			return data, pos, err
+		}
+
+		select {
+		case <-written:
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		}
+	}
+}
+
+// segmentFrom returns the segment with the smallest id which is greater than or equal to id, wal.mu must be held.
+func (wal *Wal) segmentFrom(id uint32) *segment {
+	if id >= wal.activeSegment.id {
+		if id == wal.activeSegment.id {
+			return wal.activeSegment
+		}
+		return nil
+	}
+
+	if seg, ok := wal.olderSegments[int(id)]; ok {
+		return seg
+	}
+
+	ret := wal.activeSegment
+	for _, seg := range wal.olderSegments {
+		if seg.id > id && seg.id < ret.id {
+			ret = seg
+		}
+	}
+	return ret
+}
+
+// writeNotify returns a channel which is closed when the next record is written or the Wal is closed.
+func (wal *Wal) writeNotify() <-chan struct{} {
+	wal.notifyMu.Lock()
+	defer wal.notifyMu.Unlock()
+
+	if wal.notify == nil {
+		wal.notify = make(chan struct{})
+	}
+	return wal.notify
+}
+
+func (wal *Wal) notifyWritten() {
+	wal.notifyMu.Lock()
+	defer wal.notifyMu.Unlock()
+
+	if wal.notify != nil {
+		close(wal.notify)
+		wal.notify = nil
+	}
+}
@@ -0,0 +1,194 @@
+package wal
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReader_Next(t *testing.T) {
+	wal, err := Open(Options{
+		Dir:         t.TempDir(),
+		SegmentSize: DefaultBlockSize * 2,
+	})
+	assert.Nil(t, err)
+	defer removeWal(wal)
+
+	// write across several segments
+	data := []byte(strings.Repeat("x", DefaultBlockSize/2))
+	var positions []*Chunk
+	for i := 0; i < 10; i++ {
+		chunk, err := wal.Write(data)
+		assert.Nil(t, err)
+		positions = append(positions, chunk)
+	}
+	assert.True(t, len(wal.olderSegments) > 1)
+
+	reader := wal.NewReaderFrom(nil)
+	var resumePos *ReaderPos
+	for i := 0; i < 10; i++ {
+		if i == 7 {
+			resumePos = reader.Pos()
+		}
+		ret, pos, err := reader.Next()
+		assert.Nil(t, err)
+		assert.Equal(t, data, ret)
+		assert.Equal(t, positions[i].SegmentId, pos.SegmentId)
+		assert.Equal(t, positions[i].BlockIndex, pos.BlockIndex)
+		assert.Equal(t, positions[i].BlockOffset, pos.BlockOffset)
+	}
+	_, _, err = reader.Next()
+	assert.Equal(t, io.EOF, err)
+
+	// the records written after EOF can be read
+	chunk, err := wal.Write([]byte("abc"))
+	assert.Nil(t, err)
+	ret, pos, err := reader.Next()
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("abc"), ret)
+	assert.Equal(t, chunk.BlockOffset, pos.BlockOffset)
+
+	// resume from the position of a record, or from the position of a reader
+	for _, reader := range []*Reader{wal.NewReaderFrom(positions[7]), wal.NewReaderFromPos(resumePos)} {
+		count := 0
+		for {
+			_, _, err := reader.Next()
+			if err == io.EOF {
+				break
+			}
+			assert.Nil(t, err)
+			count++
+		}
+		assert.Equal(t, 4, count)
+	}
+}
+
+func TestReader_NextStalePosition(t *testing.T) {
+	options := Options{
+		Dir:         t.TempDir(),
+		SegmentSize: DefaultBlockSize * 2,
+	}
+	wal, err := Open(options)
+	assert.Nil(t, err)
+	defer removeWal(wal)
+
+	data := []byte(strings.Repeat("x", DefaultBlockSize/2))
+	for i := 0; i < 10; i++ {
+		_, err := wal.Write(data)
+		assert.Nil(t, err)
+	}
+	assert.True(t, len(wal.olderSegments) > 1)
+
+	// a reader in the middle of the first segment and one at its start
+	reader := wal.NewReaderFrom(nil)
+	_, _, err = reader.Next()
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(1), reader.Pos().SegmentId)
+	pos := reader.Pos()
+	pos.BlockIndex, pos.BlockOffset = 0, 0
+	fresh := wal.NewReaderFromPos(pos)
+	fromChunk := wal.NewReaderFrom(&Chunk{SegmentId: 1})
+
+	// rewrite the first segment with the same id, as merge does
+	other := options
+	other.Dir = t.TempDir()
+	time.Sleep(time.Millisecond)
+	otherWal, err := Open(other)
+	assert.Nil(t, err)
+	_, err = otherWal.Write([]byte("abc"))
+	assert.Nil(t, err)
+	assert.Nil(t, otherWal.Close())
+	path := JoinSegmentPath(options.Dir, options.SegmentFileSuffix, 1)
+	assert.Nil(t, os.Rename(JoinSegmentPath(other.Dir, other.SegmentFileSuffix, 1), path))
+	assert.Nil(t, wal.ReplaceSegments([]uint32{1}))
+
+	_, _, err = reader.Next()
+	assert.Equal(t, ErrStalePosition, err)
+	_, _, err = fresh.Next()
+	assert.Equal(t, ErrStalePosition, err)
+	_, _, err = fromChunk.Next()
+	assert.Equal(t, ErrStalePosition, err)
+
+	// a position at the start of the segment goes on from the rewritten segment
+	pos.SegmentCreateTime = 0
+	ret, _, err := wal.NewReaderFromPos(pos).Next()
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("abc"), ret)
+
+	// the removed segment
+	reader = wal.NewReaderFrom(nil)
+	_, _, err = reader.Next()
+	assert.Nil(t, err)
+	assert.Nil(t, os.Remove(path))
+	assert.Nil(t, wal.ReplaceSegments([]uint32{1}))
+	_, _, err = reader.Next()
+	assert.Equal(t, ErrStalePosition, err)
+}
+
+func TestReader_NextWait(t *testing.T) {
+	wal, err := Open(Options{
+		Dir:         t.TempDir(),
+		SegmentSize: DefaultBlockSize * 2,
+	})
+	assert.Nil(t, err)
+	defer removeWal(wal)
+
+	done := make(chan []string)
+	go func() {
+		var ret []string
+		reader := wal.NewReaderFrom(nil)
+		for i := 0; i < 100; i++ {
+			data, _, err := reader.NextWait(context.Background())
+			if err != nil {
+				break
+			}
+			ret = append(ret, string(data))
+		}
+		done <- ret
+	}()
+
+	var expected []string
+	for i := 0; i < 100; i++ {
+		val := strconv.Itoa(i) + strings.Repeat("x", 1000)
+		expected = append(expected, val)
+		_, err := wal.Write([]byte(val))
+		assert.Nil(t, err)
+		if i%10 == 0 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	select {
+	case ret := <-done:
+		assert.Equal(t, expected, ret)
+	case <-time.After(5 * time.Second):
+		t.Fatal("reader is not notified")
+	}
+}
+
+func TestReader_NextWaitCanceled(t *testing.T) {
+	wal, err := Open(Options{
+		Dir:         t.TempDir(),
+		SegmentSize: DefaultBlockSize * 2,
+	})
+	assert.Nil(t, err)
+	defer removeWal(wal)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, _, err = wal.NewReaderFrom(nil).NextWait(ctx)
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	// close wakes up the reader
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		_ = wal.Close()
+	}()
+	_, _, err = wal.NewReaderFrom(nil).NextWait(context.Background())
+	assert.Equal(t, ErrWalClosed, err)
+}
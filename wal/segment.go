@@ -1,6 +1,7 @@
 package wal
 
 import (
+	"container/list"
 	"encoding/binary"
 	"errors"
 	"fmt"
@@ -10,12 +11,16 @@ import (
 	"os"
 	"path/filepath"
 	"sync"
+	"sync/atomic"
 )
 
 const (
 	// 7 Bytes： Checksum：4 Bytes； Length：2 Bytes；Type：1 Bytes
 	chunkHeaderSize = 7
-	blockSize       = 32 * KB
+	// 跨越多个 block 的记录末尾的 xxHash64 校验值
+	recordHashSize = 8
+	// chunk header 中 Length 字段的最大值，block 大于 64KB 时一个 block 中可以有多个属于同一条记录的 chunk
+	maxChunkLength = 1<<16 - 1
 
 	fileModePerm = 0644
 )
@@ -30,17 +35,44 @@ const (
 var (
 	segmentIsClosedErr = errors.New("segment file is closed")
 	invalidCRC         = errors.New("invalid crc, the data may be damaged")
+	invalidRecordHash  = errors.New("invalid record hash, the data may be damaged")
 )
 
+// IsCorruption reports whether err is returned because the data read from a segment is damaged.
+func IsCorruption(err error) bool {
+	return errors.Is(err, invalidCRC) || errors.Is(err, invalidRecordHash)
+}
+
 type segment struct {
-	id                uint32
-	fd                *os.File
+	id     uint32
+	path   string
+	fd     *os.File
+	header *segmentHeader
+	// dataOffset is the size of the header in the file, the data starts after it
+	dataOffset        int64
+	crcTable          *crc32.Table
+	blockSize         uint32
 	activeBlockIndex  uint32
 	activeBlockOffset uint32
 	closed            bool
 	headerCache       []byte
+	cache             *BlockCache
+
+	// 块缓存中 segment 的标识，每次打开 segment 时都不同，因此 merge 替换的 segment 不会读到旧的缓存
+	cacheId uint32
+
+	// 已封存的 segment 的文件描述符由 fds 按需打开和关闭，fds 为 nil 时 fd 一直保持打开
+	fds     *fdCache
+	lruElem *list.Element
+
+	// 正在读取 segment 的数量，retired 的 segment 在没有读取时关闭。fds 为 nil 时由 refMu 保护，否则由 fds 保护
+	refMu   sync.Mutex
+	refs    int
+	retired bool
 }
 
+var nextCacheId uint32
+
 type Chunk struct {
 	SegmentId   uint32
 	BlockIndex  uint32
@@ -50,12 +82,16 @@ type Chunk struct {
 
 var blockPool = sync.Pool{
 	New: func() interface{} {
-		return make([]byte, blockSize)
+		return make([]byte, DefaultBlockSize)
 	},
 }
 
-func getBuffer() []byte {
-	return blockPool.Get().([]byte)
+func getBuffer(size uint32) []byte {
+	buf := blockPool.Get().([]byte)
+	if uint32(cap(buf)) < size {
+		buf = make([]byte, size)
+	}
+	return buf[:size]
 }
 
 func putBuffer(buf []byte) {
@@ -63,25 +99,151 @@ func putBuffer(buf []byte) {
 }
 
 func openSegment(dirPath string, fileSuffix string, id uint32) (*segment, error) {
+	return openSegmentWithHeader(dirPath, fileSuffix, newSegmentHeader(id))
+}
+
+// openSegmentWithHeader opens the segment file, the header is written if the file is new, or else the header in the file is used.
+func openSegmentWithHeader(dirPath string, fileSuffix string, newHeader *segmentHeader) (*segment, error) {
+	id := newHeader.segmentId
 	path := JoinSegmentPath(dirPath, fileSuffix, id)
-	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_RDWR, fileModePerm)
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, fileModePerm)
 	if err != nil {
 		return nil, err
 	}
 
-	offset, err := file.Seek(0, io.SeekEnd)
+	fileSize, err := file.Seek(0, io.SeekEnd)
 	if err != nil {
+		_ = file.Close()
 		return nil, err
 	}
 
+	var header *segmentHeader
+	if fileSize == 0 {
+		// 新建的 segment，写入 header
+		header = newHeader
+		if _, err = file.WriteAt(header.encode(), 0); err != nil {
+			_ = file.Close()
+			return nil, err
+		}
+		fileSize = header.size()
+	} else if header, err = readSegmentHeader(file, id); err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+
+	return newSegment(path, header, file, fileSize-header.size()), nil
+}
+
+// openSealedSegment opens a read-only segment without opening its file, the file is opened on demand by fdCache.
+func openSealedSegment(dirPath string, fileSuffix string, id uint32) (*segment, error) {
+	path := JoinSegmentPath(dirPath, fileSuffix, id)
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+
+	header, err := readSegmentHeader(file, id)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	return newSegment(path, header, nil, info.Size()-header.size()), nil
+}
+
+// openSegmentReadOnly opens the segment file read-only and keeps it open, the size is the size of the file.
+func openSegmentReadOnly(dirPath string, fileSuffix string, id uint32) (*segment, error) {
+	path := JoinSegmentPath(dirPath, fileSuffix, id)
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	header, err := readSegmentHeader(file, id)
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+
+	return newSegment(path, header, file, info.Size()-header.size()), nil
+}
+
+// newSegment creates a segment whose data size is at most size, the real size of a preallocated segment is found by recoverSize.
+func newSegment(path string, header *segmentHeader, fd *os.File, size int64) *segment {
 	return &segment{
-		id:                id,
-		fd:                file,
-		activeBlockIndex:  uint32(offset / blockSize),
-		activeBlockOffset: uint32(offset % blockSize),
+		id:                header.segmentId,
+		path:              path,
+		fd:                fd,
+		header:            header,
+		dataOffset:        header.size(),
+		crcTable:          header.checksumType.table(),
+		blockSize:         header.blockSize,
+		cacheId:           atomic.AddUint32(&nextCacheId, 1),
+		activeBlockIndex:  uint32(size / int64(header.blockSize)),
+		activeBlockOffset: uint32(size % int64(header.blockSize)),
 		closed:            false,
 		headerCache:       make([]byte, chunkHeaderSize),
-	}, nil
+	}
+}
+
+// preallocate reserves the disk space of the segment file, it does not change the data of the segment.
+func (seg *segment) preallocate(size int64) error {
+	if seg.closed {
+		return segmentIsClosedErr
+	}
+	return preallocate(seg.fd, size)
+}
+
+// recoverSize scans the chunks of the segment to find the end of the data, the space after it is zero filled by preallocation.
+// The data ends before a record whose last chunks are not written, which is left by a crash during the write.
+// If tornTail is true, the data also ends before a record that fails the check, which may be being written.
+func (seg *segment) recoverSize(tornTail bool) error {
+	var blockIndex, blockOffset uint32
+	for {
+		_, _, next, err := seg.doRead(blockIndex, blockOffset)
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			if err == io.ErrUnexpectedEOF || (tornTail && (err == invalidCRC || err == invalidRecordHash)) {
+				// the size of the file is the end of a block written partially, so the end must be moved back
+				seg.activeBlockIndex = blockIndex
+				seg.activeBlockOffset = blockOffset
+				return nil
+			}
+			return err
+		}
+		blockIndex, blockOffset = next.BlockIndex, next.BlockOffset
+	}
+
+	// the end of the last chunk may be moved to the next block when the rest of the block is padding,
+	// which can be beyond the end of a file that is not preallocated
+	if int64(blockIndex)*int64(seg.blockSize)+int64(blockOffset) < seg.Size() {
+		seg.activeBlockIndex = blockIndex
+		seg.activeBlockOffset = blockOffset
+	}
+	return nil
+}
+
+// truncate releases the preallocated space after the data, it is called when the segment is sealed.
+func (seg *segment) truncate() error {
+	if seg.closed {
+		return segmentIsClosedErr
+	}
+	return seg.fd.Truncate(seg.dataOffset + seg.Size())
 }
 
 func JoinSegmentPath(dir string, fileSuffix string, id uint32) string {
@@ -102,11 +264,12 @@ func (seg *segment) Write(data []byte) (*Chunk, error) {
 	var chunk *Chunk
 	var err error
 
+	offset := seg.Size()
 	if chunk, err = seg.writeToBuffer(data, buffer); err != nil {
 		return nil, err
 	}
 
-	if err = seg.writeToSegment(buffer); err != nil {
+	if err = seg.writeToSegment(buffer, offset); err != nil {
 		return nil, err
 	}
 
@@ -118,6 +281,8 @@ func (seg *segment) writeToBuffer(data []byte, buffer *bytebufferpool.ByteBuffer
 		return nil, segmentIsClosedErr
 	}
 
+	blockSize := seg.blockSize
+
 	// 如果当前 block 不能放下一个 chunk header, 添加 padding
 	if chunkHeaderSize+seg.activeBlockOffset >= blockSize && seg.activeBlockOffset < blockSize {
 		p := make([]byte, blockSize-seg.activeBlockOffset)
@@ -135,41 +300,52 @@ func (seg *segment) writeToBuffer(data []byte, buffer *bytebufferpool.ByteBuffer
 	}
 
 	dataSize := uint32(len(data))
-	if seg.activeBlockOffset+dataSize+chunkHeaderSize <= blockSize {
+	if seg.activeBlockOffset+dataSize+chunkHeaderSize <= blockSize && dataSize <= maxChunkLength {
 		// 当前 block 能放下整个 chunk
 		seg.fillBuffer(buffer, data, chunkTypeFull)
 		chunk.Size = dataSize + chunkHeaderSize
 	} else {
-		// 当前 block 不能放下整个 chunk，使用多个 block 存储
-		var chunkCount uint32 = 0
-		start := 0
-		remaining := len(data)
-		offset := (int)(seg.activeBlockOffset)
+		if seg.header.flags&flagRecordHash != 0 {
+			data = appendRecordHash(data)
+			dataSize = uint32(len(data))
+		}
+
+		// 当前 block 不能放下整个 chunk，使用多个 chunk 存储
+		var start, size uint32
+		offset := seg.activeBlockOffset
 
-		for remaining > 0 {
-			free := blockSize - offset
+		for start < dataSize {
+			end := start + (blockSize - offset - chunkHeaderSize)
+			if end-start > maxChunkLength {
+				end = start + maxChunkLength
+			}
+			if end > dataSize {
+				end = dataSize
+			}
 
 			var chunkType byte
 			switch {
 			case start == 0:
 				chunkType = chunkTypeStart
-			case free < chunkHeaderSize+remaining:
+			case end < dataSize:
 				chunkType = chunkTypeMiddle
 			default:
 				chunkType = chunkTypeEnd
 			}
 
-			end := start + (free - chunkHeaderSize)
-			if end > len(data) {
-				end = len(data)
-			}
 			seg.fillBuffer(buffer, data[start:end], chunkType)
-			chunkCount++
+			offset += chunkHeaderSize + end - start
+			size += chunkHeaderSize + end - start
 			start = end
-			offset = (offset + free) % blockSize
-			remaining = int(dataSize) - start
+
+			// 下一个 chunk 紧跟在后面，block 剩余的空间放不下 chunk header 时添加 padding
+			if start < dataSize && offset+chunkHeaderSize >= blockSize {
+				buffer.B = append(buffer.B, make([]byte, blockSize-offset)...)
+				size += blockSize - offset
+				offset = 0
+			}
 		}
-		chunk.Size = chunkCount*chunkHeaderSize + dataSize
+		chunk.Size = size
 	}
 
 	seg.activeBlockOffset += chunk.Size
@@ -181,8 +357,8 @@ func (seg *segment) writeToBuffer(data []byte, buffer *bytebufferpool.ByteBuffer
 	return chunk, nil
 }
 
-func (seg *segment) writeToSegment(buffer *bytebufferpool.ByteBuffer) error {
-	if _, err := seg.fd.Write(buffer.B); err != nil {
+func (seg *segment) writeToSegment(buffer *bytebufferpool.ByteBuffer, offset int64) error {
+	if _, err := seg.fd.WriteAt(buffer.B, seg.dataOffset+offset); err != nil {
 		return err
 	}
 	return nil
@@ -196,28 +372,33 @@ func (seg *segment) Sync() error {
 }
 
 func (seg *segment) Read(blockIndex uint32, offset uint32) ([]byte, error) {
-	data, _, err := seg.doRead(blockIndex, offset)
+	data, _, _, err := seg.doRead(blockIndex, offset)
 	return data, err
 }
 
-func (seg *segment) doRead(blockIndex uint32, offset uint32) ([]byte, *Chunk, error) {
-	if seg.closed {
-		return nil, nil, segmentIsClosedErr
+// doRead reads the record at the position, it returns the record, the bytes it takes in the segment like Chunk.Size
+// of a written record, and the position of the next record.
+func (seg *segment) doRead(blockIndex uint32, offset uint32) ([]byte, uint32, *Chunk, error) {
+	if err := seg.acquire(); err != nil {
+		return nil, 0, nil, err
 	}
+	defer seg.release()
 
-	block := getBuffer()
-	if len(block) != blockSize {
-		block = make([]byte, blockSize)
-	}
-	defer putBuffer(block)
+	blockSize := int64(seg.blockSize)
+	buffer := getBuffer(seg.blockSize)
+	defer putBuffer(buffer)
 
 	var data []byte
+	var recordSize uint32
+	var block []byte
+	var firstChunkType byte
+	loadedBlockIndex := -1
 	nextChunk := &Chunk{
 		SegmentId: seg.id,
 	}
 
 	for {
-		size := int64(blockSize)
+		size := blockSize
 		segSize := seg.Size()
 		blockOffset := int64(blockIndex) * blockSize
 
@@ -227,11 +408,15 @@ func (seg *segment) doRead(blockIndex uint32, offset uint32) ([]byte, *Chunk, er
 		}
 
 		if (int64)(offset) >= size {
-			return nil, nil, io.EOF
+			return nil, 0, nil, io.EOF
 		}
 
-		if _, err := seg.fd.ReadAt(block[0:size], blockOffset); err != nil {
-			return nil, nil, err
+		if loadedBlockIndex != int(blockIndex) {
+			var err error
+			if block, err = seg.readBlock(blockIndex, buffer[0:size]); err != nil {
+				return nil, 0, nil, err
+			}
+			loadedBlockIndex = int(blockIndex)
 		}
 
 		header := block[offset : offset+chunkHeaderSize]
@@ -240,14 +425,30 @@ func (seg *segment) doRead(blockIndex uint32, offset uint32) ([]byte, *Chunk, er
 		length := binary.LittleEndian.Uint16(header[4:6])
 		chunkType := header[6]
 
+		// 预分配的空间被 0 填充，全 0 的 chunk header 表示数据的结尾
+		if savedChecksum == 0 && length == 0 && chunkType == 0 {
+			if len(data) == 0 {
+				return nil, 0, nil, io.EOF
+			}
+			return nil, 0, nil, io.ErrUnexpectedEOF
+		}
+
 		dataStart := (int64)(offset) + chunkHeaderSize
 		dataEnd := dataStart + int64(length)
-		checksum := crc32.ChecksumIEEE(block[offset+4 : dataEnd])
+		if dataEnd > int64(len(block)) {
+			return nil, 0, nil, invalidCRC
+		}
+
+		checksum := crc32.Checksum(block[offset+4:dataEnd], seg.crcTable)
 		if checksum != savedChecksum {
-			return nil, nil, invalidCRC
+			return nil, 0, nil, invalidCRC
 		}
 
+		if len(data) == 0 {
+			firstChunkType = chunkType
+		}
 		data = append(data, block[dataStart:dataEnd]...)
+		recordSize += chunkHeaderSize + uint32(length)
 		if chunkType == chunkTypeFull || chunkType == chunkTypeEnd {
 			nextChunk.BlockIndex = blockIndex
 			nextChunk.BlockOffset = uint32(dataEnd)
@@ -257,19 +458,82 @@ func (seg *segment) doRead(blockIndex uint32, offset uint32) ([]byte, *Chunk, er
 			}
 			break
 		}
-		blockIndex++
-		offset = 0
+
+		// 下一个 chunk 在当前 block 中，或者在下一个 block 的开头
+		if dataEnd+chunkHeaderSize >= blockSize {
+			recordSize += uint32(blockSize - dataEnd)
+			blockIndex++
+			offset = 0
+		} else {
+			offset = uint32(dataEnd)
+		}
 	}
 
-	return data, nextChunk, nil
+	if firstChunkType == chunkTypeStart && seg.header.flags&flagRecordHash != 0 {
+		var ok bool
+		if data, ok = verifyRecordHash(data); !ok {
+			return nil, 0, nil, invalidRecordHash
+		}
+	}
+	return data, recordSize, nextChunk, nil
+}
+
+// appendRecordHash returns a copy of data followed by its xxHash64, data is not modified.
+func appendRecordHash(data []byte) []byte {
+	ret := make([]byte, len(data)+recordHashSize)
+	copy(ret, data)
+	binary.LittleEndian.PutUint64(ret[len(data):], xxhash64(data))
+	return ret
+}
+
+func verifyRecordHash(data []byte) ([]byte, bool) {
+	if len(data) < recordHashSize {
+		return nil, false
+	}
+
+	n := len(data) - recordHashSize
+	if binary.LittleEndian.Uint64(data[n:]) != xxhash64(data[:n]) {
+		return nil, false
+	}
+	return data[:n], true
+}
+
+// readBlock reads a block into buf, blocks which are completely written are immutable and served from the cache.
+func (seg *segment) readBlock(blockIndex uint32, buf []byte) ([]byte, error) {
+	sealed := len(buf) == int(seg.blockSize) && seg.cache != nil
+	if sealed {
+		if block, ok := seg.cache.Get(seg.cacheId, blockIndex); ok {
+			return block, nil
+		}
+		// the cache keeps the block, so it can not be a pooled buffer
+		buf = make([]byte, seg.blockSize)
+	}
+
+	if _, err := seg.fd.ReadAt(buf, seg.dataOffset+int64(blockIndex)*int64(seg.blockSize)); err != nil {
+		return nil, err
+	}
+
+	if sealed {
+		seg.cache.Put(seg.cacheId, blockIndex, buf)
+	}
+	return buf, nil
 }
 
 func (seg *segment) calMaxRequiredCapacity(dataSize int) int {
-	return chunkHeaderSize + (dataSize/blockSize+1)*chunkHeaderSize + dataSize
+	if seg.header.flags&flagRecordHash != 0 {
+		dataSize += recordHashSize
+	}
+
+	blockSize := int(seg.blockSize)
+	if blockSize-chunkHeaderSize <= maxChunkLength {
+		return chunkHeaderSize + (dataSize/blockSize+1)*chunkHeaderSize + dataSize
+	}
+	// 大 block 中的每个 chunk 受 Length 字段限制，之后可能还有 padding
+	return chunkHeaderSize + (dataSize/maxChunkLength+2)*chunkHeaderSize*2 + dataSize
 }
 
 func (seg *segment) Size() int64 {
-	size := int64(seg.activeBlockIndex) * int64(blockSize)
+	size := int64(seg.activeBlockIndex) * int64(seg.blockSize)
 	return size + int64(seg.activeBlockOffset)
 }
 
@@ -277,8 +541,8 @@ func (seg *segment) fillBuffer(buffer *bytebufferpool.ByteBuffer, data []byte, c
 	seg.headerCache[6] = chunkType
 	binary.LittleEndian.PutUint16(seg.headerCache[4:6], uint16(len(data)))
 
-	sum := crc32.ChecksumIEEE(seg.headerCache[4:])
-	sum = crc32.Update(sum, crc32.IEEETable, data)
+	sum := crc32.Checksum(seg.headerCache[4:], seg.crcTable)
+	sum = crc32.Update(sum, seg.crcTable, data)
 	binary.LittleEndian.PutUint32(seg.headerCache[0:4], sum)
 
 	buffer.B = append(buffer.B, seg.headerCache...)
@@ -292,13 +556,77 @@ func (seg *segment) Remove() error {
 		}
 	}
 
-	return os.Remove(seg.fd.Name())
+	return os.Remove(seg.path)
 }
 
 func (seg *segment) Close() error {
+	if seg.cache != nil {
+		seg.cache.RemoveSegment(seg.cacheId)
+	}
+
+	if seg.fds != nil {
+		return seg.fds.close(seg)
+	}
+
+	seg.refMu.Lock()
+	defer seg.refMu.Unlock()
+
 	if !seg.closed {
 		seg.closed = true
 		return seg.fd.Close()
 	}
 	return nil
 }
+
+// acquire prevents the segment from being closed by retire until it is released.
+func (seg *segment) acquire() error {
+	if seg.fds != nil {
+		return seg.fds.acquire(seg)
+	}
+
+	seg.refMu.Lock()
+	defer seg.refMu.Unlock()
+
+	if seg.closed {
+		return segmentIsClosedErr
+	}
+	seg.refs++
+	return nil
+}
+
+func (seg *segment) release() {
+	if seg.fds != nil {
+		seg.fds.release(seg)
+		return
+	}
+
+	seg.refMu.Lock()
+	defer seg.refMu.Unlock()
+
+	seg.refs--
+	if seg.retired && seg.refs == 0 && !seg.closed {
+		seg.closed = true
+		_ = seg.fd.Close()
+	}
+}
+
+// retire closes the segment once no reader uses it, it is used when the file of the segment is replaced.
+func (seg *segment) retire() error {
+	if seg.cache != nil {
+		seg.cache.RemoveSegment(seg.cacheId)
+	}
+
+	if seg.fds != nil {
+		return seg.fds.retire(seg)
+	}
+
+	seg.refMu.Lock()
+	defer seg.refMu.Unlock()
+
+	seg.retired = true
+	if seg.refs > 0 || seg.closed {
+		return nil
+	}
+	seg.closed = true
+	return seg.fd.Close()
+}
@@ -33,7 +33,7 @@ func TestSegment_WriteFull(t *testing.T) {
 	}()
 
 	// write full
-	val := []byte(strings.Repeat("a", blockSize-chunkHeaderSize))
+	val := []byte(strings.Repeat("a", DefaultBlockSize-chunkHeaderSize))
 	chunk, err := segment.Write(val)
 	assert.Nil(t, err)
 	assert.Equal(t, uint32(0), chunk.BlockIndex)
@@ -51,7 +51,7 @@ func TestSegment_WritePadding(t *testing.T) {
 		_ = segment.Remove()
 	}()
 
-	val := []byte(strings.Repeat("a", blockSize-chunkHeaderSize-5))
+	val := []byte(strings.Repeat("a", DefaultBlockSize-chunkHeaderSize-5))
 	chunk, err := segment.Write(val)
 	assert.Equal(t, uint32(0), chunk.BlockIndex)
 	assert.Nil(t, err)
@@ -68,7 +68,7 @@ func TestSegment_WriteCrossBlock(t *testing.T) {
 		_ = segment.Remove()
 	}()
 
-	val := []byte(strings.Repeat("a", blockSize-chunkHeaderSize*2-1))
+	val := []byte(strings.Repeat("a", DefaultBlockSize-chunkHeaderSize*2-1))
 	_, err := segment.Write(val)
 	assert.Nil(t, err)
 
@@ -89,11 +89,11 @@ func TestSegment_WriteCrossBlock2(t *testing.T) {
 		_ = segment.Remove()
 	}()
 
-	val := []byte(strings.Repeat("a", blockSize-100))
+	val := []byte(strings.Repeat("a", DefaultBlockSize-100))
 	_, err := segment.Write(val)
 	assert.Nil(t, err)
 
-	val2 := []byte(strings.Repeat("z", (blockSize-chunkHeaderSize)*3))
+	val2 := []byte(strings.Repeat("z", (DefaultBlockSize-chunkHeaderSize)*3))
 	chunk2, err2 := segment.Write(val2)
 
 	assert.Nil(t, err2)
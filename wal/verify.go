@@ -0,0 +1,242 @@
+package wal
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"time"
+)
+
+var (
+	ErrChunkSequence = errors.New("invalid chunk type sequence")
+	ErrTornRecord    = errors.New("the record is not completely written")
+)
+
+// ChunkError is a damage found by VerifySegment at the position of a chunk.
+type ChunkError struct {
+	SegmentId   uint32
+	BlockIndex  uint32
+	BlockOffset uint32
+	Err         error
+}
+
+func (e *ChunkError) Error() string {
+	return fmt.Sprintf("segment %d block %d offset %d: %v", e.SegmentId, e.BlockIndex, e.BlockOffset, e.Err)
+}
+
+func (e *ChunkError) Unwrap() error {
+	return e.Err
+}
+
+// VerifySegment reads every chunk of the segment file without opening a Wal, fn is called with the records
+// which are read completely. The damages are returned in order, the rest of the block after a damaged chunk
+// is skipped, since the chunks in it can not be found. An error is returned if the file can not be read.
+func VerifySegment(dir string, fileSuffix string, id uint32, fn func(data []byte, pos *Chunk)) ([]*ChunkError, error) {
+	seg, err := openSegmentReadOnly(dir, fileSuffix, id)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = seg.Close()
+	}()
+
+	v := &segmentVerifier{seg: seg, fn: fn}
+	err = v.run()
+	return v.errs, err
+}
+
+// SegmentInfo is the header of a segment file.
+type SegmentInfo struct {
+	Id         uint32
+	Version    uint16
+	Checksum   ChecksumType
+	BlockSize  uint32
+	RecordHash bool
+	CreateTime time.Time
+	// Size is the size of the file without the header.
+	Size int64
+}
+
+// ChunkInfo is a chunk read by ScanChunks, Valid is false if its checksum does not match the data.
+type ChunkInfo struct {
+	BlockIndex  uint32
+	BlockOffset uint32
+	Type        string
+	Length      uint16
+	Valid       bool
+}
+
+var chunkTypeNames = []string{"full", "start", "middle", "end"}
+
+// ScanChunks reads the chunks of the segment file in order like VerifySegment, and calls fn for each of them.
+func ScanChunks(dir string, fileSuffix string, id uint32, fn func(chunk *ChunkInfo)) (*SegmentInfo, []*ChunkError, error) {
+	seg, err := openSegmentReadOnly(dir, fileSuffix, id)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer func() {
+		_ = seg.Close()
+	}()
+
+	v := &segmentVerifier{seg: seg, chunkFn: fn}
+	err = v.run()
+	return seg.info(), v.errs, err
+}
+
+// ReadSegmentInfo reads the header of the segment file.
+func ReadSegmentInfo(dir string, fileSuffix string, id uint32) (*SegmentInfo, error) {
+	seg, err := openSegmentReadOnly(dir, fileSuffix, id)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = seg.Close()
+	}()
+
+	return seg.info(), nil
+}
+
+func (seg *segment) info() *SegmentInfo {
+	return &SegmentInfo{
+		Id:         seg.id,
+		Version:    seg.header.version,
+		Checksum:   seg.header.checksumType,
+		BlockSize:  seg.blockSize,
+		RecordHash: seg.header.flags&flagRecordHash != 0,
+		CreateTime: time.Unix(0, seg.header.createTime),
+		Size:       seg.Size(),
+	}
+}
+
+type segmentVerifier struct {
+	seg     *segment
+	fn      func(data []byte, pos *Chunk)
+	chunkFn func(chunk *ChunkInfo)
+	errs    []*ChunkError
+
+	// the record being read, start is nil if no record is being read
+	start      *Chunk
+	data       []byte
+	firstChunk byte
+	// skip drops the rest of a damaged record, the chunks after the damage in its block can not be found
+	skip bool
+}
+
+func (v *segmentVerifier) run() error {
+	blockSize := int64(v.seg.blockSize)
+	size := v.seg.Size()
+	buf := make([]byte, blockSize)
+
+	for blockIndex := uint32(0); int64(blockIndex)*blockSize < size; blockIndex++ {
+		blockStart := int64(blockIndex) * blockSize
+		block := buf
+		if blockStart+blockSize > size {
+			block = buf[:size-blockStart]
+		}
+		if _, err := v.seg.fd.ReadAt(block, v.seg.dataOffset+blockStart); err != nil {
+			return err
+		}
+
+		if v.verifyBlock(blockIndex, block) {
+			break
+		}
+	}
+
+	if v.start != nil {
+		v.fail(v.start.BlockIndex, v.start.BlockOffset, ErrTornRecord)
+	}
+	return nil
+}
+
+// verifyBlock verifies the chunks of a block, it returns true if the block is the end of the data.
+func (v *segmentVerifier) verifyBlock(blockIndex uint32, block []byte) bool {
+	blockSize := int64(v.seg.blockSize)
+	for offset := int64(0); offset+chunkHeaderSize <= int64(len(block)); {
+		header := block[offset : offset+chunkHeaderSize]
+		savedChecksum := binary.LittleEndian.Uint32(header[0:4])
+		length := int64(binary.LittleEndian.Uint16(header[4:6]))
+		chunkType := header[6]
+
+		// 预分配的空间被 0 填充，全 0 的 chunk header 表示数据的结尾
+		if savedChecksum == 0 && length == 0 && chunkType == 0 {
+			return true
+		}
+
+		dataEnd := offset + chunkHeaderSize + length
+		valid := dataEnd <= int64(len(block)) && crc32.Checksum(block[offset+4:dataEnd], v.seg.crcTable) == savedChecksum
+		if v.chunkFn != nil {
+			typeName := fmt.Sprintf("unknown(%d)", chunkType)
+			if int(chunkType) < len(chunkTypeNames) {
+				typeName = chunkTypeNames[chunkType]
+			}
+			v.chunkFn(&ChunkInfo{BlockIndex: blockIndex, BlockOffset: uint32(offset), Type: typeName, Length: uint16(length), Valid: valid})
+		}
+		if !valid {
+			v.fail(blockIndex, uint32(offset), invalidCRC)
+			v.start = nil
+			v.skip = true
+			return false
+		}
+
+		v.verifyChunk(blockIndex, uint32(offset), chunkType, block[offset+chunkHeaderSize:dataEnd])
+
+		offset = dataEnd
+		if offset+chunkHeaderSize >= blockSize {
+			if v.start != nil {
+				v.start.Size += uint32(blockSize - offset)
+			}
+			break
+		}
+	}
+	return false
+}
+
+func (v *segmentVerifier) verifyChunk(blockIndex uint32, offset uint32, chunkType byte, data []byte) {
+	switch chunkType {
+	case chunkTypeFull, chunkTypeStart:
+		if v.start != nil {
+			v.fail(v.start.BlockIndex, v.start.BlockOffset, ErrTornRecord)
+		}
+		v.skip = false
+		v.start = &Chunk{SegmentId: v.seg.id, BlockIndex: blockIndex, BlockOffset: offset}
+		v.data = nil
+		v.firstChunk = chunkType
+	case chunkTypeMiddle, chunkTypeEnd:
+		if v.start == nil {
+			if !v.skip {
+				v.fail(blockIndex, offset, ErrChunkSequence)
+			}
+			return
+		}
+	default:
+		v.fail(blockIndex, offset, fmt.Errorf("unknown chunk type %d", chunkType))
+		v.start = nil
+		v.skip = true
+		return
+	}
+
+	v.data = append(v.data, data...)
+	v.start.Size += chunkHeaderSize + uint32(len(data))
+	if chunkType != chunkTypeFull && chunkType != chunkTypeEnd {
+		return
+	}
+
+	record := v.data
+	if v.firstChunk == chunkTypeStart && v.seg.header.flags&flagRecordHash != 0 {
+		var ok bool
+		if record, ok = verifyRecordHash(record); !ok {
+			v.fail(v.start.BlockIndex, v.start.BlockOffset, invalidRecordHash)
+			v.start = nil
+			return
+		}
+	}
+	if v.fn != nil {
+		v.fn(record, v.start)
+	}
+	v.start = nil
+}
+
+func (v *segmentVerifier) fail(blockIndex uint32, offset uint32, err error) {
+	v.errs = append(v.errs, &ChunkError{SegmentId: v.seg.id, BlockIndex: blockIndex, BlockOffset: offset, Err: err})
+}
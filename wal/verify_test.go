@@ -0,0 +1,78 @@
+package wal
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+func TestVerifySegment(t *testing.T) {
+	dir := t.TempDir()
+	wal, err := Open(Options{Dir: dir, SegmentSize: 32 * MB, SegmentFileSuffix: SegmentSuffix, Preallocate: true, RecordHash: true, BlockSize: MinBlockSize})
+	assert.Nil(t, err)
+
+	var positions []*Chunk
+	for i := 0; i < 100; i++ {
+		data := []byte(strings.Repeat("x", i*97))
+		pos, err := wal.Write(data)
+		assert.Nil(t, err)
+		positions = append(positions, pos)
+	}
+	assert.Nil(t, wal.Close())
+
+	var read []*Chunk
+	errs, err := VerifySegment(dir, SegmentSuffix, 1, func(data []byte, pos *Chunk) {
+		assert.Equal(t, len(read)*97, len(data))
+		read = append(read, pos)
+	})
+	assert.Nil(t, err)
+	assert.Empty(t, errs)
+	assert.Equal(t, positions, read)
+
+	// the records in the blocks after the damaged one are read
+	seg, err := openSegment(dir, SegmentSuffix, 1)
+	assert.Nil(t, err)
+	_, err = seg.fd.WriteAt([]byte{0xff}, segmentHeaderSize+int64(positions[10].BlockIndex)*MinBlockSize+int64(positions[10].BlockOffset)+chunkHeaderSize)
+	assert.Nil(t, err)
+	assert.Nil(t, seg.Close())
+
+	read = nil
+	errs, err = VerifySegment(dir, SegmentSuffix, 1, func(data []byte, pos *Chunk) {
+		read = append(read, pos)
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(errs))
+	assert.Equal(t, positions[10].BlockIndex, errs[0].BlockIndex)
+	assert.Equal(t, positions[10].BlockOffset, errs[0].BlockOffset)
+	assert.True(t, errors.Is(errs[0], invalidCRC))
+	assert.Equal(t, positions[len(positions)-1], read[len(read)-1])
+	assert.True(t, len(read) < len(positions)-1)
+
+	_, err = VerifySegment(dir, SegmentSuffix, 2, nil)
+	assert.NotNil(t, err)
+}
+
+func TestScanChunks(t *testing.T) {
+	dir := t.TempDir()
+	wal, err := Open(Options{Dir: dir, SegmentSize: 32 * MB, SegmentFileSuffix: SegmentSuffix, BlockSize: MinBlockSize})
+	assert.Nil(t, err)
+	_, err = wal.Write([]byte("hello"))
+	assert.Nil(t, err)
+	_, err = wal.Write([]byte(strings.Repeat("x", MinBlockSize)))
+	assert.Nil(t, err)
+	assert.Nil(t, wal.Close())
+
+	var chunks []*ChunkInfo
+	info, errs, err := ScanChunks(dir, SegmentSuffix, 1, func(chunk *ChunkInfo) {
+		chunks = append(chunks, chunk)
+	})
+	assert.Nil(t, err)
+	assert.Empty(t, errs)
+	assert.Equal(t, uint32(1), info.Id)
+	assert.Equal(t, uint32(MinBlockSize), info.BlockSize)
+	assert.Equal(t, 3, len(chunks))
+	assert.Equal(t, &ChunkInfo{BlockIndex: 0, BlockOffset: 0, Type: "full", Length: 5, Valid: true}, chunks[0])
+	assert.Equal(t, "start", chunks[1].Type)
+	assert.Equal(t, &ChunkInfo{BlockIndex: 1, BlockOffset: 0, Type: "end", Length: chunks[2].Length, Valid: true}, chunks[2])
+}
@@ -3,18 +3,28 @@ package wal
 import (
 	"errors"
 	"fmt"
+	"github.com/valyala/bytebufferpool"
 	"io"
 	"os"
 	"sort"
 	"sync"
+	"time"
 )
 
+var ErrReadOnly = errors.New("wal is read-only")
+
 type Wal struct {
 	options       Options
 	activeSegment *segment
 	olderSegments map[int]*segment
+	fds           *fdCache
 	mu            sync.RWMutex
 	byteWritten   uint32
+	closed        bool
+
+	// notify 在有新记录写入时被关闭，用于唤醒等待的 Reader
+	notifyMu sync.Mutex
+	notify   chan struct{}
 }
 
 type Iterator struct {
@@ -52,6 +62,21 @@ func (wal *Wal) NewIteratorLessEqual(maxId uint32) *Iterator {
 	}
 }
 
+// NewSegmentIterator creates an iterator of the records in the segment with the given id.
+func (wal *Wal) NewSegmentIterator(id uint32) (*Iterator, error) {
+	wal.mu.RLock()
+	defer wal.mu.RUnlock()
+
+	seg := wal.olderSegments[int(id)]
+	if id == wal.activeSegment.id {
+		seg = wal.activeSegment
+	}
+	if seg == nil {
+		return nil, fmt.Errorf("inexistent segment: %d", id)
+	}
+	return &Iterator{segments: []*segment{seg}}, nil
+}
+
 func (iter *Iterator) SkipSegmentLessEqual(id uint32) {
 	if iter.segmentIdx != 0 {
 		return
@@ -76,7 +101,7 @@ func (iter *Iterator) Next() ([]byte, *Chunk, error) {
 	}
 
 	segment := iter.segments[iter.segmentIdx]
-	data, next, err := segment.doRead(iter.nextBlockIdx, iter.nextBlockOffset)
+	data, size, next, err := segment.doRead(iter.nextBlockIdx, iter.nextBlockOffset)
 	if err != nil {
 		if err != io.EOF {
 			return nil, nil, err
@@ -89,20 +114,31 @@ func (iter *Iterator) Next() ([]byte, *Chunk, error) {
 	}
 
 	pos.SegmentId = segment.id
-	pos.Size = uint32(len(data))
+	pos.Size = size
 	iter.nextBlockIdx = next.BlockIndex
 	iter.nextBlockOffset = next.BlockOffset
 	return data, pos, err
 }
 
 func Open(options Options) (*Wal, error) {
-	if err := os.MkdirAll(options.Dir, os.ModePerm); err != nil {
+	if options.BlockSize == 0 {
+		options.BlockSize = DefaultBlockSize
+	}
+	if options.BlockSize < MinBlockSize || options.BlockSize > MaxBlockSize {
+		return nil, fmt.Errorf("block size must be between %d and %d", MinBlockSize, MaxBlockSize)
+	}
+
+	if options.ReadOnly {
+		options.MaxOpenSegments = 0
+		options.Preallocate = false
+	} else if err := os.MkdirAll(options.Dir, os.ModePerm); err != nil {
 		return nil, err
 	}
 
 	wal := &Wal{
 		options:       options,
 		olderSegments: make(map[int]*segment),
+		fds:           newFdCache(options.MaxOpenSegments),
 	}
 
 	if err := initSegments(wal); err != nil {
@@ -112,39 +148,57 @@ func Open(options Options) (*Wal, error) {
 	return wal, nil
 }
 
-func initSegments(wal *Wal) error {
-	options := wal.options
-	entries, err := os.ReadDir(options.Dir)
+// listSegmentIds returns the ids of the segment files in the directory in ascending order.
+func listSegmentIds(dir string, fileSuffix string) ([]int, error) {
+	entries, err := os.ReadDir(dir)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	var ids []int
 	for _, entry := range entries {
 		var id int
-		if _, err := fmt.Sscanf(entry.Name(), "%d"+wal.options.SegmentFileSuffix, &id); err != nil {
+		if _, err := fmt.Sscanf(entry.Name(), "%d"+fileSuffix, &id); err != nil {
 			continue
 		}
 		ids = append(ids, id)
 	}
+	sort.Ints(ids)
+	return ids, nil
+}
+
+func initSegments(wal *Wal) error {
+	ids, err := listSegmentIds(wal.options.Dir, wal.options.SegmentFileSuffix)
+	if err != nil {
+		return err
+	}
 
 	if len(ids) == 0 {
-		firstSegment, err := openSegment(options.Dir, options.SegmentFileSuffix, 1)
+		if wal.options.ReadOnly {
+			return fmt.Errorf("no segment in %s", wal.options.Dir)
+		}
+		firstId := wal.options.FirstSegmentId
+		if firstId == 0 {
+			firstId = 1
+		}
+		firstSegment, err := wal.createSegment(firstId)
 		if err != nil {
 			return err
 		}
 		wal.activeSegment = firstSegment
 	} else {
-		sort.Ints(ids)
 		for i, id := range ids {
-			segment, err := openSegment(options.Dir, options.SegmentFileSuffix, uint32(id))
-			if err != nil {
-				return err
-			}
-
 			if i == len(ids)-1 {
+				segment, err := wal.openActiveSegment(uint32(id))
+				if err != nil {
+					return err
+				}
 				wal.activeSegment = segment
 			} else {
+				segment, err := wal.openOlderSegment(uint32(id))
+				if err != nil {
+					return err
+				}
 				wal.olderSegments[id] = segment
 			}
 		}
@@ -152,19 +206,108 @@ func initSegments(wal *Wal) error {
 	return nil
 }
 
+func (wal *Wal) newSegmentHeader(id uint32) *segmentHeader {
+	header := newSegmentHeader(id)
+	header.checksumType = wal.options.Checksum
+	header.blockSize = wal.options.BlockSize
+	if wal.options.RecordHash {
+		header.flags |= flagRecordHash
+	}
+	return header
+}
+
+func (wal *Wal) createSegment(id uint32) (*segment, error) {
+	seg, err := openSegmentWithHeader(wal.options.Dir, wal.options.SegmentFileSuffix, wal.newSegmentHeader(id))
+	if err != nil {
+		return nil, err
+	}
+
+	if wal.options.Preallocate {
+		if err = seg.preallocate(wal.options.SegmentSize); err != nil {
+			_ = seg.Close()
+			return nil, err
+		}
+	}
+	seg.cache = wal.options.BlockCache
+	return seg, nil
+}
+
+func (wal *Wal) openActiveSegment(id uint32) (*segment, error) {
+	var seg *segment
+	var err error
+	if wal.options.ReadOnly {
+		seg, err = openSegmentReadOnly(wal.options.Dir, wal.options.SegmentFileSuffix, id)
+	} else {
+		seg, err = openSegmentWithHeader(wal.options.Dir, wal.options.SegmentFileSuffix, wal.newSegmentHeader(id))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// the cache must not be set before the real size is known, or the unwritten blocks would be cached.
+	// The writer may be writing the last record when the segment is opened read-only, it is not a damage.
+	fileSize := seg.Size()
+	if err = seg.recoverSize(wal.options.ReadOnly); err != nil {
+		_ = seg.Close()
+		return nil, err
+	}
+	// 崩溃时未写完的记录留在数据之后，截断后新的记录不会和它的残留混在一起
+	if !wal.options.ReadOnly && seg.Size() < fileSize {
+		if err = seg.truncate(); err != nil {
+			_ = seg.Close()
+			return nil, err
+		}
+	}
+
+	// the segments without header are never preallocated, since the old versions read the whole file as data
+	if wal.options.Preallocate && seg.header.version > 0 {
+		if err = seg.preallocate(wal.options.SegmentSize); err != nil {
+			_ = seg.Close()
+			return nil, err
+		}
+	}
+	seg.cache = wal.options.BlockCache
+	return seg, nil
+}
+
+func (wal *Wal) openOlderSegment(id uint32) (*segment, error) {
+	var seg *segment
+	var err error
+	if wal.options.ReadOnly {
+		seg, err = openSegmentReadOnly(wal.options.Dir, wal.options.SegmentFileSuffix, id)
+	} else if wal.fds == nil {
+		seg, err = openSegment(wal.options.Dir, wal.options.SegmentFileSuffix, id)
+	} else {
+		seg, err = openSealedSegment(wal.options.Dir, wal.options.SegmentFileSuffix, id)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	seg.cache = wal.options.BlockCache
+	if wal.fds != nil {
+		wal.fds.add(seg)
+	}
+	return seg, nil
+}
+
 func (wal *Wal) Write(data []byte) (*Chunk, error) {
+	if wal.options.ReadOnly {
+		return nil, ErrReadOnly
+	}
+
 	wal.mu.Lock()
 	defer wal.mu.Unlock()
 
 	dataSize := len(data)
 	maxRequiredCapacity := int64(wal.activeSegment.calMaxRequiredCapacity(dataSize))
 
-	if maxRequiredCapacity > wal.options.SegmentSize {
+	if maxRequiredCapacity+segmentHeaderSize > wal.options.SegmentSize {
 		return nil, errors.New("required capacity is larger than segment Size")
 	}
 
-	if maxRequiredCapacity+wal.activeSegment.Size() > wal.options.SegmentSize {
-		if err := wal.switchNewSegment(); err != nil {
+	if maxRequiredCapacity+wal.activeSegment.dataOffset+wal.activeSegment.Size() > wal.options.SegmentSize {
+		if err := wal.switchNewSegment(0); err != nil {
 			return nil, err
 		}
 	}
@@ -173,12 +316,84 @@ func (wal *Wal) Write(data []byte) (*Chunk, error) {
 	if err != nil {
 		return nil, err
 	}
+	wal.notifyWritten()
+
+	if err = wal.syncWritten(pos.Size); err != nil {
+		return nil, err
+	}
+	return pos, nil
+}
+
+// WriteAll writes the records in order like Write, the records in the same segment are written by a single write.
+// Nothing is written if a record is too large, a failed write may leave a part of the records written.
+func (wal *Wal) WriteAll(data [][]byte) ([]*Chunk, error) {
+	if wal.options.ReadOnly {
+		return nil, ErrReadOnly
+	}
+
+	wal.mu.Lock()
+	defer wal.mu.Unlock()
+
+	for _, d := range data {
+		if int64(wal.activeSegment.calMaxRequiredCapacity(len(d)))+segmentHeaderSize > wal.options.SegmentSize {
+			return nil, errors.New("required capacity is larger than segment Size")
+		}
+	}
+
+	buffer := bytebufferpool.Get()
+	buffer.Reset()
+	defer bytebufferpool.Put(buffer)
+
+	// 缓冲的 chunk 在切换 segment 前写入当前的 active segment
+	offset := wal.activeSegment.Size()
+	flush := func() error {
+		if len(buffer.B) == 0 {
+			return nil
+		}
+		err := wal.activeSegment.writeToSegment(buffer, offset)
+		buffer.Reset()
+		return err
+	}
+
+	positions := make([]*Chunk, 0, len(data))
+	var written uint32
+	for _, d := range data {
+		maxRequiredCapacity := int64(wal.activeSegment.calMaxRequiredCapacity(len(d)))
+		if maxRequiredCapacity+wal.activeSegment.dataOffset+wal.activeSegment.Size() > wal.options.SegmentSize {
+			if err := flush(); err != nil {
+				return nil, err
+			}
+			if err := wal.switchNewSegment(0); err != nil {
+				return nil, err
+			}
+			offset = wal.activeSegment.Size()
+		}
 
+		pos, err := wal.activeSegment.writeToBuffer(d, buffer)
+		if err != nil {
+			return nil, err
+		}
+		positions = append(positions, pos)
+		written += pos.Size
+	}
+	if err := flush(); err != nil {
+		return nil, err
+	}
+	wal.notifyWritten()
+
+	if err := wal.syncWritten(written); err != nil {
+		return nil, err
+	}
+	return positions, nil
+}
+
+// syncWritten syncs the active segment after size bytes are written if the Sync option requires it.
+func (wal *Wal) syncWritten(size uint32) error {
 	needSync := false
 	if wal.options.Sync == 1 {
 		needSync = true
 	} else if wal.options.Sync == 2 {
-		wal.byteWritten += pos.Size
+		wal.byteWritten += size
 		if wal.byteWritten >= wal.options.BytesBeforeSync {
 			needSync = true
 			wal.byteWritten = 0
@@ -186,12 +401,9 @@ func (wal *Wal) Write(data []byte) (*Chunk, error) {
 	}
 
 	if needSync {
-		if err = wal.Sync(); err != nil {
-			return nil, err
-		}
+		return wal.Sync()
 	}
-
-	return pos, nil
+	return nil
 }
 
 func (wal *Wal) Read(chunk *Chunk) ([]byte, error) {
@@ -211,41 +423,172 @@ func (wal *Wal) Read(chunk *Chunk) ([]byte, error) {
 	return segment.Read(chunk.BlockIndex, chunk.BlockOffset)
 }
 
-func (wal *Wal) switchNewSegment() error {
+// switchNewSegment seals the active segment, the id of the new active segment skips the reserved ids.
+func (wal *Wal) switchNewSegment(reserved uint32) error {
 	oldSegment := wal.activeSegment
-	if err := oldSegment.Sync(); err != nil {
+	if err := oldSegment.truncate(); err != nil {
+		return err
+	}
+	if err := wal.syncSegment(oldSegment); err != nil {
 		return err
 	}
 
-	newSegment, err := openSegment(wal.options.Dir, wal.options.SegmentFileSuffix, oldSegment.id+1)
+	newSegment, err := wal.createSegment(oldSegment.id + 1 + reserved)
 	if err != nil {
 		return err
 	}
 
 	wal.activeSegment = newSegment
 	wal.olderSegments[int(oldSegment.id)] = oldSegment
+	if wal.fds != nil {
+		wal.fds.add(oldSegment)
+	}
+	if wal.options.SwitchObserver != nil {
+		wal.options.SwitchObserver(oldSegment.id, newSegment.id)
+	}
 	return nil
 }
 
 func (wal *Wal) SwitchNewSegmentForce() (uint32, error) {
+	if wal.options.ReadOnly {
+		return 0, ErrReadOnly
+	}
+
 	wal.mu.Lock()
 	defer wal.mu.Unlock()
 
 	prevSegId := wal.activeSegment.id
-	return prevSegId, wal.switchNewSegment()
+	return prevSegId, wal.switchNewSegment(0)
+}
+
+// SwitchNewSegmentReserve is SwitchNewSegmentForce which reserves the n ids after the sealed segment, the segments
+// with the reserved ids are written elsewhere and added by ReplaceSegments, e.g. the segments written by merge.
+func (wal *Wal) SwitchNewSegmentReserve(n uint32) (uint32, error) {
+	if wal.options.ReadOnly {
+		return 0, ErrReadOnly
+	}
+
+	wal.mu.Lock()
+	defer wal.mu.Unlock()
+
+	prevSegId := wal.activeSegment.id
+	return prevSegId, wal.switchNewSegment(n)
+}
+
+// ReplaceSegments reopens the sealed segments with the given ids after their files are replaced, e.g. by merge,
+// the segments whose files are removed are dropped and the new files are added. The replaced segments are closed once the reads on them finish.
+func (wal *Wal) ReplaceSegments(ids []uint32) error {
+	if wal.options.ReadOnly {
+		return ErrReadOnly
+	}
+
+	wal.mu.Lock()
+	defer wal.mu.Unlock()
+
+	segments := make(map[int]*segment)
+	for _, id := range ids {
+		if id >= wal.activeSegment.id {
+			return fmt.Errorf("can not replace the active segment: %d", id)
+		}
+
+		path := JoinSegmentPath(wal.options.Dir, wal.options.SegmentFileSuffix, id)
+		if _, err := os.Stat(path); err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return err
+		}
+
+		seg, err := wal.openOlderSegment(id)
+		if err != nil {
+			for _, s := range segments {
+				_ = s.Close()
+			}
+			return err
+		}
+		segments[int(id)] = seg
+	}
+
+	for _, id := range ids {
+		if seg, ok := wal.olderSegments[int(id)]; ok {
+			if err := seg.retire(); err != nil {
+				return err
+			}
+			delete(wal.olderSegments, int(id))
+		}
+	}
+	for id, seg := range segments {
+		wal.olderSegments[id] = seg
+	}
+	return nil
+}
+
+// SegmentIds returns the ids of all segments in ascending order, the last one is the active segment.
+func (wal *Wal) SegmentIds() []uint32 {
+	wal.mu.RLock()
+	defer wal.mu.RUnlock()
+
+	ids := make([]uint32, 0, len(wal.olderSegments)+1)
+	for _, seg := range wal.olderSegments {
+		ids = append(ids, seg.id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i] < ids[j]
+	})
+	return append(ids, wal.activeSegment.id)
+}
+
+// ActiveSegmentId returns the id of the active segment.
+func (wal *Wal) ActiveSegmentId() uint32 {
+	wal.mu.RLock()
+	defer wal.mu.RUnlock()
+
+	return wal.activeSegment.id
+}
+
+// SegmentSizes returns the size of the data written to each segment, the headers and the preallocated space
+// are not counted.
+func (wal *Wal) SegmentSizes() map[uint32]int64 {
+	wal.mu.RLock()
+	defer wal.mu.RUnlock()
+
+	sizes := make(map[uint32]int64, len(wal.olderSegments)+1)
+	for _, seg := range wal.olderSegments {
+		sizes[seg.id] = seg.Size()
+	}
+	sizes[wal.activeSegment.id] = wal.activeSegment.Size()
+	return sizes
 }
 
 func (wal *Wal) Sync() error {
+	if wal.options.ReadOnly {
+		return nil
+	}
+
 	wal.mu.Lock()
 	defer wal.mu.Unlock()
 
-	return wal.activeSegment.Sync()
+	return wal.syncSegment(wal.activeSegment)
+}
+
+func (wal *Wal) syncSegment(seg *segment) error {
+	if wal.options.SyncObserver == nil {
+		return seg.Sync()
+	}
+
+	start := time.Now()
+	err := seg.Sync()
+	wal.options.SyncObserver(time.Since(start))
+	return err
 }
 
 func (wal *Wal) Close() error {
 	wal.mu.Lock()
 	defer wal.mu.Unlock()
 
+	wal.closed = true
+	wal.notifyWritten()
+
 	for _, seg := range wal.olderSegments {
 		if !seg.closed {
 			if err := seg.Close(); err != nil {
@@ -254,10 +597,20 @@ func (wal *Wal) Close() error {
 		}
 	}
 
+	// 释放预分配的空间，重新打开时会再次预分配
+	if wal.options.Preallocate && wal.activeSegment.header.version > 0 && !wal.activeSegment.closed {
+		if err := wal.activeSegment.truncate(); err != nil {
+			return err
+		}
+	}
 	return wal.activeSegment.Close()
 }
 
 func (wal *Wal) Delete() error {
+	if wal.options.ReadOnly {
+		return ErrReadOnly
+	}
+
 	wal.mu.Lock()
 	defer wal.mu.Unlock()
 
@@ -4,12 +4,17 @@ import (
 	"github.com/stretchr/testify/assert"
 	"io"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestWal_Write(t *testing.T) {
-	wal, err := Open(*DefaultOptions)
+	options := *DefaultOptions
+	options.Dir = t.TempDir()
+	wal, err := Open(options)
 	assert.Nil(t, err)
 	defer removeWal(wal)
 
@@ -26,13 +31,13 @@ func TestWal_Write(t *testing.T) {
 
 func TestWal_WriteLarge(t *testing.T) {
 	wal, err := Open(Options{
-		Dir:         os.TempDir(),
-		SegmentSize: blockSize * 10,
+		Dir:         t.TempDir(),
+		SegmentSize: DefaultBlockSize * 10,
 	})
 	assert.Nil(t, err)
 	defer removeWal(wal)
 
-	data := []byte(strings.Repeat("x", blockSize*1))
+	data := []byte(strings.Repeat("x", DefaultBlockSize*1))
 	chunk, err := wal.Write(data)
 	assert.Nil(t, err)
 	assert.Equal(t, uint32(0), chunk.BlockIndex)
@@ -46,13 +51,13 @@ func TestWal_WriteLarge(t *testing.T) {
 
 func TestWal_WriteTooLarge(t *testing.T) {
 	wal, err := Open(Options{
-		Dir:         os.TempDir(),
-		SegmentSize: blockSize * 10,
+		Dir:         t.TempDir(),
+		SegmentSize: DefaultBlockSize * 10,
 	})
 	assert.Nil(t, err)
 	defer removeWal(wal)
 
-	data := []byte(strings.Repeat("x", blockSize*10-chunkHeaderSize))
+	data := []byte(strings.Repeat("x", DefaultBlockSize*10-chunkHeaderSize))
 	chunk, err := wal.Write(data)
 	assert.Nil(t, chunk)
 	assert.NotNil(t, err)
@@ -60,13 +65,13 @@ func TestWal_WriteTooLarge(t *testing.T) {
 
 func TestWal_WriteAndSwitchSegment(t *testing.T) {
 	wal, err := Open(Options{
-		Dir:         os.TempDir(),
-		SegmentSize: blockSize * 5,
+		Dir:         t.TempDir(),
+		SegmentSize: DefaultBlockSize * 5,
 	})
 	assert.Nil(t, err)
 	defer removeWal(wal)
 
-	data := []byte(strings.Repeat("x", blockSize-chunkHeaderSize))
+	data := []byte(strings.Repeat("x", DefaultBlockSize-chunkHeaderSize))
 	chunk, err := wal.Write(data)
 	assert.Nil(t, err)
 	assert.Equal(t, uint32(0), chunk.BlockIndex)
@@ -76,16 +81,62 @@ func TestWal_WriteAndSwitchSegment(t *testing.T) {
 	assert.Equal(t, uint32(1), chunk2.BlockIndex)
 }
 
+func TestWal_WriteAll(t *testing.T) {
+	dir := t.TempDir()
+	wal, err := Open(Options{
+		Dir:         dir,
+		SegmentSize: DefaultBlockSize * 5,
+	})
+	assert.Nil(t, err)
+
+	var data [][]byte
+	for i := 0; i < 100; i++ {
+		data = append(data, []byte(strings.Repeat(strconv.Itoa(i), 1000)))
+	}
+	_, err = wal.Write([]byte("first"))
+	assert.Nil(t, err)
+	chunks, err := wal.WriteAll(data)
+	assert.Nil(t, err)
+	assert.Equal(t, len(data), len(chunks))
+	// the records are written across the segments
+	assert.True(t, chunks[len(chunks)-1].SegmentId > 1)
+
+	_, err = wal.WriteAll([][]byte{[]byte("abc"), make([]byte, DefaultBlockSize*5)})
+	assert.NotNil(t, err)
+	last, err := wal.Write([]byte("last"))
+	assert.Nil(t, err)
+
+	assert.Nil(t, wal.Close())
+	wal, err = Open(Options{
+		Dir:         dir,
+		SegmentSize: DefaultBlockSize * 5,
+	})
+	assert.Nil(t, err)
+	defer removeWal(wal)
+	for i, chunk := range chunks {
+		ret, err := wal.Read(chunk)
+		assert.Nil(t, err)
+		assert.Equal(t, data[i], ret)
+	}
+	// nothing is written if a record is too large
+	ret, err := wal.Read(last)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("last"), ret)
+	assert.Equal(t, chunks[len(chunks)-1].SegmentId, last.SegmentId)
+	assert.Equal(t, chunks[len(chunks)-1].BlockIndex*DefaultBlockSize+chunks[len(chunks)-1].BlockOffset+chunks[len(chunks)-1].Size,
+		last.BlockIndex*DefaultBlockSize+last.BlockOffset)
+}
+
 func TestWal_Read(t *testing.T) {
 	wal, err := Open(Options{
-		Dir:         os.TempDir(),
-		SegmentSize: blockSize * 15,
+		Dir:         t.TempDir(),
+		SegmentSize: DefaultBlockSize * 15,
 	})
 	assert.Nil(t, err)
 	defer removeWal(wal)
 
 	data := []byte("foo")
-	loopTime := blockSize
+	loopTime := DefaultBlockSize
 
 	// write
 	positions := make([]*Chunk, loopTime)
@@ -106,14 +157,14 @@ func TestWal_Read(t *testing.T) {
 
 func TestWal_NewIterator(t *testing.T) {
 	wal, err := Open(Options{
-		Dir:         os.TempDir(),
-		SegmentSize: blockSize,
+		Dir:         t.TempDir(),
+		SegmentSize: DefaultBlockSize,
 	})
 	assert.Nil(t, err)
 	defer removeWal(wal)
 
 	data := []byte("foo")
-	loopTime := blockSize
+	loopTime := DefaultBlockSize
 
 	// write
 	for i := 0; i < loopTime; i++ {
@@ -138,8 +189,8 @@ func TestWal_NewIterator(t *testing.T) {
 
 func TestWal_ReadButFailed(t *testing.T) {
 	wal, err := Open(Options{
-		Dir:         os.TempDir(),
-		SegmentSize: blockSize * 15,
+		Dir:         t.TempDir(),
+		SegmentSize: DefaultBlockSize * 15,
 	})
 	assert.Nil(t, err)
 	defer removeWal(wal)
@@ -153,8 +204,8 @@ func TestWal_ReadButFailed(t *testing.T) {
 
 func TestWal_Close(t *testing.T) {
 	wal, err := Open(Options{
-		Dir:         os.TempDir(),
-		SegmentSize: blockSize * 15,
+		Dir:         t.TempDir(),
+		SegmentSize: DefaultBlockSize * 15,
 	})
 	assert.Nil(t, err)
 	defer removeWal(wal)
@@ -178,7 +229,7 @@ func TestWal_Delete(t *testing.T) {
 
 	wal, err := Open(Options{
 		Dir:         tempDir,
-		SegmentSize: blockSize * 15,
+		SegmentSize: DefaultBlockSize * 15,
 	})
 	assert.Nil(t, err)
 
@@ -195,7 +246,7 @@ func TestWal_Delete(t *testing.T) {
 	// reopen
 	wal, err = Open(Options{
 		Dir:         tempDir,
-		SegmentSize: blockSize * 15,
+		SegmentSize: DefaultBlockSize * 15,
 	})
 	assert.Nil(t, err)
 	defer removeWal(wal)
@@ -207,3 +258,240 @@ func removeWal(wal *Wal) {
 	_ = wal.Close()
 	_ = os.RemoveAll(wal.options.Dir)
 }
+
+func TestWal_BlockSize(t *testing.T) {
+	sizes := []int{0, 1, 100, 4 * KB, 40 * KB, 64 * KB, 100 * KB, 2 * MB}
+	for _, bs := range []uint32{MinBlockSize, DefaultBlockSize, 256 * KB, MaxBlockSize} {
+		options := Options{
+			Dir:               t.TempDir(),
+			SegmentSize:       16 * MB,
+			SegmentFileSuffix: SegmentSuffix,
+			BlockSize:         bs,
+		}
+		wal, err := Open(options)
+		assert.Nil(t, err)
+
+		var values [][]byte
+		var positions []*Chunk
+		for i := 0; i < 3; i++ {
+			for _, size := range sizes {
+				val := []byte(strings.Repeat(string(rune('a'+i)), size))
+				chunk, err := wal.Write(val)
+				assert.Nil(t, err)
+				values = append(values, val)
+				positions = append(positions, chunk)
+			}
+		}
+
+		for i, pos := range positions {
+			ret, err := wal.Read(pos)
+			assert.Nil(t, err, "block size %d", bs)
+			assert.Equal(t, string(values[i]), string(ret), "block size %d", bs)
+		}
+
+		// reopen with another block size, the existing segments keep their own one
+		assert.Nil(t, wal.Close())
+		options.BlockSize = MinBlockSize
+		wal, err = Open(options)
+		assert.Nil(t, err)
+		assert.Equal(t, bs, wal.activeSegment.blockSize)
+
+		idx := 0
+		iter := wal.NewIterator()
+		for {
+			ret, _, err := iter.Next()
+			if err == io.EOF {
+				break
+			}
+			assert.Nil(t, err, "block size %d", bs)
+			assert.Equal(t, string(values[idx]), string(ret), "block size %d", bs)
+			idx++
+		}
+		assert.Equal(t, len(values), idx)
+		removeWal(wal)
+	}
+}
+
+func TestWal_InvalidBlockSize(t *testing.T) {
+	_, err := Open(Options{
+		Dir:         t.TempDir(),
+		SegmentSize: 16 * MB,
+		BlockSize:   MaxBlockSize + 1,
+	})
+	assert.NotNil(t, err)
+}
+
+func TestWal_ReplaceSegments(t *testing.T) {
+	wal, err := Open(Options{
+		Dir:         t.TempDir(),
+		SegmentSize: DefaultBlockSize + segmentHeaderSize,
+	})
+	assert.Nil(t, err)
+	defer removeWal(wal)
+
+	data := []byte(strings.Repeat("x", DefaultBlockSize-chunkHeaderSize*2))
+	var positions []*Chunk
+	for i := 0; i < 3; i++ {
+		chunk, err := wal.Write(data)
+		assert.Nil(t, err)
+		positions = append(positions, chunk)
+	}
+
+	// the old segment being read is closed after the read finishes
+	old := wal.olderSegments[1]
+	assert.Nil(t, old.acquire())
+	assert.Nil(t, wal.ReplaceSegments([]uint32{1, 2}))
+	assert.False(t, old.closed)
+	old.release()
+	assert.True(t, old.closed)
+	assert.NotEqual(t, old, wal.olderSegments[1])
+
+	for _, pos := range positions {
+		ret, err := wal.Read(pos)
+		assert.Nil(t, err)
+		assert.Equal(t, data, ret)
+	}
+
+	assert.NotNil(t, wal.ReplaceSegments([]uint32{wal.activeSegment.id}))
+}
+
+func TestWal_SwitchNewSegmentReserve(t *testing.T) {
+	dir := t.TempDir()
+	wal, err := Open(Options{
+		Dir:               dir,
+		SegmentSize:       32 * MB,
+		SegmentFileSuffix: SegmentSuffix,
+	})
+	assert.Nil(t, err)
+	defer removeWal(wal)
+
+	_, err = wal.Write([]byte("a"))
+	assert.Nil(t, err)
+	prevSegId, err := wal.SwitchNewSegmentReserve(2)
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(1), prevSegId)
+	assert.Equal(t, []uint32{1, 4}, wal.SegmentIds())
+
+	// a segment with a reserved id is written elsewhere and added
+	other, err := Open(Options{
+		Dir:               filepath.Join(dir, "other"),
+		SegmentSize:       32 * MB,
+		SegmentFileSuffix: SegmentSuffix,
+		FirstSegmentId:    2,
+	})
+	assert.Nil(t, err)
+	pos, err := other.Write([]byte("b"))
+	assert.Nil(t, err)
+	assert.Nil(t, other.Close())
+	assert.Nil(t, os.Rename(JoinSegmentPath(filepath.Join(dir, "other"), SegmentSuffix, 2), JoinSegmentPath(dir, SegmentSuffix, 2)))
+	assert.Nil(t, wal.ReplaceSegments([]uint32{2}))
+	assert.Equal(t, []uint32{1, 2, 4}, wal.SegmentIds())
+	data, err := wal.Read(pos)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("b"), data)
+}
+
+func TestWal_IteratorChunkSize(t *testing.T) {
+	wal, err := Open(Options{
+		Dir:         t.TempDir(),
+		SegmentSize: DefaultBlockSize * 10,
+		RecordHash:  true,
+	})
+	assert.Nil(t, err)
+	defer removeWal(wal)
+
+	// the positions returned by the iterator have the same sizes as the written ones
+	var written []*Chunk
+	for _, n := range []int{3, DefaultBlockSize - 20, DefaultBlockSize * 3, 100} {
+		chunk, err := wal.Write([]byte(strings.Repeat("x", n)))
+		assert.Nil(t, err)
+		written = append(written, chunk)
+	}
+
+	iter := wal.NewIterator()
+	for _, chunk := range written {
+		_, pos, err := iter.Next()
+		assert.Nil(t, err)
+		assert.Equal(t, chunk, pos)
+	}
+}
+
+func TestWal_ReadOnly(t *testing.T) {
+	dir := t.TempDir()
+	_, err := Open(Options{Dir: dir, SegmentSize: 32 * MB, ReadOnly: true})
+	assert.NotNil(t, err)
+
+	wal, err := Open(Options{Dir: dir, SegmentSize: 32 * MB, Preallocate: true, MaxOpenSegments: 1})
+	assert.Nil(t, err)
+	defer func() {
+		_ = wal.Close()
+	}()
+	pos, err := wal.Write([]byte("hello"))
+	assert.Nil(t, err)
+
+	// a record torn by the writer is the end of the data
+	_, err = wal.activeSegment.fd.WriteAt([]byte{1, 2, 3, 4, 5, 0, 0}, segmentHeaderSize+int64(pos.Size))
+	assert.Nil(t, err)
+
+	reader, err := Open(Options{Dir: dir, SegmentSize: 32 * MB, ReadOnly: true, MaxOpenSegments: 1})
+	assert.Nil(t, err)
+	assert.Nil(t, reader.fds)
+	assert.Equal(t, int64(pos.Size), reader.activeSegment.Size())
+
+	data, err := reader.Read(pos)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("hello"), data)
+
+	_, err = reader.Write([]byte("world"))
+	assert.Equal(t, ErrReadOnly, err)
+	_, err = reader.SwitchNewSegmentForce()
+	assert.Equal(t, ErrReadOnly, err)
+	assert.Nil(t, reader.Close())
+}
+
+func TestWal_SegmentSizes(t *testing.T) {
+	options := *DefaultOptions
+	options.Dir = t.TempDir()
+	wal, err := Open(options)
+	assert.Nil(t, err)
+	defer removeWal(wal)
+
+	_, err = wal.Write([]byte(strings.Repeat("x", 10)))
+	assert.Nil(t, err)
+	_, err = wal.SwitchNewSegmentForce()
+	assert.Nil(t, err)
+	_, err = wal.Write([]byte(strings.Repeat("x", 20)))
+	assert.Nil(t, err)
+
+	ids := wal.SegmentIds()
+	assert.Equal(t, map[uint32]int64{
+		ids[0]: 10 + chunkHeaderSize,
+		ids[1]: 20 + chunkHeaderSize,
+	}, wal.SegmentSizes())
+}
+
+func TestWal_Observers(t *testing.T) {
+	var syncs int
+	var switched []uint32
+	options := *DefaultOptions
+	options.Dir = t.TempDir()
+	options.SyncObserver = func(d time.Duration) {
+		syncs++
+	}
+	options.SwitchObserver = func(sealedId uint32, newId uint32) {
+		switched = append(switched, sealedId, newId)
+	}
+	wal, err := Open(options)
+	assert.Nil(t, err)
+	defer removeWal(wal)
+
+	_, err = wal.Write([]byte("x"))
+	assert.Nil(t, err)
+	assert.Nil(t, wal.Sync())
+	assert.Equal(t, 1, syncs)
+
+	prevSegId, err := wal.SwitchNewSegmentForce()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, syncs)
+	assert.Equal(t, []uint32{prevSegId, prevSegId + 1}, switched)
+}
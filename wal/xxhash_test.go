@@ -0,0 +1,14 @@
+package wal
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestXXHash64(t *testing.T) {
+	assert.Equal(t, uint64(0xEF46DB3751D8E999), xxhash64([]byte("")))
+	assert.Equal(t, uint64(0xD24EC4F1A98C6E5B), xxhash64([]byte("a")))
+	assert.Equal(t, uint64(0x44BC2CF5AD770999), xxhash64([]byte("abc")))
+	assert.Equal(t, uint64(0xCFE1F278FA89835C), xxhash64([]byte("abcdefghijklmnopqrstuvwxyz")))
+	assert.Equal(t, uint64(0xE04A477F19EE145D), xxhash64([]byte("12345678901234567890123456789012345678901234567890123456789012345678901234567890")))
+}